@@ -2,150 +2,1284 @@ package filesrv
 
 import (
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/simonz05/util/log"
+	"golang.org/x/sync/singleflight"
 )
 
+// ErrTooManyReaders is returned by the cache when an entry already has the
+// maximum number of concurrent readers.
+var ErrTooManyReaders = errors.New("filesrv: too many readers")
+
 type memoryCacheFilesystem struct {
 	fs          http.FileSystem
 	evictList   *list.List
 	cache       map[string]*list.Element
+	keys        map[string]map[string]bool // surrogate key -> names
+	recent      map[string]fetch
+	missing     map[string]time.Time // key -> expiry of negative entries
+	varies      map[string][]string  // key without vary -> headers the file varies by
+	negativeTTL time.Duration
+	dedupWindow time.Duration
 	mux         sync.RWMutex
 	maxSize     int64
 	size        int64
 	maxItems    int
 	items       int
+	maxReaders  int
+	paranoid    bool
+	gzipMax     int64
+	brotliMax   int64
+	brotliLevel int
+	extTTL      map[string]time.Duration
+	ttlDefault  time.Duration
+	staleGrace  time.Duration
+	flight      singleflight.Group // origin fetches of missed entries
 	invalidator *cacheInvalidator
+	broadcaster PurgeBroadcaster
+	log         Logger
+	onEvict     func(name string, size int64, reason EvictReason)
+	evicted     []eviction // removed under the lock, for onEvict
+
+	// statistics, updated atomically
+	hits      int64
+	misses    int64
+	negative  int64
+	evictions int64
+}
+
+// CacheStats describes the effectiveness and state of a cache.
+type CacheStats struct {
+	Hits      int64 // opens served from the cache
+	Misses    int64 // opens fetched from the underlying filesystem
+	Negative  int64 // opens failed by a file remembered as missing
+	Items     int64 // entries held
+	Size      int64 // bytes held
+	Evictions int64 // entries evicted to stay within the limits
+}
+
+// CacheStatter is implemented by the filesystems returned by NewCache and
+// NewCacheWithOptions.
+type CacheStatter interface {
+	Stats() CacheStats
+}
+
+// CacheOptions configures a cache created by NewCacheWithOptions.
+type CacheOptions struct {
+	// MaxItems is the maximum number of entries held by the cache.
+	MaxItems int
+
+	// MaxSize is the maximum number of bytes held by the cache. Files
+	// larger than MaxSize are served straight through without being
+	// cached, so they don't evict the rest of the cache. Zero means no
+	// limit.
+	MaxSize int64
+
+	// MaxReaders caps the number of concurrent readers of a single entry.
+	// Opening an entry beyond the cap fails with ErrTooManyReaders. Zero
+	// means no limit.
+	MaxReaders int
+
+	// DedupWindow is how long the result of an origin fetch is reused for
+	// requests of the same name, even after the entry has left the cache.
+	// Zero disables reuse.
+	DedupWindow time.Duration
+
+	// MaxRevalidateAge is how long an entry is kept by revalidating it
+	// with the origin. Older entries are evicted by the invalidator
+	// without asking the origin, so the next open fetches them again,
+	// even with StaleWhileRevalidate. Whichever of MaxRevalidateAge and the
+	// TTL or ExtensionTTL of an entry is shorter wins: an entry within its
+	// TTL is still evicted past MaxRevalidateAge, and an entry past its
+	// TTL is fetched again on the next open. It applies with NoRevalidate
+	// as well. Zero means entries are revalidated for as long as they are
+	// cached.
+	MaxRevalidateAge time.Duration
+
+	// NoRevalidate stops the invalidator from revalidating entries with
+	// the origin, for origins which push purges. See PurgeListener.
+	NoRevalidate bool
+
+	// InvalidatePeriod is how often the invalidator sweeps the cache.
+	// Zero means every 30 seconds; a negative period disables the
+	// invalidator.
+	InvalidatePeriod time.Duration
+
+	// InvalidatorMaxDiff bounds the number of adds and removes the
+	// invalidator tracks between sweeps. Past the bound it copies the
+	// cache state instead. Defaults to 1024.
+	InvalidatorMaxDiff int
+
+	// CollapseRevalidation shares a revalidation in progress with
+	// concurrent revalidations of the same entry, so the origin sees at
+	// most one HEAD request per entry at a time.
+	CollapseRevalidation bool
+
+	// TTL is how long entries are cached, independent of revalidation by
+	// the invalidator. An entry older than its TTL is fetched again on the
+	// next open, or refreshed with a conditional request when the origin
+	// supports it. Zero means entries don't expire.
+	TTL time.Duration
+
+	// NegativeTTL is how long files missing on the origin are remembered
+	// as missing, so repeated opens fail without asking the origin. The
+	// negative entries don't count towards MaxItems and MaxSize. Zero
+	// disables negative caching.
+	NegativeTTL time.Duration
+
+	// ExtensionTTL maps file extensions, such as ".html", to how long
+	// entries are cached. The "*" extension applies to files with other
+	// extensions. Files without an extension TTL use TTL.
+	ExtensionTTL map[string]time.Duration
+
+	// GzipMaxSize stores a gzipped copy of compressible entries of up to
+	// GzipMaxSize bytes next to the original, so responses compressed with
+	// gzip are served from it. The copy counts towards MaxSize. Zero
+	// disables the copies.
+	GzipMaxSize int64
+
+	// StaleWhileRevalidate keeps entries the invalidator finds stale for
+	// up to StaleWhileRevalidate instead of removing them. The first open
+	// of a stale entry fetches it again in the background, replacing it,
+	// while the stale entry is served. Stale entries which aren't replaced
+	// within the grace window are removed. Zero removes stale entries
+	// right away. Entries past MaxRevalidateAge are evicted, not kept
+	// stale.
+	StaleWhileRevalidate time.Duration
+
+	// BrotliMaxSize stores a brotli compressed copy of compressible
+	// entries of up to BrotliMaxSize bytes like GzipMaxSize, compressed at
+	// BrotliQuality, 0 to 11. Zero BrotliQuality means 4. The copies are
+	// compressed as entries are added, so high qualities slow down misses.
+	BrotliMaxSize int64
+	BrotliQuality int
+
+	// Logger logs lookups, evictions and revalidations.
+	Logger Logger
+
+	// OnEvict, if set, is called with the name, the size and the reason of
+	// every entry removed from the cache. It's called after the cache is
+	// unlocked, from the goroutine which removed the entry, so it may use
+	// the cache.
+	OnEvict func(name string, size int64, reason EvictReason)
+
+	// Broadcaster, if set, publishes the purges of Purge, PurgeAll and
+	// PurgeSurrogateKey to the other nodes of a cluster, and applies the
+	// purges they publish, so the nodes don't serve stale copies after a
+	// purge on one of them.
+	Broadcaster PurgeBroadcaster
+
+	// Paranoid stores a checksum of each entry, including its compressed
+	// copies, and verifies it on every hit. Entries which fail
+	// verification are logged and evicted. It's expensive, meant for
+	// chasing corruption bugs.
+	Paranoid bool
+}
+
+// EvictReason tells why an entry was removed from a cache.
+type EvictReason int
+
+const (
+	EvictCapacity    EvictReason = iota // to stay within MaxItems or MaxSize
+	EvictInvalidated                    // stale, expired or failing to read
+	EvictPurged                         // by Purge, PurgeAll or PurgeSurrogateKey
+	EvictReplaced                       // by a newer copy
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictInvalidated:
+		return "invalidated"
+	case EvictPurged:
+		return "purged"
+	case EvictReplaced:
+		return "replaced"
+	}
+
+	return ""
+}
+
+// maxNegativeEntries bounds the number of negative entries. Past the bound
+// misses aren't remembered until entries expire.
+const maxNegativeEntries = 10000
+
+// fetch is a recently completed origin fetch.
+type fetch struct {
+	file *file
+	at   time.Time
 }
 
-func NewCache(fs http.FileSystem, maxItems int, maxSize int) http.FileSystem {
+// Cache is a filesystem caching the files of another in memory. Close
+// stops its background revalidation of cached files.
+type Cache interface {
+	http.FileSystem
+	io.Closer
+}
+
+// NewCache returns a memory cache in front of fs holding up to maxItems
+// files of up to maxSize bytes in total.
+func NewCache(fs http.FileSystem, maxItems int, maxSize int) Cache {
+	return NewCacheWithOptions(fs, CacheOptions{
+		MaxItems: maxItems,
+		MaxSize:  int64(maxSize),
+	})
+}
+
+// NewCacheWithOptions returns a memory cache in front of fs configured by
+// opt.
+func NewCacheWithOptions(fs http.FileSystem, opt CacheOptions) Cache {
 	mc := &memoryCacheFilesystem{
-		maxItems:  maxItems,
-		maxSize:   int64(maxSize),
-		fs:        fs,
-		cache:     make(map[string]*list.Element),
-		evictList: list.New(),
+		maxItems:    opt.MaxItems,
+		maxSize:     opt.MaxSize,
+		maxReaders:  opt.MaxReaders,
+		dedupWindow: opt.DedupWindow,
+		paranoid:    opt.Paranoid,
+		gzipMax:     opt.GzipMaxSize,
+		brotliMax:   opt.BrotliMaxSize,
+		brotliLevel: opt.BrotliQuality,
+		extTTL:      opt.ExtensionTTL,
+		ttlDefault:  opt.TTL,
+		staleGrace:  opt.StaleWhileRevalidate,
+		fs:          fs,
+		cache:       make(map[string]*list.Element),
+		keys:        make(map[string]map[string]bool),
+		recent:      make(map[string]fetch),
+		missing:     make(map[string]time.Time),
+		varies:      make(map[string][]string),
+		negativeTTL: opt.NegativeTTL,
+		evictList:   list.New(),
+		log:         loggerOrDefault(opt.Logger),
+		onEvict:     opt.OnEvict,
+		broadcaster: opt.Broadcaster,
 	}
-	mc.invalidator = newCacheInvalidator(func(name string) {
+	var client *http.Client
+	var header http.Header
+
+	if hc, ok := fs.(httpClienter); ok {
+		client, header = hc.httpClient(), hc.staticHeader()
+	}
+
+	delfn := func(name string) {
 		mc.del(name)
-	})
+	}
+	stalefn := delfn
+
+	if mc.staleGrace > 0 {
+		stalefn = mc.markStale
+	}
+
+	mc.invalidator = newCacheInvalidator(delfn, stalefn, client, header, opt)
+
+	if mc.broadcaster != nil {
+		mc.broadcaster.Subscribe(mc.purgeMessage)
+	}
+
 	return mc
 }
 
+func (fs *memoryCacheFilesystem) logger() Logger {
+	return fs.log
+}
+
+// Close stops revalidating cached files with the origin. The cache keeps
+// serving files after it's closed.
+func (fs *memoryCacheFilesystem) Close() error {
+	return fs.invalidator.Close()
+}
+
+// refresher is implemented by filesystems which fetch a file again only
+// when it changed. The cache refreshes expired entries with it.
+type refresher interface {
+	Refresh(ctx context.Context, name, etag string, modtime time.Time) (http.File, error)
+}
+
+// httpClienter is implemented by filesystems which fetch files over HTTP.
+// The invalidator revalidates their files with the same client and static
+// header.
+type httpClienter interface {
+	httpClient() *http.Client
+	staticHeader() http.Header
+}
+
 type centry struct {
-	file *file
-	name string
+	file    *file
+	name    string
+	added   time.Time
+	sum     uint32    // checksum of the file in paranoid mode
+	expires time.Time // zero when the entry doesn't expire
+
+	// validated is when the file was fetched or last found unchanged by
+	// the origin, guarded by the cache's lock unlike added.
+	validated time.Time
+
+	// stale is when the invalidator found the entry stale, zero when it's
+	// fresh. refreshing is set once a background refresh of it started.
+	stale      time.Time
+	refreshing bool
 }
 
-func (fs *memoryCacheFilesystem) get(name string) (http.File, bool) {
+// expired reports whether the entry outlived its TTL.
+func (ent *centry) expired() bool {
+	return !ent.expires.IsZero() && time.Now().After(ent.expires)
+}
+
+// ttl returns how long the entry of key is cached or zero when it doesn't
+// expire.
+func (fs *memoryCacheFilesystem) ttl(key string) time.Duration {
+	if len(fs.extTTL) == 0 {
+		return fs.ttlDefault
+	}
+
+	if i := strings.IndexAny(key, "?#"); i >= 0 {
+		key = key[:i]
+	}
+
+	if ttl, ok := fs.extTTL[path.Ext(key)]; ok {
+		return ttl
+	} else if ttl, ok := fs.extTTL["*"]; ok {
+		return ttl
+	}
+
+	return fs.ttlDefault
+}
+
+// get returns a read clone of the cached file of name, or a file with its
+// metadata only when meta is set.
+func (fs *memoryCacheFilesystem) get(name string, meta bool) (http.File, bool, error) {
 	fs.mux.Lock()
-	defer fs.mux.Unlock()
+	defer fs.unlock()
 	ent, ok := fs.cache[name]
 
+	if expires, missing := fs.missing[name]; !ok && missing {
+		if time.Now().Before(expires) {
+			return nil, true, http.ErrMissingFile
+		}
+
+		delete(fs.missing, name)
+	}
+
 	if !ok {
-		return nil, false
+		return fs.getRecent(name)
+	}
+
+	cent := ent.Value.(*centry)
+	f := cent.file
+
+	if fs.paranoid && f.checksum() != cent.sum {
+		fs.log.Println("cache: checksum mismatch, evicting", name)
+		fs.removeElement(ent, EvictInvalidated)
+		delete(fs.recent, name)
+		return nil, false, nil
+	}
+
+	if cent.expired() {
+		// expired entries are kept for refreshers to refresh
+		if _, ok := fs.fs.(refresher); !ok {
+			fs.removeElement(ent, EvictInvalidated)
+		}
+
+		delete(fs.recent, name)
+		return nil, false, nil
+	}
+
+	if !cent.stale.IsZero() && time.Since(cent.stale) > fs.staleGrace {
+		fs.removeElement(ent, EvictInvalidated)
+		delete(fs.recent, name)
+		return nil, false, nil
 	}
 
 	fs.evictList.MoveToFront(ent)
-	f := ent.Value.(*centry).file
-	return f.readClone(), true
+
+	if meta {
+		rv := f.metaClone()
+		rv.(*file).cached = cent.validated
+		return rv, true, nil
+	}
+
+	if fs.maxReaders > 0 && f.Readers() >= fs.maxReaders {
+		return nil, true, ErrTooManyReaders
+	}
+
+	rv, err := f.readClone()
+
+	if err != nil {
+		fs.log.Println("cache: clone failed, evicting", name, err)
+		fs.removeElement(ent, EvictInvalidated)
+		delete(fs.recent, name)
+		return nil, false, nil
+	}
+
+	rv.(*file).cached = cent.validated
+	return rv, true, nil
 }
 
-func (fs *memoryCacheFilesystem) add(name string, f *file) http.File {
+// addMissing remembers the file of key as missing for the negative TTL.
+func (fs *memoryCacheFilesystem) addMissing(key string) {
 	fs.mux.Lock()
 	defer fs.mux.Unlock()
+	now := time.Now()
+
+	if len(fs.missing) >= maxNegativeEntries {
+		for k, expires := range fs.missing {
+			if now.After(expires) {
+				delete(fs.missing, k)
+			}
+		}
+
+		if len(fs.missing) >= maxNegativeEntries {
+			return
+		}
+	}
+
+	fs.missing[key] = now.Add(fs.negativeTTL)
+}
+
+// getRecent re-adds the result of a fetch of name completed within the
+// dedup window.
+func (fs *memoryCacheFilesystem) getRecent(name string) (http.File, bool, error) {
+	rf, ok := fs.recent[name]
+
+	if !ok || time.Since(rf.at) > fs.dedupWindow {
+		return nil, false, nil
+	}
+
+	f, err := fs.addLocked(name, rf.file)
+	return f, true, err
+}
+
+// addRecent records a completed fetch of name and forgets fetches which
+// have left the dedup window.
+func (fs *memoryCacheFilesystem) addRecent(name string, f *file) {
+	now := time.Now()
+
+	for k, rf := range fs.recent {
+		if now.Sub(rf.at) > fs.dedupWindow {
+			delete(fs.recent, k)
+		}
+	}
+
+	fs.recent[name] = fetch{file: f, at: now}
+}
+
+// ManifestEntry describes a cached file.
+type ManifestEntry struct {
+	ETag        string `json:"etag"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+}
 
+// Manifest returns the cached files with names starting with prefix. Files
+// cached for different origin headers are left out.
+func (fs *memoryCacheFilesystem) Manifest(prefix string) map[string]ManifestEntry {
+	fs.mux.RLock()
+	defer fs.mux.RUnlock()
+	m := make(map[string]ManifestEntry)
+
+	for name, ent := range fs.cache {
+		if !strings.HasPrefix(name, prefix) || strings.Contains(name, "#") {
+			continue
+		}
+
+		fi := ent.Value.(*centry).file.fi
+		m[name] = ManifestEntry{
+			ETag:        fi.etag,
+			Size:        fi.Size(),
+			ContentType: fi.contentType,
+		}
+	}
+
+	return m
+}
+
+// CacheEntry describes a cached file.
+type CacheEntry struct {
+	Name        string    `json:"name"` // cache key, the name and its variant, if any
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType"`
+	ETag        string    `json:"etag"`
+	ModTime     time.Time `json:"modtime"`
+	Age         int64     `json:"age"` // seconds since the file was cached
+}
+
+// Entries returns the cached files, most recently used first. Only their
+// metadata is copied.
+func (fs *memoryCacheFilesystem) Entries() []CacheEntry {
+	fs.mux.RLock()
+	defer fs.mux.RUnlock()
+	now := time.Now()
+	entries := make([]CacheEntry, 0, fs.evictList.Len())
+
+	for e := fs.evictList.Front(); e != nil; e = e.Next() {
+		ent := e.Value.(*centry)
+		fi := ent.file.fi
+		entries = append(entries, CacheEntry{
+			Name:        ent.name,
+			Size:        fi.Size(),
+			ContentType: fi.contentType,
+			ETag:        fi.etag,
+			ModTime:     fi.modtime,
+			Age:         int64(now.Sub(ent.added) / time.Second),
+		})
+	}
+
+	return entries
+}
+
+// Revalidate checks the cached entry name with the origin now and removes
+// it when it's stale.
+func (fs *memoryCacheFilesystem) Revalidate(name string) error {
+	fs.mux.RLock()
+	ent, ok := fs.cache[name]
+	fs.mux.RUnlock()
+
+	if !ok {
+		return nil
+	}
+
+	_, err := fs.invalidator.revalidate(ent.Value.(*centry))
+	return err
+}
+
+// Readers returns the number of concurrent readers of the cached entry
+// name.
+func (fs *memoryCacheFilesystem) Readers(name string) int {
+	fs.mux.RLock()
+	defer fs.mux.RUnlock()
+	ent, ok := fs.cache[name]
+
+	if !ok {
+		return 0
+	}
+
+	return ent.Value.(*centry).file.Readers()
+}
+
+func (fs *memoryCacheFilesystem) add(name string, f *file) (http.File, error) {
+	if err := f.buffer(); err != nil {
+		return nil, err
+	}
+
+	// compress before taking the lock
+	if f.gzbuf == nil && fs.gzipMax > 0 && f.fi.Size() <= fs.gzipMax && compressible(f.fi.contentType) {
+		f.gzbuf = gzipBytes(f.buf)
+	}
+
+	if f.brbuf == nil && fs.brotliMax > 0 && f.fi.Size() <= fs.brotliMax && compressible(f.fi.contentType) {
+		quality := fs.brotliLevel
+
+		if quality == 0 {
+			quality = defaultBrotliQuality
+		}
+
+		f.brbuf = brotliBytes(f.buf, quality)
+	}
+
+	fs.mux.Lock()
+	defer fs.unlock()
+
+	if fs.dedupWindow > 0 {
+		fs.addRecent(name, f)
+	}
+
+	return fs.addLocked(name, f)
+}
+
+func (fs *memoryCacheFilesystem) addLocked(name string, f *file) (http.File, error) {
 	// delete existing item
 	if v, ok := fs.cache[name]; ok {
-		fs.removeElement(v)
+		fs.removeElement(v, EvictReplaced)
+	}
+
+	// files larger than the cache are served without being cached
+	if fs.maxSize > 0 && f.size() > fs.maxSize {
+		return f.readClone()
 	}
 
 	// add new
-	ent := &centry{file: f, name: name}
+	now := time.Now()
+	ent := &centry{file: f, name: name, added: now, validated: now}
+
+	if fs.paranoid {
+		ent.sum = f.checksum()
+	}
+
+	if ttl := fs.ttl(name); ttl > 0 {
+		ent.expires = ent.added.Add(ttl)
+	}
+
 	fs.cache[name] = fs.evictList.PushFront(ent)
-	fs.size += f.fi.Size()
+	fs.size += f.size()
+
+	for _, key := range f.fi.surrogateKeys {
+		if fs.keys[key] == nil {
+			fs.keys[key] = make(map[string]bool)
+		}
+		fs.keys[key][name] = true
+	}
 
 	if fs.evictList.Len() > fs.maxItems {
 		fs.removeOldest()
 	}
 
+	for fs.maxSize > 0 && fs.size > fs.maxSize {
+		fs.removeOldest()
+	}
+
 	fs.invalidator.Add(ent)
 	return f.readClone()
 }
 
 func (fs *memoryCacheFilesystem) del(name string) bool {
 	fs.mux.Lock()
-	defer fs.mux.Unlock()
+	defer fs.unlock()
 	ent, ok := fs.cache[name]
+	delete(fs.recent, name)
 
 	if ok {
-		fs.removeElement(ent)
+		fs.removeElement(ent, EvictInvalidated)
 	}
 
 	return ok
 }
 
+// delContext drops the entry of name opened with ctx, the variant of the
+// origin and request headers of ctx.
+func (fs *memoryCacheFilesystem) delContext(ctx context.Context, name string) bool {
+	_, key := fs.cacheKeys(ctx, name)
+	return fs.del(key)
+}
+
+// markStale marks the entry name as stale, so it's refreshed in the
+// background when it's opened next.
+func (fs *memoryCacheFilesystem) markStale(name string) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	if ent, ok := fs.cache[name]; ok && ent.Value.(*centry).stale.IsZero() {
+		ent.Value.(*centry).stale = time.Now()
+	}
+}
+
+// refreshStale fetches the entry of key again in the background when it's
+// stale, replacing it with the file fetched. It fetches each stale entry
+// once; entries which fail to refresh are removed at the end of the grace
+// window.
+func (fs *memoryCacheFilesystem) refreshStale(ctx context.Context, key, name string) {
+	fs.mux.Lock()
+	ent, ok := fs.cache[key]
+
+	if !ok || ent.Value.(*centry).stale.IsZero() || ent.Value.(*centry).refreshing {
+		fs.mux.Unlock()
+		return
+	}
+
+	ent.Value.(*centry).refreshing = true
+	fs.mux.Unlock()
+
+	// the refresh outlives the request, but not the cache
+	bg := withOriginHeader(fs.invalidator.context(), originHeader(ctx))
+	bg = withRequestHeader(withForwarded(bg, forwarded(ctx)), requestHeader(ctx))
+
+	go func() {
+		_, err, _ := fs.flight.Do(key, func() (interface{}, error) {
+			f, err := openContext(bg, fs.fs, name)
+
+			if err == http.ErrMissingFile {
+				fs.del(key)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			if !f.(*file).cacheable() || !varyForwarded(bg, f.(*file).fi.vary) {
+				f.Close()
+				fs.del(key)
+				return f, nil
+			}
+
+			rv, err := fs.add(key, f.(*file))
+
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+
+			rv.Close()
+			return f, nil
+		})
+
+		if err != nil {
+			fs.log.Printf("cache: refresh %s: %v", key, err)
+		}
+	}()
+}
+
+// Purger is implemented by the filesystems returned by NewCache and
+// NewCacheWithOptions.
+type Purger interface {
+	// Purge removes name and its variants from the cache. It reports
+	// whether anything was removed.
+	Purge(name string) bool
+
+	// PurgeAll empties the cache.
+	PurgeAll()
+}
+
+// Messages of a PurgeBroadcaster other than names. A NUL byte doesn't occur
+// in names, which are URL paths.
+const (
+	purgeAllMessage = "\x00all"
+	purgeKeyMessage = "\x00key:" // followed by the surrogate key
+)
+
+// publish sends a purge message to the other nodes. They may hold entries
+// even when this node doesn't.
+func (fs *memoryCacheFilesystem) publish(msg string) {
+	if fs.broadcaster == nil {
+		return
+	}
+
+	if err := fs.broadcaster.Publish(msg); err != nil {
+		fs.log.Printf("cache: publish purge %q: %v", msg, err)
+	}
+}
+
+// purgeMessage applies a purge published by another node, without
+// publishing it again.
+func (fs *memoryCacheFilesystem) purgeMessage(msg string) {
+	switch {
+	case msg == purgeAllMessage:
+		fs.purgeAll()
+		fs.log.Printf("cache: broadcast purge all")
+	case strings.HasPrefix(msg, purgeKeyMessage):
+		key := msg[len(purgeKeyMessage):]
+		fs.log.Printf("cache: broadcast purge key %s (%d)", key, fs.purgeSurrogateKey(key))
+	default:
+		fs.log.Printf("cache: broadcast purge %s (%d)", msg, fs.purge(msg))
+	}
+}
+
+func (fs *memoryCacheFilesystem) Purge(name string) bool {
+	n := fs.purge(name)
+	fs.publish(name)
+	return n > 0
+}
+
+func (fs *memoryCacheFilesystem) PurgeAll() {
+	fs.purgeAll()
+	fs.publish(purgeAllMessage)
+}
+
+func (fs *memoryCacheFilesystem) purgeAll() {
+	fs.mux.Lock()
+	defer fs.unlock()
+
+	for _, ent := range fs.cache {
+		fs.removeElement(ent, EvictPurged)
+	}
+
+	fs.recent = make(map[string]fetch)
+	fs.missing = make(map[string]time.Time)
+	fs.varies = make(map[string][]string)
+}
+
+// purge removes name and its variants cached for different origin headers
+// and returns the number of entries removed.
+func (fs *memoryCacheFilesystem) purge(name string) int {
+	fs.mux.Lock()
+	defer fs.unlock()
+	n := 0
+
+	for key, ent := range fs.cache {
+		if key == name || strings.HasPrefix(key, name+"#") {
+			delete(fs.recent, key)
+			fs.removeElement(ent, EvictPurged)
+			n++
+		}
+	}
+
+	for key := range fs.missing {
+		if key == name || strings.HasPrefix(key, name+"#") {
+			delete(fs.missing, key)
+		}
+	}
+
+	for key := range fs.varies {
+		if key == name || strings.HasPrefix(key, name+"#") {
+			delete(fs.varies, key)
+		}
+	}
+
+	delete(fs.recent, name)
+	return n
+}
+
 // removeOldest removes the oldest item from the cache.
 func (fs *memoryCacheFilesystem) removeOldest() {
 	ent := fs.evictList.Back()
 
 	if ent != nil {
-		fs.removeElement(ent)
+		fs.removeElement(ent, EvictCapacity)
+		atomic.AddInt64(&fs.evictions, 1)
+	}
+}
+
+// Stats returns the statistics of the cache.
+func (fs *memoryCacheFilesystem) Stats() CacheStats {
+	fs.mux.RLock()
+	defer fs.mux.RUnlock()
+
+	return CacheStats{
+		Hits:      atomic.LoadInt64(&fs.hits),
+		Misses:    atomic.LoadInt64(&fs.misses),
+		Negative:  atomic.LoadInt64(&fs.negative),
+		Items:     int64(fs.evictList.Len()),
+		Size:      fs.size,
+		Evictions: atomic.LoadInt64(&fs.evictions),
+	}
+}
+
+// eviction is an entry removed from the cache, for OnEvict.
+type eviction struct {
+	name   string
+	size   int64
+	reason EvictReason
+}
+
+// unlock releases the write lock of the cache, then calls OnEvict for the
+// entries removed while it was held.
+func (fs *memoryCacheFilesystem) unlock() {
+	evicted := fs.evicted
+	fs.evicted = nil
+	fs.mux.Unlock()
+
+	for _, e := range evicted {
+		fs.onEvict(e.name, e.size, e.reason)
 	}
 }
 
 // removeElement is used to remove a given list element from the cache
-func (fs *memoryCacheFilesystem) removeElement(ent *list.Element) {
+func (fs *memoryCacheFilesystem) removeElement(ent *list.Element, reason EvictReason) {
 	fs.evictList.Remove(ent)
 	cent := ent.Value.(*centry)
-	fs.size -= cent.file.fi.Size()
+	fs.size -= cent.file.size()
 	delete(fs.cache, cent.name)
+
+	if fs.onEvict != nil {
+		fs.evicted = append(fs.evicted, eviction{cent.name, cent.file.size(), reason})
+	}
+
+	for _, key := range cent.file.fi.surrogateKeys {
+		delete(fs.keys[key], cent.name)
+
+		if len(fs.keys[key]) == 0 {
+			delete(fs.keys, key)
+		}
+	}
+
 	fs.invalidator.Del(cent)
 }
 
+// PurgeSurrogateKey removes all entries tagged with the surrogate key and
+// returns the number of entries removed.
+func (fs *memoryCacheFilesystem) PurgeSurrogateKey(key string) int {
+	n := fs.purgeSurrogateKey(key)
+	fs.publish(purgeKeyMessage + key)
+	return n
+}
+
+func (fs *memoryCacheFilesystem) purgeSurrogateKey(key string) int {
+	fs.mux.Lock()
+	defer fs.unlock()
+	n := 0
+
+	for name := range fs.keys[key] {
+		delete(fs.recent, name)
+
+		if ent, ok := fs.cache[name]; ok {
+			fs.removeElement(ent, EvictPurged)
+			n++
+		}
+	}
+
+	return n
+}
+
 func (fs *memoryCacheFilesystem) Open(name string) (http.File, error) {
-	log.Printf("cache: %s\n", name)
+	return fs.OpenContext(context.Background(), name)
+}
+
+// cached reports whether name fetched with the origin headers of ctx is
+// cached.
+func (fs *memoryCacheFilesystem) cached(ctx context.Context, name string) bool {
+	_, key := fs.cacheKeys(ctx, name)
+	fs.mux.RLock()
+	defer fs.mux.RUnlock()
+	_, ok := fs.cache[key]
+	return ok
+}
+
+// cacheKeys returns the cache key of name opened with ctx without and with the
+// request headers the file is known to vary by.
+func (fs *memoryCacheFilesystem) cacheKeys(ctx context.Context, name string) (base, key string) {
+	h := originHeader(ctx)
+	base = cacheKey(name, h)
+	fs.mux.RLock()
+	vary := fs.varies[base]
+	fs.mux.RUnlock()
+	return base, varyKey(name, h, vary, requestHeader(ctx))
+}
+
+// openConditional opens name missing in the cache for a conditional
+// request, which the origin may answer with 304 instead of the file. The
+// fetch is shared with concurrent requests with the same validators; a
+// changed file is cached unless it varies by request headers, an unchanged
+// one is fetched and cached in the background.
+func (fs *memoryCacheFilesystem) openConditional(ctx context.Context, key, name string) (http.File, error) {
+	inm, ims := conditional(ctx)
+	leader := false
+	v, err, _ := fs.flight.Do(key+"\x00"+inm+"\x00"+ims, func() (interface{}, error) {
+		leader = true
+		f, err := openContext(ctx, fs.fs, name)
+
+		if err == http.ErrMissingFile && fs.negativeTTL > 0 {
+			fs.addMissing(key)
+		} else if _, ok := err.(*notModifiedError); ok {
+			fs.fill(ctx, key, name)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if ff, ok := f.(*file); ok && ff.cacheable() && len(ff.fi.vary) == 0 {
+			return fs.add(key, ff)
+		}
 
-	if f, ok := fs.get(name); ok {
 		return f, nil
+	})
+
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		// the fetch was cancelled by the request which started it
+		if !leader && ctx.Err() == nil {
+			return fs.openConditional(ctx, key, name)
+		}
+
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	if leader {
+		return v.(http.File), nil
+	}
+
+	// the file the leader opened is read by it alone
+	if rv, ok, err := fs.get(key, false); ok {
+		return rv, err
+	}
+
+	return openContext(ctx, fs.fs, name)
+}
+
+// fill fetches and caches name in the background after the origin answered
+// a conditional miss with 304, so later requests for it are hits.
+func (fs *memoryCacheFilesystem) fill(ctx context.Context, key, name string) {
+	// the fill outlives the request, but not the cache
+	bg := withOriginHeader(fs.invalidator.context(), originHeader(ctx))
+	bg = withRequestHeader(bg, requestHeader(ctx))
+
+	go func() {
+		_, err, _ := fs.flight.Do(key, func() (interface{}, error) {
+			fs.mux.RLock()
+			ent, ok := fs.cache[key]
+			fs.mux.RUnlock()
+
+			// a request missing the file fetched it first
+			if ok && ent.Value.(*centry).file != nil {
+				return ent.Value.(*centry).file, nil
+			}
+
+			f, err := openContext(bg, fs.fs, name)
+
+			if err != nil {
+				return nil, err
+			}
+
+			// requests joining the fill read the file themselves
+			if !f.(*file).cacheable() || len(f.(*file).fi.vary) > 0 {
+				f.Close()
+				return f, nil
+			}
+
+			rv, err := fs.add(key, f.(*file))
+
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+
+			rv.Close()
+			return f, nil
+		})
+
+		if err != nil {
+			fs.log.Printf("cache: fill %s: %v", key, err)
+		}
+	}()
+}
+
+// fetch opens name from the underlying filesystem. An expired entry of key
+// is refreshed when the filesystem is a refresher; when the file didn't
+// change the file of the entry is returned and unchanged is set.
+func (fs *memoryCacheFilesystem) fetch(ctx context.Context, key, name string) (f http.File, unchanged bool, err error) {
+	rf, ok := fs.fs.(refresher)
+
+	if !ok {
+		f, err = openContext(ctx, fs.fs, name)
+		return f, false, err
+	}
+
+	fs.mux.RLock()
+	var stale *file
+
+	if ent, ok := fs.cache[key]; ok && ent.Value.(*centry).expired() {
+		stale = ent.Value.(*centry).file
+	}
+
+	fs.mux.RUnlock()
+
+	if stale == nil {
+		f, err = openContext(ctx, fs.fs, name)
+		return f, false, err
+	}
+
+	f, err = rf.Refresh(ctx, name, stale.fi.etag, stale.fi.modtime)
+
+	if err == ErrNotModified {
+		return stale, true, nil
+	} else if err != nil && ctx.Err() == nil {
+		fs.del(key)
+	}
+
+	return f, false, err
+}
+
+// renew restarts the TTL of the entry of key holding f, which the origin
+// reported unchanged, and returns a read clone of f. The entry is updated in
+// place rather than replaced, so it isn't reported as evicted. It reports
+// false when the entry was removed or replaced meanwhile.
+func (fs *memoryCacheFilesystem) renew(key string, f *file) (http.File, bool, error) {
+	fs.mux.Lock()
+	defer fs.unlock()
+	ent, ok := fs.cache[key]
+
+	if !ok || ent.Value.(*centry).file != f {
+		return nil, false, nil
 	}
 
-	f, err := fs.fs.Open(name)
+	cent := ent.Value.(*centry)
+	cent.validated = time.Now()
+	cent.expires = time.Time{}
+	cent.stale, cent.refreshing = time.Time{}, false
+
+	if ttl := fs.ttl(key); ttl > 0 {
+		cent.expires = cent.validated.Add(ttl)
+	}
+
+	fs.evictList.MoveToFront(ent)
+	rv, err := f.readClone()
 
 	if err != nil {
+		return nil, true, err
+	}
+
+	rv.(*file).cached = cent.validated
+	return rv, true, nil
+}
+
+// OpenContext opens name on behalf of a request. Files fetched with
+// different origin headers in ctx are cached as separate entries.
+// Concurrent misses of the same entry share a single origin fetch.
+func (fs *memoryCacheFilesystem) OpenContext(ctx context.Context, name string) (http.File, error) {
+	base, key := fs.cacheKeys(ctx, name)
+	fs.log.Printf("cache: %s\n", key)
+
+	if f, ok, err := fs.get(key, headRequest(ctx)); ok && f == nil && err == http.ErrMissingFile {
+		// files remembered as missing are counted apart from hits, and
+		// reported as misses since no cached file is served
+		atomic.AddInt64(&fs.negative, 1)
+		setCacheStatus(ctx, CacheMiss)
+		return nil, err
+	} else if ok {
+		atomic.AddInt64(&fs.hits, 1)
+		setCacheStatus(ctx, CacheHit)
+
+		if fs.staleGrace > 0 && err == nil {
+			fs.refreshStale(ctx, key, name)
+		}
+
+		return f, err
+	}
+
+	atomic.AddInt64(&fs.misses, 1)
+	setCacheStatus(ctx, CacheMiss)
+
+	// the metadata opened for HEAD requests isn't cached
+	if headRequest(ctx) {
+		return openContext(ctx, fs.fs, name)
+	}
+
+	if inm, ims := conditional(ctx); (inm != "" || ims != "") && !fs.cached(ctx, name) {
+		return fs.openConditional(ctx, key, name)
+	}
+
+	var rv http.File
+	leader := false
+	v, err, _ := fs.flight.Do(key, func() (interface{}, error) {
+		leader = true
+		f, unchanged, err := fs.fetch(ctx, key, name)
+
+		if err == http.ErrMissingFile && fs.negativeTTL > 0 {
+			fs.addMissing(key)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if unchanged {
+			var ok bool
+
+			if rv, ok, err = fs.renew(key, f.(*file)); ok {
+				return f, err
+			}
+		}
+
+		if rv = f; f.(*file).cacheable() && varyForwarded(ctx, f.(*file).fi.vary) {
+			key := key
+
+			// variants are cached by the request headers they vary by
+			if vary := f.(*file).fi.vary; len(vary) > 0 {
+				fs.mux.Lock()
+				fs.varies[base] = vary
+				fs.mux.Unlock()
+				key = varyKey(name, originHeader(ctx), vary, requestHeader(ctx))
+			}
+
+			if rv, err = fs.add(key, f.(*file)); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+
+		return f, nil
+	})
+
+	if leader {
+		return rv, err
+	}
+
+	// the fetch was cancelled by the request which started it
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return fs.OpenContext(ctx, name)
+	} else if err != nil {
 		return nil, err
 	}
 
-	rv := fs.add(name, f.(*file))
-	return rv, nil
+	// partial, streamed and uncacheable files are read by a single request
+	if f := v.(*file); f.cacheable() && varyForwarded(ctx, f.fi.vary) {
+		_, key = fs.cacheKeys(ctx, name)
+
+		if rv, ok, err := fs.get(key, false); ok {
+			return rv, err
+		}
+
+		// the file varies and the leader fetched another variant
+		if len(f.fi.vary) > 0 {
+			return fs.OpenContext(ctx, name)
+		}
+
+		return f.readClone()
+	}
+
+	return openContext(ctx, fs.fs, name)
 }
 
 type cacheInvalidator struct {
 	wg      sync.WaitGroup
 	Period  time.Duration
 	quit    chan bool
-	delfn   func(name string)
-	items   map[string]fileInfo
+	ctx     context.Context // done on Close, aborting revalidations
+	cancel  context.CancelFunc
+	once    sync.Once
+	delfn   func(name string) // evicts entries past maxAge
+	stalefn func(name string) // handles stale entries; delfn when nil
+	client  *http.Client
+	header  http.Header // sent on every revalidation
+	maxAge  time.Duration
+	noCheck bool
+	flight  *singleflight.Group
+	items   map[string]*centry
 	added   map[string]bool
 	removed map[string]bool
-	lastmod int // relative clock
+	maxDiff int
+	resync  bool // diff dropped, local state is rebuilt from items
+	lastmod int  // relative clock
 	mux     sync.Mutex
+	log     Logger
 }
 
-func newCacheInvalidator(delfn func(name string)) *cacheInvalidator {
+func newCacheInvalidator(delfn, stalefn func(name string), client *http.Client, header http.Header, opt CacheOptions) *cacheInvalidator {
+	ctx, cancel := context.WithCancel(context.Background())
 	ci := &cacheInvalidator{
 		quit:    make(chan bool),
-		items:   make(map[string]fileInfo),
+		ctx:     ctx,
+		cancel:  cancel,
+		items:   make(map[string]*centry),
 		added:   make(map[string]bool),
 		removed: make(map[string]bool),
 		lastmod: 0,
-		Period:  time.Second * 30,
+		Period:  opt.InvalidatePeriod,
 		delfn:   delfn,
+		stalefn: stalefn,
+		client:  client,
+		header:  header,
+		maxAge:  opt.MaxRevalidateAge,
+		noCheck: opt.NoRevalidate,
+		maxDiff: opt.InvalidatorMaxDiff,
+		log:     loggerOrDefault(opt.Logger),
+	}
+
+	if ci.maxDiff <= 0 {
+		ci.maxDiff = 1024
+	}
+
+	if opt.CollapseRevalidation {
+		ci.flight = new(singleflight.Group)
+	}
+
+	if ci.Period == 0 {
+		ci.Period = time.Second * 30
+	} else if ci.Period < 0 {
+		return ci
 	}
 
 	ci.wg.Add(1)
@@ -157,109 +1291,293 @@ func newCacheInvalidator(delfn func(name string)) *cacheInvalidator {
 	return ci
 }
 
+// disabled reports whether the invalidator doesn't run.
+func (ci *cacheInvalidator) disabled() bool {
+	return ci.Period < 0
+}
+
 func (ci *cacheInvalidator) Add(ent *centry) {
+	if ci.disabled() {
+		return
+	}
+
 	ci.mux.Lock()
 	defer ci.mux.Unlock()
-	ci.items[ent.name] = ent.file.fi
-	ci.added[ent.name] = true
+	ci.items[ent.name] = ent
 	ci.lastmod++
+
+	if !ci.resync {
+		delete(ci.removed, ent.name)
+		ci.added[ent.name] = true
+		ci.compact()
+	}
 }
 
 func (ci *cacheInvalidator) Del(ent *centry) {
+	if ci.disabled() {
+		return
+	}
+
 	ci.mux.Lock()
 	defer ci.mux.Unlock()
 	delete(ci.items, ent.name)
-	ci.removed[ent.name] = true
 	ci.lastmod++
+
+	if !ci.resync {
+		delete(ci.added, ent.name)
+		ci.removed[ent.name] = true
+		ci.compact()
+	}
+}
+
+// compact drops the diff when it grows past maxDiff. The local state is
+// then rebuilt from items on the next update.
+func (ci *cacheInvalidator) compact() {
+	if len(ci.added)+len(ci.removed) <= ci.maxDiff {
+		return
+	}
+
+	ci.added = make(map[string]bool)
+	ci.removed = make(map[string]bool)
+	ci.resync = true
 }
 
 func (ci *cacheInvalidator) run() {
-	items := make(map[string]fileInfo)
+	items := make(map[string]*centry)
+	next := make(map[string]time.Time)
 	lastmod := 0
 
 	for {
 		select {
 		case <-ci.quit:
-			log.Println("invalidator exp: quit")
+			ci.log.Println("invalidator exp: quit")
 			return
 		case <-time.After(ci.Period):
-			start := time.Now()
-			ci.mux.Lock()
-			// check if we need to update local state
-			if ci.lastmod != lastmod {
-				// update local and ci state
-				lastmod = ci.lastmod
-				for k := range ci.removed {
-					delete(items, k)
-					delete(ci.removed, k)
-				}
-				for k := range ci.added {
-					items[k] = ci.items[k]
-					delete(ci.added, k)
-				}
-			}
+			lastmod = ci.update(items, lastmod)
+			ci.sweep(items, next)
+		}
+	}
+}
 
-			ci.mux.Unlock()
-			invalidCnt := 0
+// update brings the local state items up to date with ci.items and returns
+// the new relative clock.
+func (ci *cacheInvalidator) update(items map[string]*centry, lastmod int) int {
+	ci.mux.Lock()
+	defer ci.mux.Unlock()
 
-			// items is now up to date with ci.items
-			for name, fi := range items {
-				uptodate, err := ci.check(fi)
+	// check if we need to update local state
+	if ci.lastmod == lastmod {
+		return lastmod
+	}
 
-				if err != nil {
-					// todo
-					log.Print(err)
-					continue
-				}
+	if ci.resync {
+		for k := range items {
+			delete(items, k)
+		}
+		for k, ent := range ci.items {
+			items[k] = ent
+		}
 
-				if !uptodate {
-					log.Printf("invalidate: %s", name)
-					ci.delfn(name)
-					invalidCnt++
-				}
-			}
+		ci.resync = false
+		return ci.lastmod
+	}
 
-			if invalidCnt > 0 {
-				dt := time.Now().Sub(start)
-				log.Printf("invalidator: timer %s", dt)
-			}
+	// update local and ci state
+	for k := range ci.removed {
+		delete(items, k)
+		delete(ci.removed, k)
+	}
+	for k := range ci.added {
+		items[k] = ci.items[k]
+		delete(ci.added, k)
+	}
+
+	return ci.lastmod
+}
+
+// sweep evicts the stale items. Items cached longer than maxAge are evicted
+// without asking the origin, the others are revalidated with a HEAD
+// request. Items the origin asked to retry later are skipped until the time
+// recorded in next.
+func (ci *cacheInvalidator) sweep(items map[string]*centry, next map[string]time.Time) {
+	start := time.Now()
+	invalidCnt := 0
+
+	for name := range next {
+		if _, ok := items[name]; !ok {
+			delete(next, name)
+		}
+	}
+
+	for name, ent := range items {
+		if ci.context().Err() != nil {
+			return
+		}
+
+		if t, ok := next[name]; ok && start.Before(t) {
+			continue
+		}
+
+		delete(next, name)
+
+		if ci.maxAge > 0 && start.Sub(ent.added) > ci.maxAge {
+			ci.log.Printf("invalidate: %s: max age", name)
+			ci.delfn(name)
+			invalidCnt++
+			continue
+		}
+
+		if ci.noCheck {
+			continue
+		}
+
+		uptodate, err := ci.revalidate(ent)
+
+		if rerr, ok := err.(*retryError); ok {
+			ci.log.Printf("invalidate: %s: %v", name, err)
+			next[name] = start.Add(rerr.after)
+			continue
+		} else if err != nil {
+			ci.log.Println(err)
+			continue
+		}
+
+		if !uptodate {
+			invalidCnt++
+		}
+	}
+
+	if invalidCnt > 0 {
+		dt := time.Now().Sub(start)
+		ci.log.Printf("invalidator: timer %s", dt)
+	}
+}
+
+// revalidate checks whether ent is up to date with the origin and removes
+// it from the cache when it's not.
+func (ci *cacheInvalidator) revalidate(ent *centry) (bool, error) {
+	if ci.flight == nil {
+		return ci.revalidateOnce(ent)
+	}
+
+	v, err, _ := ci.flight.Do(ent.name, func() (interface{}, error) {
+		return ci.revalidateOnce(ent)
+	})
+
+	return v.(bool), err
+}
+
+func (ci *cacheInvalidator) revalidateOnce(ent *centry) (bool, error) {
+	uptodate, err := ci.check(ent.file.fi)
+
+	if err == nil && !uptodate {
+		ci.log.Printf("invalidate: %s", ent.name)
+
+		if ci.stalefn != nil {
+			ci.stalefn(ent.name)
+		} else {
+			ci.delfn(ent.name)
 		}
 	}
+
+	return uptodate, err
 }
 
 func (ci *cacheInvalidator) check(fi fileInfo) (bool, error) {
-	req, err := http.NewRequest("HEAD", fi.Name(), nil)
+	// files which weren't fetched over HTTP are always up to date
+	if fi.url == "" {
+		return true, nil
+	}
+
+	req, err := http.NewRequestWithContext(ci.context(), "HEAD", fi.url, nil)
 
 	if err != nil {
 		return false, err
 	}
 
+	for k, v := range ci.header {
+		req.Header[k] = v
+	}
+
 	req.Header.Add("If-Modified-Since", fi.modtime.UTC().Format(http.TimeFormat))
-	req.Header.Add("If-None-Match", fi.etag)
 
-	res, err := http.DefaultClient.Do(req)
+	if fi.etag != "" {
+		req.Header.Add("If-None-Match", fi.etag)
+	}
+
+	client := ci.client
+
+	if client == nil {
+		client = defaultClient
+	}
+
+	res, err := client.Do(req)
 
 	if err != nil {
 		return false, err
 	}
 
 	defer res.Body.Close()
-	log.Println(fi.Name(), res.StatusCode, res.Status)
+	ci.log.Println(fi.url, res.StatusCode, res.Status)
 
 	switch res.StatusCode {
 	case http.StatusNotModified:
 		return true, nil
 	case 429, http.StatusRequestTimeout:
-		return false, errors.New("retry")
+		return false, &retryError{parseRetryAfter(res.Header.Get("Retry-After"), time.Now())}
 	default:
 		return false, nil
 	}
 }
 
+// retryError is returned by check when the origin asks to retry the
+// revalidation after a while.
+type retryError struct {
+	after time.Duration
+}
+
+func (e *retryError) Error() string {
+	return fmt.Sprintf("invalidator: retry after %s", e.after)
+}
+
+// parseRetryAfter parses a Retry-After header value, delay seconds or an
+// HTTP date, into the delay from now. Missing or malformed values mean no
+// delay.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+
+	return 0
+}
+
+// context returns the context of revalidation requests, which is done
+// once the invalidator is closed.
+func (ci *cacheInvalidator) context() context.Context {
+	if ci.ctx == nil {
+		return context.Background()
+	}
+
+	return ci.ctx
+}
+
+// Close stops the invalidator, aborting a sweep in progress, and waits for
+// it to return. Closing the invalidator again does nothing.
 func (ci *cacheInvalidator) Close() error {
-	log.Println("invalidator: Closing ...")
+	var err error
+	ci.once.Do(func() { err = ci.close() })
+	return err
+}
+
+func (ci *cacheInvalidator) close() error {
+	ci.log.Println("invalidator: Closing ...")
+	ci.cancel()
 	close(ci.quit)
-	done := make(chan bool)
+	done := make(chan bool, 1)
 
 	go func(done chan bool) {
 		ci.wg.Wait()
@@ -272,6 +1590,6 @@ func (ci *cacheInvalidator) Close() error {
 	case <-time.After(5 * time.Second):
 		return fmt.Errorf("invalidator: Timed out")
 	}
-	log.Println("invalidator: Closed")
+	ci.log.Println("invalidator: Closed")
 	return nil
 }
@@ -2,9 +2,19 @@ package filesrv
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -61,6 +71,7 @@ func TestCache(t *testing.T) {
 	ast := assert.NewAssertWithName(t, "TestCache")
 	fs := newFakeFs()
 	cache := NewCache(fs, 2, 64)
+	defer cache.Close()
 	file1, file2, file3 := "file1", "file2", "file3"
 
 	_, err := cache.Open(file1)
@@ -119,6 +130,7 @@ func TestCacheConcurrent(t *testing.T) {
 	ast := assert.NewAssertWithName(t, "TestCacheConcurrent")
 	fs := newFakeFs()
 	cache := NewCache(fs, 2, 64)
+	defer cache.Close()
 	files := []string{"file1", "file2", "file3"}
 	wg := sync.WaitGroup{}
 
@@ -141,3 +153,1099 @@ func TestCacheConcurrent(t *testing.T) {
 
 	wg.Wait()
 }
+
+// slowFs delays opens of the underlying filesystem.
+type slowFs struct {
+	*fakeFs
+	delay time.Duration
+}
+
+func (fs *slowFs) Open(name string) (http.File, error) {
+	time.Sleep(fs.delay)
+	return fs.fakeFs.Open(name)
+}
+
+func TestCacheConcurrentMiss(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheConcurrentMiss")
+	fs := newFakeFs()
+	files := []string{"file1", "file2", "file3"}
+
+	for _, file := range files {
+		fs.files[file] = newFile(file)
+	}
+
+	cache := NewCache(&slowFs{fakeFs: fs, delay: 50 * time.Millisecond}, 10, 64)
+	defer cache.Close()
+	start := make(chan bool)
+	wg := sync.WaitGroup{}
+
+	for _, file := range files {
+		for j := 0; j < 100; j++ {
+			wg.Add(1)
+
+			go func(file string) {
+				defer wg.Done()
+				<-start
+				f, err := cache.Open(file)
+				ast.Nil(err)
+				body, _ := ioutil.ReadAll(f)
+				f.Close()
+				ast.Equal(file, string(body))
+			}(file)
+		}
+	}
+
+	close(start)
+	wg.Wait()
+
+	for _, file := range files {
+		ast.Equal(1, fs.filesStat[file])
+	}
+
+	ast.Equal(3, fs.openCnt)
+}
+
+func TestCacheMaxReaders(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheMaxReaders")
+	fs := newFakeFs()
+	fs.files["file1"] = newFile("file1")
+	cache := NewCacheWithOptions(fs, CacheOptions{MaxItems: 2, MaxSize: 64, MaxReaders: 2})
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+
+	f1, err := cache.Open("file1")
+	ast.Nil(err)
+	f2, err := cache.Open("file1")
+	ast.Nil(err)
+	ast.Equal(2, mc.Readers("file1"))
+
+	_, err = cache.Open("file1")
+	ast.Equal(ErrTooManyReaders, err)
+
+	f1.Close()
+	f1.Close()
+	ast.Equal(1, mc.Readers("file1"))
+
+	f3, err := cache.Open("file1")
+	ast.Nil(err)
+	f2.Close()
+	f3.Close()
+	ast.Equal(0, mc.Readers("file1"))
+	ast.Equal(1, fs.openCnt)
+}
+
+func newLargeFile(name string, size int) *file {
+	buf := bytes.Repeat([]byte("x"), size)
+	f := newFile(name)
+	f.buf = buf
+	f.ReadSeeker = bytes.NewReader(buf)
+	f.fi.size = size
+	return f
+}
+
+func TestCacheMaxSize(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheMaxSize")
+	fs := newFakeFs()
+	fs.files["file1"] = newLargeFile("file1", 40)
+	fs.files["file2"] = newLargeFile("file2", 40)
+	fs.files["file3"] = newLargeFile("file3", 100)
+	cache := NewCacheWithOptions(fs, CacheOptions{MaxItems: 10, MaxSize: 64})
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+
+	for _, name := range []string{"file1", "file2", "file3"} {
+		f, err := cache.Open(name)
+		ast.Nil(err)
+		f.Close()
+		ast.Equal(true, mc.size <= mc.maxSize)
+	}
+
+	ast.Equal(int64(40), mc.size)
+	ast.Equal(1, mc.evictList.Len())
+	_, ok := mc.cache["file2"]
+	ast.Equal(true, ok)
+}
+
+func TestCacheTinyMaxSize(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheTinyMaxSize")
+	fs := newFakeFs()
+	fs.files["small"] = newLargeFile("small", 4)
+	fs.files["large"] = newLargeFile("large", 100)
+	cache := NewCacheWithOptions(fs, CacheOptions{MaxItems: 10, MaxSize: 8})
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+
+	f, err := cache.Open("small")
+	ast.Nil(err)
+	f.Close()
+
+	// the large file passes through without evicting the small one
+	for i := 0; i < 2; i++ {
+		f, err = cache.Open("large")
+		ast.Nil(err)
+		n, _ := io.Copy(ioutil.Discard, f)
+		f.Close()
+		ast.Equal(int64(100), n)
+	}
+
+	ast.Equal(2, fs.filesStat["large"])
+	ast.Equal(1, mc.evictList.Len())
+	ast.Equal(int64(4), mc.size)
+	_, ok := mc.cache["small"]
+	ast.Equal(true, ok)
+}
+
+func TestCacheConcurrentLargeEntry(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheConcurrentLargeEntry")
+	const size = 4 << 20
+	fs := newFakeFs()
+	fs.files["large"] = newLargeFile("large", size)
+	cache := NewCache(fs, 2, size)
+	defer cache.Close()
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			f, err := cache.Open("large")
+
+			if err != nil {
+				ast.Nil(err)
+				return
+			}
+
+			defer f.Close()
+			n, err := io.Copy(ioutil.Discard, f)
+			ast.Nil(err)
+			ast.Equal(int64(size), n)
+		}()
+	}
+
+	wg.Wait()
+	ast.Equal(0, cache.(*memoryCacheFilesystem).Readers("large"))
+}
+
+func BenchmarkCacheConcurrentLargeEntry(b *testing.B) {
+	const size = 4 << 20
+	fs := newFakeFs()
+	fs.files["large"] = newLargeFile("large", size)
+	cache := NewCache(fs, 2, size)
+	defer cache.Close()
+	b.SetBytes(size)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			f, err := cache.Open("large")
+
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			io.Copy(ioutil.Discard, f)
+			f.Close()
+		}
+	})
+}
+
+func TestCachePurgeSurrogateKey(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCachePurgeSurrogateKey")
+	fs := newFakeFs()
+	cache := NewCache(fs, 10, 64)
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+	tags := map[string][]string{
+		"file1": {"product-42", "css"},
+		"file2": {"product-42"},
+		"file3": {"product-7"},
+	}
+
+	for name, keys := range tags {
+		f := newFile(name)
+		f.fi.surrogateKeys = keys
+		fs.files[name] = f
+		_, err := cache.Open(name)
+		ast.Nil(err)
+	}
+
+	ast.Equal(2, mc.PurgeSurrogateKey("product-42"))
+	ast.Equal(0, mc.PurgeSurrogateKey("product-42"))
+	ast.Equal(0, mc.PurgeSurrogateKey("css"))
+	ast.Equal(1, len(mc.cache))
+	ast.Equal(1, len(mc.keys))
+
+	// file1 is refetched after the purge
+	_, err := cache.Open("file1")
+	ast.Nil(err)
+	ast.Equal(2, fs.filesStat["file1"])
+	ast.Equal(1, fs.filesStat["file3"])
+}
+
+func TestCacheDedupWindow(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheDedupWindow")
+	fs := newFakeFs()
+	fs.files["file1"] = newFile("file1")
+	fs.files["file2"] = newFile("file2")
+	cache := NewCacheWithOptions(fs, CacheOptions{MaxItems: 1, MaxSize: 64, DedupWindow: 50 * time.Millisecond})
+	defer cache.Close()
+
+	// file1 and file2 evict each other but are fetched once within the
+	// window
+	for i := 0; i < 5; i++ {
+		_, err := cache.Open("file1")
+		ast.Nil(err)
+		_, err = cache.Open("file2")
+		ast.Nil(err)
+		time.Sleep(time.Millisecond)
+	}
+
+	ast.Equal(1, fs.filesStat["file1"])
+	ast.Equal(1, fs.filesStat["file2"])
+
+	time.Sleep(60 * time.Millisecond)
+	_, err := cache.Open("file1")
+	ast.Nil(err)
+	ast.Equal(2, fs.filesStat["file1"])
+}
+
+func TestInvalidatorMaxRevalidateAge(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestInvalidatorMaxRevalidateAge")
+	heads := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		heads++
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer origin.Close()
+
+	var deleted []string
+	ci := &cacheInvalidator{
+		delfn:  func(name string) { deleted = append(deleted, name) },
+		maxAge: time.Minute,
+		log:    DiscardLogger,
+	}
+
+	old := newFile("old")
+	old.fi.url = origin.URL + "/old"
+	young := newFile("young")
+	young.fi.url = origin.URL + "/young"
+	items := map[string]*centry{
+		"old":   {file: old, name: "old", added: time.Now().Add(-2 * time.Minute)},
+		"young": {file: young, name: "young", added: time.Now()},
+	}
+
+	ci.sweep(items, make(map[string]time.Time))
+	ast.Equal([]string{"old"}, deleted)
+	ast.Equal(1, heads)
+}
+
+func TestInvalidatorRetryAfter(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestInvalidatorRetryAfter")
+	var heads int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&heads, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer origin.Close()
+
+	var deleted []string
+	ci := &cacheInvalidator{delfn: func(name string) { deleted = append(deleted, name) }, log: DiscardLogger}
+	f := newFile("file")
+	f.fi.url = origin.URL + "/file"
+	items := map[string]*centry{"file": {file: f, name: "file", added: time.Now()}}
+	next := make(map[string]time.Time)
+
+	// the entry is kept and not rechecked before the retry time
+	ci.sweep(items, next)
+	ci.sweep(items, next)
+	ast.Equal(int32(1), atomic.LoadInt32(&heads))
+	ast.Equal(0, len(deleted))
+	ast.Equal(true, next["file"].After(time.Now().Add(59*time.Minute)))
+
+	next["file"] = time.Now().Add(-time.Second)
+	ci.sweep(items, next)
+	ast.Equal(int32(2), atomic.LoadInt32(&heads))
+
+	// entries which left the cache are forgotten
+	delete(items, "file")
+	ci.sweep(items, next)
+	ast.Equal(0, len(next))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestParseRetryAfter")
+	now := time.Date(2015, 9, 1, 15, 3, 1, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		after time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"soon", 0},
+		{"Tue, 01 Sep 2015 15:05:01 GMT", 2 * time.Minute},
+		{"Tue, 01 Sep 2015 15:00:00 GMT", 0},
+	}
+
+	for _, tt := range tests {
+		ast.Equal(tt.after, parseRetryAfter(tt.value, now))
+	}
+}
+
+func TestCacheCollapseRevalidation(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheCollapseRevalidation")
+	var heads int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&heads, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer origin.Close()
+
+	fs := newFakeFs()
+	f := newFile("file1")
+	f.fi.url = origin.URL + "/file1"
+	fs.files["file1"] = f
+	cache := NewCacheWithOptions(fs, CacheOptions{MaxItems: 2, MaxSize: 64, CollapseRevalidation: true})
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+	_, err := cache.Open("file1")
+	ast.Nil(err)
+
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			ast.Nil(mc.Revalidate("file1"))
+		}()
+	}
+
+	wg.Wait()
+	ast.Equal(int32(1), atomic.LoadInt32(&heads))
+	ast.Equal(1, len(mc.cache))
+}
+
+func TestCacheManifest(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheManifest")
+	fs := newFakeFs()
+	cache := NewCache(fs, 10, 64)
+	defer cache.Close()
+
+	for _, name := range []string{"/js/app.js", "/js/vendor.js", "/css/app.css"} {
+		fs.files[name] = newFile(name)
+		_, err := cache.Open(name)
+		ast.Nil(err)
+	}
+
+	m := cache.(*memoryCacheFilesystem).Manifest("/js/")
+	ast.Equal(2, len(m))
+	ast.Equal(ManifestEntry{ETag: "tag", Size: 10, ContentType: "application/text"}, m["/js/app.js"])
+
+	buf, err := json.Marshal(m)
+	ast.Nil(err)
+	ast.Equal(`{"/js/app.js":{"etag":"tag","size":10,"contentType":"application/text"},`+
+		`"/js/vendor.js":{"etag":"tag","size":13,"contentType":"application/text"}}`, string(buf))
+}
+
+func TestInvalidatorChurn(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestInvalidatorChurn")
+	ci := &cacheInvalidator{
+		items:   make(map[string]*centry),
+		added:   make(map[string]bool),
+		removed: make(map[string]bool),
+		maxDiff: 100,
+		log:     DiscardLogger,
+	}
+	items := make(map[string]*centry)
+	lastmod := 0
+	f := newFile("file")
+
+	// add then del is no diff
+	ent := &centry{file: f, name: "file"}
+	ci.Add(ent)
+	ci.Del(ent)
+	ci.Add(ent)
+	ast.Equal(1, len(ci.added))
+	ast.Equal(0, len(ci.removed))
+	lastmod = ci.update(items, lastmod)
+	ast.Equal(map[string]*centry{"file": ent}, items)
+
+	for i := 0; i < 10000; i++ {
+		ent := &centry{file: f, name: fmt.Sprintf("file%d", i)}
+		ci.Add(ent)
+
+		if i%10 != 0 {
+			ci.Del(ent)
+		}
+
+		ast.Equal(true, len(ci.added)+len(ci.removed) <= 100)
+	}
+
+	lastmod = ci.update(items, lastmod)
+	ast.Equal(1001, len(items))
+	ast.Equal(ci.items, items)
+	ast.Equal(false, ci.resync)
+}
+
+func TestCacheParanoid(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheParanoid")
+	fs := newFakeFs()
+	fs.files["file1"] = newFile("file1")
+	cache := NewCacheWithOptions(fs, CacheOptions{MaxItems: 10, MaxSize: 64, Paranoid: true})
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+
+	f, err := cache.Open("file1")
+	ast.Nil(err)
+	f.Close()
+	f, err = cache.Open("file1")
+	ast.Nil(err)
+	f.Close()
+	ast.Equal(1, fs.openCnt)
+
+	// corrupt the cached copy
+	mc.cache["file1"].Value.(*centry).file.buf[0] = 'X'
+	_, ok, err := mc.get("file1", false)
+	ast.Nil(err)
+	ast.Equal(false, ok)
+	_, ok = mc.cache["file1"]
+	ast.Equal(false, ok)
+}
+
+func TestCacheParanoidCompressed(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheParanoidCompressed")
+	content := strings.Repeat("compressible content ", 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+	}))
+	defer origin.Close()
+
+	cache := NewCacheWithOptions(New(origin.URL), CacheOptions{MaxItems: 10, GzipMaxSize: 1 << 20, BrotliMaxSize: 1 << 20, Paranoid: true})
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+
+	for _, corrupt := range []func(f *file){
+		func(f *file) { f.gzbuf[len(f.gzbuf)/2] ^= 0xff },
+		func(f *file) { f.brbuf[len(f.brbuf)/2] ^= 0xff },
+	} {
+		f, err := cache.Open("/file.txt")
+		ast.Nil(err)
+		f.Close()
+
+		// the copy served to clients accepting the encoding is corrupted
+		corrupt(mc.cache["/file.txt"].Value.(*centry).file)
+		_, ok, err := mc.get("/file.txt", false)
+		ast.Nil(err)
+		ast.Equal(false, ok)
+		_, ok = mc.cache["/file.txt"]
+		ast.Equal(false, ok)
+	}
+}
+
+func TestCacheExtensionTTL(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheExtensionTTL")
+	fs := newFakeFs()
+
+	for _, name := range []string{"/index.html", "/app.js", "/image.png", "/app.js?v=2"} {
+		fs.files[name] = newFile(name)
+	}
+
+	ttls := map[string]time.Duration{
+		".html": time.Minute,
+		".js":   time.Hour,
+		"*":     10 * time.Minute,
+	}
+	cache := NewCacheWithOptions(fs, CacheOptions{MaxItems: 10, MaxSize: 1024, ExtensionTTL: ttls})
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+
+	tests := []struct {
+		name string
+		ttl  time.Duration
+	}{
+		{"/index.html", time.Minute},
+		{"/app.js", time.Hour},
+		{"/app.js?v=2", time.Hour},
+		{"/image.png", 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		f, err := cache.Open(tt.name)
+		ast.Nil(err)
+		f.Close()
+		ent := mc.cache[tt.name].Value.(*centry)
+		ast.Equal(tt.ttl, ent.expires.Sub(ent.added))
+	}
+
+	// an expired entry is fetched again
+	mc.cache["/index.html"].Value.(*centry).expires = time.Now().Add(-time.Second)
+	f, err := cache.Open("/index.html")
+	ast.Nil(err)
+	f.Close()
+	ast.Equal(2, fs.filesStat["/index.html"])
+}
+
+func TestCacheStats(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheStats")
+	fs := newFakeFs()
+	files := []string{"file1", "file2", "file3"}
+
+	for _, file := range files {
+		fs.files[file] = newFile(file)
+	}
+
+	cache := NewCache(fs, 2, 64)
+	defer cache.Close()
+
+	for _, name := range []string{"file1", "file1", "file2", "file3", "file3"} {
+		f, err := cache.Open(name)
+		ast.Nil(err)
+		f.Close()
+	}
+
+	stats := cache.(CacheStatter).Stats()
+	ast.Equal(CacheStats{Hits: 2, Misses: 3, Items: 2, Size: 10, Evictions: 1}, stats)
+}
+
+func TestCacheTTL(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheTTL")
+	fs := newFakeFs()
+	fs.files["file1"] = newFile("file1")
+	fs.files["file2.js"] = newFile("file2")
+
+	for _, ttl := range []time.Duration{0, 50 * time.Millisecond} {
+		cache := NewCacheWithOptions(fs, CacheOptions{MaxItems: 10, MaxSize: 64, TTL: ttl})
+		defer cache.Close()
+		fs.filesStat["file1"] = 0
+
+		for i := 0; i < 2; i++ {
+			f, err := cache.Open("file1")
+			ast.Nil(err)
+			f.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if ttl == 0 {
+			ast.Equal(1, fs.filesStat["file1"])
+		} else {
+			ast.Equal(2, fs.filesStat["file1"])
+		}
+	}
+
+	// extension TTLs take precedence
+	cache := NewCacheWithOptions(fs, CacheOptions{
+		MaxItems:     10,
+		MaxSize:      64,
+		TTL:          time.Minute,
+		ExtensionTTL: map[string]time.Duration{".js": time.Hour},
+	})
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+	ast.Equal(time.Minute, mc.ttl("file1"))
+	ast.Equal(time.Hour, mc.ttl("file2.js"))
+}
+
+func TestCacheInvalidatePeriod(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheInvalidatePeriod")
+	var heads int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&heads, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		period time.Duration
+		cached bool
+	}{
+		{-1, true},
+		{20 * time.Millisecond, false},
+	}
+
+	for _, tt := range tests {
+		atomic.StoreInt32(&heads, 0)
+		fs := newFakeFs()
+		f := newFile("file1")
+		f.fi.url = origin.URL + "/file1"
+		fs.files["file1"] = f
+		cache := NewCacheWithOptions(fs, CacheOptions{MaxItems: 10, MaxSize: 64, InvalidatePeriod: tt.period})
+		defer cache.Close()
+		mc := cache.(*memoryCacheFilesystem)
+
+		rf, err := cache.Open("file1")
+		ast.Nil(err)
+		rf.Close()
+		time.Sleep(100 * time.Millisecond)
+
+		mc.mux.RLock()
+		_, ok := mc.cache["file1"]
+		mc.mux.RUnlock()
+		ast.Equal(tt.cached, ok)
+		ast.Equal(!tt.cached, atomic.LoadInt32(&heads) > 0)
+		ast.Nil(mc.invalidator.Close())
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheStaleWhileRevalidate")
+	var version, gets int32 = 1, 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf(`"%d"`, atomic.LoadInt32(&version))
+
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if r.Method == "GET" {
+			atomic.AddInt32(&gets, 1)
+		}
+
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, "version %d", atomic.LoadInt32(&version))
+	}))
+	defer origin.Close()
+
+	cache := NewCacheWithOptions(New(origin.URL), CacheOptions{
+		MaxItems:             10,
+		InvalidatePeriod:     -1,
+		StaleWhileRevalidate: time.Minute,
+	})
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+
+	read := func() string {
+		f, err := cache.Open("/file")
+		ast.Nil(err)
+		b, err := ioutil.ReadAll(f)
+		ast.Nil(err)
+		f.Close()
+		return string(b)
+	}
+
+	ast.Equal("version 1", read())
+	atomic.StoreInt32(&version, 2)
+	ast.Nil(mc.Revalidate("/file"))
+
+	// the stale entry is served while it's refreshed
+	ast.Equal("version 1", read())
+
+	for i := 0; i < 100 && atomic.LoadInt32(&gets) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 100 && read() != "version 2"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ast.Equal("version 2", read())
+	ast.Equal(int32(2), atomic.LoadInt32(&gets))
+}
+
+func TestCacheGzip(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheGzip")
+	fs := newFakeFs()
+	content := strings.Repeat("text ", 20)
+
+	tests := []struct {
+		name        string
+		content     string
+		contentType string
+		gzipped     bool
+	}{
+		{"text", content, "text/plain; charset=utf-8", true},
+		{"image", content, "image/png", false},
+		{"large", content + content, "text/plain", false},
+	}
+
+	for _, tt := range tests {
+		f := newFile(tt.content)
+		f.fi.contentType = tt.contentType
+		fs.files[tt.name] = f
+	}
+
+	cache := NewCacheWithOptions(fs, CacheOptions{MaxItems: 10, GzipMaxSize: int64(len(content))})
+	defer cache.Close()
+	var size int64
+
+	for _, tt := range tests {
+		f, err := cache.Open(tt.name)
+		ast.Nil(err)
+		gzbuf := f.(*file).gzbuf
+		f.Close()
+		ast.Equal(tt.gzipped, gzbuf != nil)
+		size += int64(len(tt.content) + len(gzbuf))
+
+		if gzbuf != nil {
+			gz, err := gzip.NewReader(bytes.NewReader(gzbuf))
+			ast.Nil(err)
+			b, err := ioutil.ReadAll(gz)
+			ast.Nil(err)
+			ast.Equal(tt.content, string(b))
+		}
+	}
+
+	ast.Equal(size, cache.(CacheStatter).Stats().Size)
+
+	// without a maximum size nothing is compressed, not even empty files
+	fs.files["empty"] = newFile("")
+	fs.files["empty"].fi.contentType = "text/plain"
+	plain := NewCacheWithOptions(fs, CacheOptions{MaxItems: 10})
+	defer plain.Close()
+	f, err := plain.Open("empty")
+	ast.Nil(err)
+	ast.Equal(true, f.(*file).gzbuf == nil && f.(*file).brbuf == nil)
+	f.Close()
+}
+
+func TestCacheNoStore(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheNoStore")
+	fs := newFakeFs()
+	f := newFile("private")
+	f.fi.noStore = true
+	fs.files["private"] = f
+	fs.files["public"] = newFile("public")
+	cache := NewCache(fs, 10, 1024).(*memoryCacheFilesystem)
+	defer cache.Close()
+
+	for _, name := range []string{"private", "private", "public"} {
+		rv, err := cache.Open(name)
+		ast.Nil(err)
+		rv.Close()
+	}
+
+	ast.Equal(1, len(cache.cache))
+	ast.Equal(false, cache.cache["private"] != nil)
+	ast.Equal(3, fs.openCnt)
+}
+
+func TestCacheRefresh(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheRefresh")
+	var mu sync.Mutex
+	etag, content := `"v1"`, "content1"
+	var conditional, modified int
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("ETag", etag)
+
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			conditional++
+
+			if inm == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		modified++
+		w.Write([]byte(content))
+	}))
+	defer origin.Close()
+
+	var evictions []EvictReason
+	cache := NewCacheWithOptions(New(origin.URL), CacheOptions{
+		MaxItems: 10,
+		TTL:      20 * time.Millisecond,
+		OnEvict: func(name string, size int64, reason EvictReason) {
+			mu.Lock()
+			evictions = append(evictions, reason)
+			mu.Unlock()
+		},
+	})
+	defer cache.Close()
+	read := func() string {
+		f, err := cache.Open("/file")
+		ast.Nil(err)
+		defer f.Close()
+		b, err := ioutil.ReadAll(f)
+		ast.Nil(err)
+		return string(b)
+	}
+
+	count := func(n *int) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return *n
+	}
+
+	ast.Equal("content1", read())
+	time.Sleep(50 * time.Millisecond)
+
+	// unchanged files are reused
+	ast.Equal("content1", read())
+	ast.Equal(1, count(&conditional))
+	ast.Equal(1, count(&modified))
+	ast.Equal("content1", read())
+	ast.Equal(1, count(&conditional))
+
+	// unchanged files are renewed in place, not replaced
+	mu.Lock()
+	ast.Equal(0, len(evictions))
+	etag, content = `"v2"`, "content2"
+	mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+
+	// changed files are fetched again
+	ast.Equal("content2", read())
+	ast.Equal(2, count(&conditional))
+	ast.Equal(2, count(&modified))
+	ast.Equal(int64(1), cache.(CacheStatter).Stats().Items)
+}
+
+// failingSeeker fails all seeks.
+type failingSeeker struct {
+	io.Reader
+}
+
+func (failingSeeker) Seek(int64, int) (int64, error) { return 0, errors.New("seek failed") }
+
+func TestCacheUnbufferedFile(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheUnbufferedFile")
+	fs := newFakeFs()
+	f := newFile("unbuffered")
+	f.buf = nil
+	f.ReadSeeker.Seek(3, io.SeekStart)
+	fs.files["unbuffered"] = f
+	broken := newFile("broken")
+	broken.buf = nil
+	broken.ReadSeeker = failingSeeker{strings.NewReader("broken")}
+	fs.files["broken"] = broken
+	cache := NewCache(fs, 10, 1024)
+	defer cache.Close()
+
+	for i := 0; i < 2; i++ {
+		rv, err := cache.Open("unbuffered")
+		ast.Nil(err)
+		b, err := ioutil.ReadAll(rv)
+		ast.Nil(err)
+		rv.Close()
+		ast.Equal("unbuffered", string(b))
+	}
+
+	// buffering leaves the read position
+	pos, _ := f.Seek(0, io.SeekCurrent)
+	ast.Equal(int64(3), pos)
+
+	_, err := cache.Open("broken")
+	ast.NotNil(err)
+	ast.Equal(int64(1), cache.(CacheStatter).Stats().Items)
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheNegativeTTL")
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		http.NotFound(w, r)
+	}))
+	defer origin.Close()
+
+	for _, ttl := range []time.Duration{0, 50 * time.Millisecond} {
+		atomic.StoreInt32(&hits, 0)
+		cache := NewCacheWithOptions(New(origin.URL), CacheOptions{MaxItems: 10, MaxSize: 64, NegativeTTL: ttl})
+		defer cache.Close()
+
+		for i := 0; i < 3; i++ {
+			_, err := cache.Open("/missing")
+			ast.Equal(http.ErrMissingFile, err)
+		}
+
+		if ttl == 0 {
+			ast.Equal(int32(3), atomic.LoadInt32(&hits))
+			continue
+		}
+
+		ast.Equal(int32(1), atomic.LoadInt32(&hits))
+		ast.Equal(CacheStats{Misses: 1, Negative: 2}, cache.(CacheStatter).Stats())
+
+		// a file remembered as missing isn't reported as a hit
+		ctx, status := cacheStatus(context.Background())
+		_, err := cache.(*memoryCacheFilesystem).OpenContext(ctx, "/missing")
+		ast.Equal(http.ErrMissingFile, err)
+		ast.Equal(CacheMiss, *status)
+
+		// purges and expiry forget missing files
+		cache.(Purger).Purge("/missing")
+		cache.Open("/missing")
+		ast.Equal(int32(2), atomic.LoadInt32(&hits))
+		time.Sleep(100 * time.Millisecond)
+		cache.Open("/missing")
+		ast.Equal(int32(3), atomic.LoadInt32(&hits))
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheVary")
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+
+		if r.URL.Path == "/any" {
+			w.Header().Set("Vary", "*")
+		} else if r.URL.Path == "/agent" {
+			w.Header().Set("Vary", "User-Agent")
+		} else {
+			w.Header().Set("Vary", "accept-language, Accept-Encoding")
+		}
+
+		w.Write([]byte("content " + r.Header.Get("Accept-Language")))
+	}))
+	defer origin.Close()
+
+	cache := NewCache(New(origin.URL), 10, 1024).(*memoryCacheFilesystem)
+	defer cache.Close()
+	variant := func(lang string) context.Context {
+		h := http.Header{"Accept-Language": {lang}}
+		ctx := withForwarded(withOriginHeader(context.Background(), h), []string{"accept-language"})
+		return withRequestHeader(ctx, http.Header{"Accept-Language": {lang}, "User-Agent": {lang}})
+	}
+	open := func(name, lang string) {
+		f, err := cache.OpenContext(variant(lang), name)
+		ast.Nil(err)
+		f.Close()
+	}
+
+	for _, lang := range []string{"en", "de", "en", "de"} {
+		open("/file", lang)
+	}
+
+	ast.Equal(int32(2), atomic.LoadInt32(&hits))
+	ast.Equal(2, len(cache.cache))
+
+	// files varying by anything aren't cached
+	open("/any", "en")
+	open("/any", "en")
+	ast.Equal(int32(4), atomic.LoadInt32(&hits))
+	ast.Equal(2, len(cache.cache))
+
+	// nor are files varying by headers which aren't forwarded
+	open("/agent", "en")
+	open("/agent", "en")
+	ast.Equal(int32(6), atomic.LoadInt32(&hits))
+	ast.Equal(2, len(cache.cache))
+
+	// a variant is dropped by the context it was opened with
+	ast.Equal(true, cache.delContext(variant("de"), "/file"))
+	ast.Equal(1, len(cache.cache))
+}
+
+func TestCacheClose(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheClose")
+	heads := make(chan bool, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			select {
+			case heads <- true:
+			default:
+			}
+
+			// revalidations hang until they're aborted
+			<-r.Context().Done()
+			return
+		}
+
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+	before := runtime.NumGoroutine()
+	var caches []http.FileSystem
+
+	for i := 0; i < 10; i++ {
+		fs := NewCacheWithOptions(New(origin.URL), CacheOptions{MaxItems: 10, InvalidatePeriod: 10 * time.Millisecond})
+		f, err := fs.Open("/file")
+		ast.Nil(err)
+		f.Close()
+		caches = append(caches, fs)
+	}
+
+	<-heads
+	start := time.Now()
+
+	for _, fs := range caches {
+		ast.Nil(fs.(io.Closer).Close())
+		ast.Nil(fs.(io.Closer).Close())
+	}
+
+	ast.Equal(true, time.Since(start) < time.Second)
+
+	// the connections to the origin close in the background
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		defaultClient.CloseIdleConnections()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ast.Equal(true, runtime.NumGoroutine() <= before)
+}
+
+func TestCacheOnEvict(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheOnEvict")
+	fs := newFakeFs()
+	fs.files["file1"] = newFile("file1")
+	fs.files["file2"] = newFile("file2")
+	fs.files["file3"] = newFile("file3")
+
+	var got []string
+	var cache Cache
+	cache = NewCacheWithOptions(fs, CacheOptions{MaxItems: 2, MaxSize: 64, OnEvict: func(name string, size int64, reason EvictReason) {
+		// the hook runs without the cache locked
+		cache.(CacheStatter).Stats()
+		got = append(got, fmt.Sprintf("%s %d %s", name, size, reason))
+	}})
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+
+	for _, name := range []string{"file1", "file2", "file3"} {
+		f, err := cache.Open(name)
+		ast.Nil(err)
+		f.Close()
+	}
+
+	_, err := mc.add("file2", newFile("file2"))
+	ast.Nil(err)
+	ast.Equal(true, mc.del("file3"))
+	ast.Equal(true, cache.(Purger).Purge("file2"))
+
+	ast.Equal([]string{
+		"file1 5 capacity",
+		"file2 5 replaced",
+		"file3 5 invalidated",
+		"file2 5 purged",
+	}, got)
+}
+
+func TestCacheStaleMaxRevalidateAge(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheStaleMaxRevalidateAge")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+
+	cache := NewCacheWithOptions(New(origin.URL), CacheOptions{
+		MaxItems:             10,
+		InvalidatePeriod:     -1,
+		MaxRevalidateAge:     time.Minute,
+		StaleWhileRevalidate: time.Minute,
+	})
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+
+	f, err := cache.Open("/file")
+	ast.Nil(err)
+	f.Close()
+
+	// entries past the max age are evicted rather than kept stale
+	ent := mc.cache["/file"].Value.(*centry)
+	old := *ent
+	old.added = time.Now().Add(-2 * time.Minute)
+	mc.invalidator.sweep(map[string]*centry{"/file": &old}, make(map[string]time.Time))
+	_, ok := mc.cache["/file"]
+	ast.Equal(false, ok)
+}
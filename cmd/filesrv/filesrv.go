@@ -23,6 +23,8 @@ var (
 	version        = flag.Bool("version", false, "show version number and exit")
 	configFilename = flag.String("config", "config.toml", "config file path")
 	cpuprofile     = flag.String("debug.cpuprofile", "", "write cpu profile to file")
+	memprofile     = flag.String("debug.memprofile", "", "write heap profile to file on shutdown")
+	maxprocs       = flag.Int("maxprocs", 0, "set GOMAXPROCS; 0 means the number of CPUs unless the GOMAXPROCS environment variable is set")
 )
 
 var Version = "0.1.0"
@@ -60,7 +62,11 @@ func main() {
 		conf.Listen = *laddr
 	}
 
-	runtime.GOMAXPROCS(runtime.NumCPU())
+	if *maxprocs > 0 {
+		runtime.GOMAXPROCS(*maxprocs)
+	} else if os.Getenv("GOMAXPROCS") == "" {
+		runtime.GOMAXPROCS(runtime.NumCPU())
+	}
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -77,9 +83,36 @@ func main() {
 		log.Fatalf("error instantiating HTTP server: %v", err)
 	}
 
-	err = server.ListenAndServe(conf.Listen, closer)
+	err = server.ListenAndServe(conf, closer)
 
 	if err != nil {
 		log.Errorln(err)
 	}
+
+	// written after the server drained, so it shows the memory held by
+	// the cache rather than by requests
+	if *memprofile != "" {
+		if err := writeHeapProfile(*memprofile); err != nil {
+			log.Errorln(err)
+		}
+
+		runtime.KeepAlive(closer)
+	}
+}
+
+func writeHeapProfile(filename string) error {
+	f, err := os.Create(filename)
+
+	if err != nil {
+		return err
+	}
+
+	runtime.GC()
+
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
 }
@@ -0,0 +1,217 @@
+package filesrv
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// defaultCompressMinSize is the size below which files aren't compressed
+// when ServeOptions.CompressMinSize is zero.
+const defaultCompressMinSize = 1024
+
+var compressibleTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// compressible reports whether files of the content type ctype benefit
+// from compression.
+func compressible(ctype string) bool {
+	if i := strings.Index(ctype, ";"); i >= 0 {
+		ctype = ctype[:i]
+	}
+
+	ctype = strings.TrimSpace(ctype)
+
+	for _, t := range compressibleTypes {
+		if ctype == t || strings.HasSuffix(t, "/") && strings.HasPrefix(ctype, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// defaultBrotliQuality is the brotli quality responses are compressed
+// with when ServeOptions.BrotliQuality is zero.
+const defaultBrotliQuality = 4
+
+// acceptEncoding returns the encoding out of encs preferred by the
+// Accept-Encoding header of r, or "" when the client accepts none of them.
+// Encodings the client prefers equally are picked in the order of encs.
+func acceptEncoding(r *http.Request, encs ...string) string {
+	q := encodingQ(r)
+	best, bestQ := "", 0.0
+
+	for _, enc := range encs {
+		if q[enc] > bestQ {
+			best, bestQ = enc, q[enc]
+		}
+	}
+
+	return best
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of r accepts
+// the encoding enc.
+func acceptsEncoding(r *http.Request, enc string) bool {
+	return encodingQ(r)[enc] > 0
+}
+
+// encodingQ returns the quality values of the encodings listed in the
+// Accept-Encoding header of r by lowercase name.
+func encodingQ(r *http.Request) map[string]float64 {
+	qs := make(map[string]float64)
+
+	for _, v := range r.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(v, ",") {
+			enc, q := part, 1.0
+
+			if i := strings.Index(part, ";"); i >= 0 {
+				enc = part[:i]
+				param := strings.TrimSpace(part[i+1:])
+
+				if strings.HasPrefix(param, "q=") {
+					if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = f
+					}
+				}
+			}
+
+			enc = strings.ToLower(strings.TrimSpace(enc))
+
+			if q > qs[enc] {
+				qs[enc] = q
+			}
+		}
+	}
+
+	return qs
+}
+
+// etagVariant returns etag with suffix added inside its quotes, if any.
+func etagVariant(etag, suffix string) string {
+	if strings.HasSuffix(etag, `"`) && len(etag) > 1 {
+		return etag[:len(etag)-1] + suffix + `"`
+	}
+
+	return etag + suffix
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+
+// gzipBytes returns b compressed with gzip.
+func gzipBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzipWriters.Get().(*gzip.Writer)
+	gz.Reset(&buf)
+	gz.Write(b)
+	gz.Close()
+	gzipWriters.Put(gz)
+	return buf.Bytes()
+}
+
+// brotliBytes returns b compressed with brotli at quality.
+func brotliBytes(b []byte, quality int) []byte {
+	var buf bytes.Buffer
+	bw := brotli.NewWriterLevel(&buf, quality)
+	bw.Write(b)
+	bw.Close()
+	return buf.Bytes()
+}
+
+// setContentEncoding sets the response headers of the variant of a file
+// encoded with enc.
+func setContentEncoding(h http.Header, enc string) {
+	h.Set("Content-Encoding", enc)
+
+	if etag := h.Get("Etag"); etag != "" {
+		h.Set("Etag", etagVariant(etag, "-"+enc))
+	}
+}
+
+// compressWriter compresses the body of a successful response with the
+// encoding enc. Other responses are written as is.
+type compressWriter struct {
+	http.ResponseWriter
+	enc         string
+	quality     int // of brotli
+	w           io.WriteCloser
+	wroteHeader bool
+}
+
+// newCompressWriter returns a compressWriter and sets the response headers
+// of the encoded variant. Brotli compresses at quality.
+func newCompressWriter(w http.ResponseWriter, enc string, quality int) *compressWriter {
+	setContentEncoding(w.Header(), enc)
+	return &compressWriter{ResponseWriter: w, enc: enc, quality: quality}
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+	h := w.Header()
+
+	if code == http.StatusOK {
+		h.Del("Content-Length")
+
+		switch w.enc {
+		case "gzip":
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(w.ResponseWriter)
+			w.w = gz
+		case "br":
+			w.w = brotli.NewWriterLevel(w.ResponseWriter, w.quality)
+		default:
+			w.w, _ = flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+		}
+	} else if code != http.StatusNotModified {
+		h.Del("Content-Encoding")
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.w == nil {
+		return w.ResponseWriter.Write(p)
+	}
+
+	return w.w.Write(p)
+}
+
+// Close flushes the compressed body.
+func (w *compressWriter) Close() error {
+	if w.w == nil {
+		return nil
+	}
+
+	err := w.w.Close()
+
+	if gz, ok := w.w.(*gzip.Writer); ok {
+		gzipWriters.Put(gz)
+	}
+
+	w.w = nil
+	return err
+}
@@ -4,7 +4,47 @@
 
 package config
 
-import "github.com/BurntSushi/toml"
+import (
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Duration is a time.Duration read from a string such as "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// ClientHintRule partitions the cache for paths matching Pattern by the
+// client hint Headers.
+type ClientHintRule struct {
+	Pattern string
+	Headers []string
+}
+
+// PlaceholderRule serves the Placeholder file for uncached images of at
+// least MinSize bytes with names starting with Prefix while they're
+// fetched.
+type PlaceholderRule struct {
+	Prefix      string
+	Placeholder string
+	MinSize     int64
+}
+
+// RateLimitRule limits requests per client for paths matching Pattern,
+// such as "/downloads/" for the paths it prefixes or "/*.zip", to Rate per
+// second with bursts of Capacity, which defaults to the rate.
+type RateLimitRule struct {
+	Pattern  string
+	Rate     float64
+	Capacity int64
+}
 
 type Config struct {
 	Listen        string
@@ -12,6 +52,305 @@ type Config struct {
 	Origin        string
 	AllowOrigin   []string `toml:"allow-origin"`
 	HTTPRateLimit int64
+
+	// LogFormat writes an access log line per request to stdout in the
+	// format "json" or "combined", the combined log format followed by
+	// the duration and the cache status. Empty disables the access log.
+	LogFormat string
+
+	// OriginMaxFetches caps concurrent requests to the origin. Zero means
+	// 32, a negative number means no limit.
+	OriginMaxFetches int
+
+	// OriginMaxFileSize is the size in bytes above which origin responses
+	// held in memory, and files of a local Root, are rejected with HTTP
+	// 502. Zero means 1 GiB, a negative number means no limit.
+	OriginMaxFileSize int64
+
+	// OriginRedirects selects how redirects of the origin are handled:
+	// "follow" follows up to OriginMaxRedirects redirects, 10 by default,
+	// "reject" responds with HTTP 502 and "relay" passes the redirect on
+	// to the client. Defaults to "follow".
+	OriginRedirects    string
+	OriginMaxRedirects int
+
+	// OriginSpoolThreshold is the size above which files are written to
+	// TmpDir as they're fetched instead of being held in memory. Zero
+	// means 1 MiB. Without TmpDir files aren't spooled.
+	OriginSpoolThreshold int64
+
+	// StripPrefix is the path prefix the server is mounted at, such as
+	// "/assets". It's removed from request paths before files are looked
+	// up; requests for other paths get HTTP 404.
+	StripPrefix string
+
+	// Root serves files from a local directory instead of an origin server,
+	// as does an Origin such as "file:///var/www". Files from the local
+	// directory aren't revalidated.
+	Root string
+
+	// ContentTypes maps file extensions, such as ".wasm", to the content
+	// type sent for files with the extension, overriding the type sent by
+	// the origin.
+	ContentTypes map[string]string
+
+	// NoSniff sends X-Content-Type-Options: nosniff and serves files
+	// without a content type from the origin or their extension as
+	// application/octet-stream instead of guessing the type from their
+	// content.
+	NoSniff bool
+
+	// OriginHeaders are sent on every request to the origin, such as
+	// "Authorization" for a private bucket or "User-Agent".
+	OriginHeaders map[string]string
+
+	// Origins lists failover origins tried in order after Origin. Without
+	// Origin the first of Origins is the origin.
+	Origins []string
+
+	// TLSCertFile and TLSKeyFile serve HTTPS with the certificate and key
+	// in the PEM files when set. TLSMinVersion, such as "1.2", is the
+	// minimum TLS version accepted.
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion string
+
+	// RateLimitAddrFallback selects how requests with a client address
+	// which can't be parsed are rate limited: "error" responds with HTTP
+	// 500, "raw" rate limits on the raw address and "skip" doesn't rate
+	// limit. Defaults to "error".
+	RateLimitAddrFallback string
+
+	// GlobalRateLimit limits all requests together to GlobalRateLimit per
+	// second with bursts of GlobalRateLimitBurst, which defaults to the
+	// rate. Requests are rate limited per client as well when it's set, to
+	// HTTPRateLimit per second with bursts of as many, which defaults to
+	// 1000. Zero disables rate limiting.
+	GlobalRateLimit      float64
+	GlobalRateLimitBurst int64
+
+	// RateLimitRules limits requests per client by the first rule matching
+	// the request path instead of the default per client limit. They apply
+	// when GlobalRateLimit is set or any rule is; without GlobalRateLimit
+	// paths no rule matches aren't limited.
+	RateLimitRules []RateLimitRule
+
+	// RateLimitBuckets is the number of clients whose rate limits are
+	// tracked, 10000 by default. Past it the least recently seen client is
+	// forgotten and gets a full allowance on its next request; more buckets
+	// limit more clients accurately at a few hundred bytes each. Evictions are
+	// published as the filesrv.ratelimit.evictions expvar.
+	RateLimitBuckets int
+
+	// RateLimitTrustedHops is the number of proxies in front of the server
+	// appending to X-Forwarded-For. Zero rate limits on the left-most
+	// address of the header.
+	RateLimitTrustedHops int
+
+	// CacheMaxReaders caps concurrent readers of a single cached file.
+	CacheMaxReaders int
+
+	// OriginLengthRetries is the number of times an origin fetch is
+	// retried when the body doesn't match its Content-Length.
+	OriginLengthRetries int
+
+	// GenerateETag generates an ETag from the content of files the origin
+	// sends without one. Defaults to true.
+	GenerateETag bool
+
+	// ETagHash is the hash generated ETags are computed with: "md5", or
+	// the non-cryptographic "fnv" or "crc32". CRC-32 hashes large files
+	// many times faster than MD5. Defaults to "md5".
+	ETagHash string
+
+	// OriginDedupWindow is how long an origin fetch is reused for requests
+	// of the same file.
+	OriginDedupWindow Duration
+
+	// ForwardHeaders lists request headers, such as "Accept-Language",
+	// sent along on origin requests. Files are cached per header value.
+	ForwardHeaders []string
+
+	// IndexFiles lists index file names, such as "index.html", tried in
+	// order for requests ending in a slash. Empty disables index files.
+	IndexFiles []string
+
+	// TrackTransfers publishes responses in progress as the
+	// filesrv.transfers expvar.
+	TrackTransfers bool
+
+	// MaxRevalidateAge is how long a cached file is revalidated with the
+	// origin before it's evicted and fetched again.
+	MaxRevalidateAge Duration
+
+	// InvalidatorMaxDiff bounds the cache changes tracked by the
+	// invalidator between revalidation sweeps.
+	InvalidatorMaxDiff int
+
+	// CollapseRevalidation sends at most one revalidation request per
+	// cached file at a time.
+	CollapseRevalidation bool
+
+	// OriginStreamThreshold is the size in bytes above which files are
+	// streamed from the origin without being cached.
+	OriginStreamThreshold int64
+
+	// StaleWhileRevalidate serves cached files found stale for up to
+	// StaleWhileRevalidate while they're fetched again in the background.
+	// Zero evicts stale files right away.
+	StaleWhileRevalidate Duration
+
+	// InvalidatePeriod is how often cached files are revalidated with the
+	// origin. Defaults to 30s; zero disables revalidation.
+	InvalidatePeriod Duration
+
+	// CacheNegativeTTL is how long files missing on the origin are
+	// remembered as missing. Defaults to 5s; zero disables it.
+	CacheNegativeTTL Duration
+
+	// CacheTTL is how long files are cached before they're fetched again.
+	// Zero means no TTL.
+	CacheTTL Duration
+
+	// ExtensionTTL maps file extensions, such as ".html", to how long
+	// files are cached. "*" applies to other extensions.
+	ExtensionTTL map[string]Duration
+
+	// CacheGzipMaxSize caches a gzipped copy of compressible files of up
+	// to CacheGzipMaxSize bytes. Zero disables the copies.
+	CacheGzipMaxSize int64
+
+	// CacheBrotliMaxSize caches a brotli compressed copy of compressible
+	// files of up to CacheBrotliMaxSize bytes. Zero disables the copies.
+	CacheBrotliMaxSize int64
+
+	// CacheParanoid verifies the checksum of cached files on every hit.
+	CacheParanoid bool
+
+	// PurgeStream is the URL of a server-sent events stream of paths to
+	// purge pushed by the origin. Cached files aren't revalidated with
+	// the origin when it's set.
+	PurgeStream string
+
+	// PurgeRedis is the address, host:port, of a Redis server purges are
+	// published to and received from on PurgeRedisChannel, so a purge on
+	// one node reaches the caches of the others. The channel defaults to
+	// "filesrv:purge". PurgeRedisPassword is sent with AUTH when set. TLS
+	// isn't supported; reach a Redis server requiring it through a local
+	// TLS proxy.
+	PurgeRedis         string
+	PurgeRedisChannel  string
+	PurgeRedisPassword string
+
+	// ClientHints partitions cached files by client hint headers.
+	ClientHints []ClientHintRule
+
+	// CacheControlMaxAge is the max-age of the Cache-Control header sent
+	// for files without a Cache-Control header of the origin. Zero sends
+	// no header.
+	CacheControlMaxAge Duration
+
+	// Compress compresses text responses of at least CompressMinSize
+	// bytes for clients accepting gzip or deflate.
+	Compress        bool
+	CompressMinSize int64
+
+	// Brotli compresses with brotli as well for clients accepting it, at
+	// BrotliQuality from 0, fastest, to 11, smallest. Zero means 4.
+	Brotli        bool
+	BrotliQuality int
+
+	// NotFoundFallback is the file, such as "/index.html", served for
+	// missing files to requests accepting HTML, for single-page apps.
+	NotFoundFallback string
+
+	// ErrorPagePath is an HTML file served with HTTP 502 when the origin
+	// is unavailable, and NotFoundPagePath one served with HTTP 404 for
+	// missing files. They're read once at startup.
+	ErrorPagePath    string
+	NotFoundPagePath string
+
+	// Precompressed serves the name.br or name.gz sibling of a file on the
+	// origin, when there is one, to clients accepting brotli or gzip.
+	Precompressed bool
+
+	// CacheStatusHeader sends X-Cache: HIT or MISS on responses, for
+	// debugging.
+	CacheStatusHeader bool
+
+	// Via is the token appended to the Via header of responses. Defaults
+	// to "1.1 filesrv"; empty disables the header.
+	Via string
+
+	// InstanceID identifies the server in the CDN-Loop header of origin
+	// requests to detect proxy loops.
+	InstanceID string
+
+	// Placeholders serves placeholders for uncached large images.
+	Placeholders []PlaceholderRule
+
+	// StatusHeaders maps response status codes, such as "503", to headers
+	// set on responses with the status.
+	StatusHeaders map[string]map[string]string
+
+	// WarmSitemap is the URL of a sitemap listing files to load into the
+	// cache on startup, and PreloadPaths lists more such files. WarmWorkers
+	// files are loaded concurrently at up to WarmRate files per second.
+	WarmSitemap  string
+	PreloadPaths []string
+	WarmWorkers  int
+	WarmRate     float64
+
+	// New transfers of LargeTransferSize bytes or more are rejected while
+	// MaxTransfers are in progress or responses are written at MaxBandwidth
+	// bytes per second or more.
+	LargeTransferSize int64
+	MaxTransfers      int
+	MaxBandwidth      int64
+
+	// RetryOnReadError refetches a cached file which fails to read before
+	// the response is written.
+	RetryOnReadError bool
+
+	// RequestTimeout is how long a request may take until its response
+	// starts, including the origin fetch of a miss. Requests past it get
+	// HTTP 503. Responses started in time, such as large downloads, aren't
+	// cut off. Zero means no timeout.
+	RequestTimeout Duration
+
+	// DrainTimeout is how long shutdown waits for requests in progress
+	// before closing their connections. Defaults to 10s.
+	DrainTimeout Duration
+
+	// DrainTransfers lets requests in progress, such as large downloads,
+	// run to completion on shutdown up to DrainMax instead of
+	// DrainTimeout. DrainMax defaults to 5m.
+	DrainTransfers bool
+	DrainMax       Duration
+
+	// BasicAuthUser and BasicAuthPassword require HTTP Basic auth for
+	// files when either is set. Health checks don't require it.
+	BasicAuthUser     string
+	BasicAuthPassword string
+
+	// AdminToken guards the admin endpoints. They are disabled when empty.
+	AdminToken string
+
+	// AdminListen is the address, such as "127.0.0.1:6070", of a second
+	// listener serving the admin endpoints, expvar, pprof and health
+	// checks, so they aren't exposed on the public listener. The public
+	// listener serves files and health checks only. Empty serves
+	// everything on the public listener.
+	AdminListen string
+
+	// EnablePprof serves the net/http/pprof handlers under /debug/pprof/,
+	// on the admin listener when there's one, guarded by AdminToken when
+	// it's set.
+	EnablePprof bool
+
+	// ManifestPrefix limits the manifest of cached files to paths with the
+	// prefix.
+	ManifestPrefix string
 }
 
 func (c *Config) HasTempDir() bool {
@@ -19,7 +358,12 @@ func (c *Config) HasTempDir() bool {
 }
 
 func ReadFile(filename string) (*Config, error) {
-	config := new(Config)
+	config := &Config{
+		GenerateETag:     true,
+		Via:              "1.1 filesrv",
+		InvalidatePeriod: Duration{30 * time.Second},
+		CacheNegativeTTL: Duration{5 * time.Second},
+	}
 	_, err := toml.DecodeFile(filename, config)
 
 	if err != nil {
@@ -30,5 +374,17 @@ func ReadFile(filename string) (*Config, error) {
 		config.HTTPRateLimit = 1000
 	}
 
+	if config.OriginMaxFetches == 0 {
+		config.OriginMaxFetches = 32
+	}
+
+	if config.DrainTimeout.Duration == 0 {
+		config.DrainTimeout.Duration = 10 * time.Second
+	}
+
+	if config.DrainMax.Duration == 0 {
+		config.DrainMax.Duration = 5 * time.Minute
+	}
+
 	return config, err
 }
@@ -0,0 +1,235 @@
+package filesrv
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// contextOpener is implemented by filesystems which open files on behalf
+// of a request.
+type contextOpener interface {
+	OpenContext(ctx context.Context, name string) (http.File, error)
+}
+
+// openContext opens name from fs passing ctx along when fs supports it.
+func openContext(ctx context.Context, fs http.FileSystem, name string) (http.File, error) {
+	if co, ok := fs.(contextOpener); ok {
+		return co.OpenContext(ctx, name)
+	}
+
+	return fs.Open(name)
+}
+
+type contextKey int
+
+const (
+	originHeaderKey contextKey = iota
+	originRangeKey
+	loopKey
+	cacheStatusKey
+	requestHeaderKey
+	headKey
+	conditionalKey
+	forwardedKey
+)
+
+// varyKey returns the cache key of name fetched with the origin headers h
+// for a request with the headers req, when the file varies by the request
+// headers vary.
+func varyKey(name string, h http.Header, vary []string, req http.Header) string {
+	if len(vary) == 0 {
+		return cacheKey(name, h)
+	}
+
+	m := make(http.Header, len(h)+len(vary))
+
+	for k, v := range h {
+		m[k] = v
+	}
+
+	for _, k := range vary {
+		m[k] = req[k]
+	}
+
+	return cacheKey(name, m)
+}
+
+// CacheStatus is the outcome of opening a file from a cache.
+type CacheStatus int32
+
+const (
+	CacheNone CacheStatus = iota // not opened from a cache
+	CacheHit
+	CacheMiss
+)
+
+func (s CacheStatus) String() string {
+	switch s {
+	case CacheHit:
+		return "HIT"
+	case CacheMiss:
+		return "MISS"
+	}
+
+	return ""
+}
+
+// Load returns the status recorded in s.
+func (s *CacheStatus) Load() CacheStatus {
+	return CacheStatus(atomic.LoadInt32((*int32)(s)))
+}
+
+// WithCacheStatus returns a copy of ctx in which caches opening files
+// record whether they were served from the cache to s.
+func WithCacheStatus(ctx context.Context, s *CacheStatus) context.Context {
+	return context.WithValue(ctx, cacheStatusKey, s)
+}
+
+// cacheStatus returns the cache status of ctx, adding one to ctx when it
+// has none.
+func cacheStatus(ctx context.Context) (context.Context, *CacheStatus) {
+	if p, ok := ctx.Value(cacheStatusKey).(*CacheStatus); ok {
+		return ctx, p
+	}
+
+	p := new(CacheStatus)
+	return WithCacheStatus(ctx, p), p
+}
+
+// setCacheStatus records s to the cache status of ctx, if any.
+func setCacheStatus(ctx context.Context, s CacheStatus) {
+	if p, ok := ctx.Value(cacheStatusKey).(*CacheStatus); ok {
+		atomic.StoreInt32((*int32)(p), int32(s))
+	}
+}
+
+// withOriginHeader returns a copy of ctx carrying headers to send on
+// origin requests. Responses fetched with different origin headers are
+// cached separately.
+func withOriginHeader(ctx context.Context, h http.Header) context.Context {
+	return context.WithValue(ctx, originHeaderKey, h)
+}
+
+func originHeader(ctx context.Context) http.Header {
+	h, _ := ctx.Value(originHeaderKey).(http.Header)
+	return h
+}
+
+// withRequestHeader returns a copy of ctx carrying the headers of the
+// client request, which files varying by request headers are cached by.
+func withRequestHeader(ctx context.Context, h http.Header) context.Context {
+	return context.WithValue(ctx, requestHeaderKey, h)
+}
+
+func requestHeader(ctx context.Context) http.Header {
+	h, _ := ctx.Value(requestHeaderKey).(http.Header)
+	return h
+}
+
+// withForwarded returns a copy of ctx carrying the names of the request
+// headers forwarded to the origin, whether or not the request has them.
+func withForwarded(ctx context.Context, names []string) context.Context {
+	return context.WithValue(ctx, forwardedKey, names)
+}
+
+func forwarded(ctx context.Context) []string {
+	names, _ := ctx.Value(forwardedKey).([]string)
+	return names
+}
+
+// varyForwarded reports whether the request headers vary are all forwarded
+// to the origin by ctx. Variants by other headers aren't cached, since the
+// origin didn't see the headers it chose them by.
+func varyForwarded(ctx context.Context, vary []string) bool {
+	names := forwarded(ctx)
+
+	for _, k := range vary {
+		ok := false
+
+		for _, name := range names {
+			if http.CanonicalHeaderKey(name) == k {
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// withHeadRequest returns a copy of ctx for a HEAD request, for which
+// files are opened with their metadata only.
+func withHeadRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, headKey, true)
+}
+
+func headRequest(ctx context.Context) bool {
+	head, _ := ctx.Value(headKey).(bool)
+	return head
+}
+
+// byteRange is a byte range requested from the origin on the condition of
+// an If-Range validator, if any.
+type byteRange struct {
+	rng, ifRange string
+}
+
+// withOriginRange returns a copy of ctx carrying a byte range to request
+// from the origin instead of the whole file. With an If-Range validator the
+// origin sends the whole file when the validator doesn't match.
+func withOriginRange(ctx context.Context, rng, ifRange string) context.Context {
+	return context.WithValue(ctx, originRangeKey, byteRange{rng, ifRange})
+}
+
+func originRange(ctx context.Context) (rng, ifRange string) {
+	br, _ := ctx.Value(originRangeKey).(byteRange)
+	return br.rng, br.ifRange
+}
+
+// validators are the If-None-Match and If-Modified-Since validators of a
+// conditional client request.
+type validators struct {
+	ifNoneMatch, ifModifiedSince string
+}
+
+// withConditional returns a copy of ctx carrying the validators of a
+// conditional client request, which are passed to the origin on a miss so
+// it can answer with 304 instead of the file.
+func withConditional(ctx context.Context, ifNoneMatch, ifModifiedSince string) context.Context {
+	return context.WithValue(ctx, conditionalKey, validators{ifNoneMatch, ifModifiedSince})
+}
+
+func conditional(ctx context.Context) (ifNoneMatch, ifModifiedSince string) {
+	v, _ := ctx.Value(conditionalKey).(validators)
+	return v.ifNoneMatch, v.ifModifiedSince
+}
+
+// cacheKey returns the cache key of name fetched with the origin headers
+// h.
+func cacheKey(name string, h http.Header) string {
+	if len(h) == 0 {
+		return name
+	}
+
+	keys := make([]string, 0, len(h))
+
+	for k := range h {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+
+	for i, k := range keys {
+		parts[i] = k + "=" + strings.Join(h[k], ",")
+	}
+
+	return name + "#" + strings.Join(parts, "&")
+}
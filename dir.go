@@ -0,0 +1,143 @@
+package filesrv
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dirFileSystem serves the files of a local directory as if they were
+// fetched from an origin.
+type dirFileSystem struct {
+	dir   http.Dir
+	opt   DirOptions
+	types map[string]string
+}
+
+// DirOptions configures a filesystem created by NewDirWithOptions.
+type DirOptions struct {
+	// NoSniff never guesses the content type of files from their content.
+	// Files with an unknown extension are application/octet-stream.
+	NoSniff bool
+
+	// ContentTypes maps file extensions, such as ".wasm", to the content
+	// type of files with the extension.
+	ContentTypes map[string]string
+
+	// ETagHash returns the hash ETags are generated with. Nil means MD5.
+	ETagHash func() hash.Hash
+
+	// MaxFileSize is the size in bytes above which files are rejected with
+	// ErrFileTooLarge. Zero means 1 GiB, a negative number means no limit.
+	MaxFileSize int64
+}
+
+// NewDir returns a filesystem reading files from the directory root, for
+// running without an origin server. Files have a content type and an ETag
+// like files fetched from an origin, but aren't revalidated by the cache.
+func NewDir(root string) http.FileSystem {
+	return NewDirWithOptions(root, DirOptions{})
+}
+
+// NewDirWithOptions returns a filesystem reading files from the directory
+// root configured by opt. See NewDir.
+func NewDirWithOptions(root string, opt DirOptions) http.FileSystem {
+	fs := &dirFileSystem{dir: http.Dir(root), opt: opt}
+
+	for ext, ctype := range opt.ContentTypes {
+		if fs.types == nil {
+			fs.types = make(map[string]string)
+		}
+
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+
+		fs.types[strings.ToLower(ext)] = ctype
+	}
+
+	return fs
+}
+
+func (fs *dirFileSystem) Open(name string) (http.File, error) {
+	// the query is part of the cache key but not of the file name
+	if i := strings.IndexByte(name, '?'); i >= 0 {
+		name = name[:i]
+	}
+
+	f, err := fs.dir.Open(name)
+
+	if os.IsNotExist(err) {
+		return nil, http.ErrMissingFile
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	d, err := f.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// directories are served by their index files, if any
+	if d.IsDir() {
+		return nil, http.ErrMissingFile
+	}
+
+	max := fs.opt.MaxFileSize
+
+	if max == 0 {
+		max = defaultMaxFileSize
+	}
+
+	if max > 0 && d.Size() > max {
+		return nil, ErrFileTooLarge
+	}
+
+	buf, err := ioutil.ReadAll(f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ext := filepath.Ext(name)
+	contentType := fs.types[strings.ToLower(ext)]
+
+	if contentType == "" {
+		contentType = mime.TypeByExtension(ext)
+	}
+
+	if contentType == "" && fs.opt.NoSniff {
+		contentType = "application/octet-stream"
+	} else if contentType == "" {
+		contentType = http.DetectContentType(buf)
+	}
+
+	newHash := fs.opt.ETagHash
+
+	if newHash == nil {
+		newHash = md5.New
+	}
+
+	h := newHash()
+	h.Write(buf)
+	return &file{
+		ReadSeeker: bytes.NewReader(buf),
+		buf:        buf,
+		fi: fileInfo{
+			basename:    d.Name(),
+			modtime:     d.ModTime(),
+			size:        len(buf),
+			contentType: contentType,
+			etag:        `"` + hex.EncodeToString(h.Sum(nil)) + `"`,
+		},
+	}, nil
+}
@@ -0,0 +1,107 @@
+package filesrv
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/simonz05/util/assert"
+)
+
+func TestDir(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestDir")
+	root := t.TempDir()
+	ast.Nil(os.MkdirAll(filepath.Join(root, "docs"), 0755))
+	ast.Nil(ioutil.WriteFile(filepath.Join(root, "app.js"), []byte("var a;"), 0644))
+	ast.Nil(ioutil.WriteFile(filepath.Join(root, "docs", "index.html"), []byte("<p>docs</p>"), 0644))
+	ast.Nil(ioutil.WriteFile(filepath.Join(root, "data"), []byte("plain text"), 0644))
+
+	fs := NewCacheWithOptions(NewDir(root), CacheOptions{MaxItems: 10, InvalidatePeriod: 10 * time.Millisecond})
+	defer fs.Close()
+	server := httptest.NewServer(FileServerWithOptions(fs, ServeOptions{IndexFiles: []string{"index.html"}}))
+	defer server.Close()
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"/app.js", http.StatusOK, "text/javascript; charset=utf-8", "var a;"},
+		{"/app.js?v=2", http.StatusOK, "text/javascript; charset=utf-8", "var a;"},
+		{"/data", http.StatusOK, "text/plain; charset=utf-8", "plain text"},
+		{"/docs/", http.StatusOK, "text/html; charset=utf-8", "<p>docs</p>"},
+		{"/docs/?x=1", http.StatusOK, "text/html; charset=utf-8", "<p>docs</p>"},
+		{"/docs", http.StatusNotFound, "", ""},
+		{"/missing.js", http.StatusNotFound, "", ""},
+		{"/../etc/passwd", http.StatusNotFound, "", ""},
+	}
+
+	for _, tt := range tests {
+		res, err := http.Get(server.URL + tt.path)
+		ast.Nil(err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		ast.Equal(tt.status, res.StatusCode)
+
+		if tt.status == http.StatusOK {
+			ast.Equal(tt.contentType, res.Header.Get("Content-Type"))
+			ast.Equal(tt.body, string(body))
+			ast.Equal(34, len(res.Header.Get("ETag")))
+		}
+	}
+
+	// entries of local files stay cached past invalidator sweeps
+	time.Sleep(50 * time.Millisecond)
+	ast.Equal(int64(5), fs.(CacheStatter).Stats().Items)
+}
+
+func TestDirNoSniff(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestDirNoSniff")
+	root := t.TempDir()
+	ast.Nil(ioutil.WriteFile(filepath.Join(root, "data"), []byte("plain text"), 0644))
+	ast.Nil(ioutil.WriteFile(filepath.Join(root, "app.js"), []byte("var a;"), 0644))
+
+	tests := []struct {
+		name        string
+		contentType string
+	}{
+		{"/data", "application/octet-stream"},
+		{"/app.js", "text/javascript; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		f, err := NewDirWithOptions(root, DirOptions{NoSniff: true}).Open(tt.name)
+		ast.Nil(err)
+		ast.Equal(tt.contentType, f.(*file).fi.contentType)
+		f.Close()
+	}
+}
+
+func TestDirOptions(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestDirOptions")
+	root := t.TempDir()
+	ast.Nil(ioutil.WriteFile(filepath.Join(root, "app.wasm"), []byte("wasm"), 0644))
+	ast.Nil(ioutil.WriteFile(filepath.Join(root, "large.bin"), []byte("0123456789"), 0644))
+	fs := NewDirWithOptions(root, DirOptions{
+		ContentTypes: map[string]string{"WASM": "application/wasm"},
+		ETagHash:     func() hash.Hash { return crc32.NewIEEE() },
+		MaxFileSize:  8,
+	})
+
+	f, err := fs.Open("/app.wasm")
+	ast.Nil(err)
+	ast.Equal("application/wasm", f.(*file).fi.contentType)
+	ast.Equal(`"`+fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte("wasm")))+`"`, f.(*file).fi.etag)
+	f.Close()
+
+	_, err = fs.Open("/large.bin")
+	ast.Equal(ErrFileTooLarge, err)
+}
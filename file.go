@@ -2,18 +2,29 @@ package filesrv
 
 import (
 	"bytes"
+	"errors"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type fileInfo struct {
-	basename    string
-	modtime     time.Time
-	size        int
-	contentType string
-	etag        string
+	basename      string
+	url           string // URL the file was fetched from, if any
+	modtime       time.Time
+	size          int
+	contentType   string
+	etag          string // entity tag with quotes, such as W/"abc"
+	surrogateKeys []string
+	via           string   // Via header of the origin response
+	cacheControl  string   // Cache-Control header of the origin response
+	noStore       bool     // the origin forbids caching the file
+	vary          []string // request headers the origin response varies by
 }
 
 func (f fileInfo) Name() string       { return f.basename }
@@ -32,20 +43,183 @@ type file struct {
 	io.ReadSeeker
 	fi  fileInfo
 	buf []byte
+
+	// gzbuf and brbuf are the gzipped and brotli compressed content of a
+	// cached file, if any.
+	gzbuf []byte
+	brbuf []byte
+
+	// readers counts open read clones of the file.
+	readers int32
+
+	// mu guards reading the content into buf.
+	mu sync.Mutex
+
+	// parent is the file a read clone was made from.
+	parent *file
+	closed int32
+
+	// partial is set on files holding a single range of their content,
+	// which aren't cached.
+	partial bool
+
+	// streamed is set on files read from the origin as they're served,
+	// which aren't cached.
+	streamed bool
+
+	// spooled is set on files read from a temporary file, which aren't
+	// cached.
+	spooled bool
+
+	// meta is set on files holding only the metadata of their content,
+	// opened for HEAD requests, which aren't cached.
+	meta bool
+
+	// cached is when the file was cached, set on the clones of cache
+	// entries only.
+	cached time.Time
+}
+
+func (f *file) Close() error {
+	if f.parent != nil && atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		atomic.AddInt32(&f.parent.readers, -1)
+	}
+
+	if c, ok := f.ReadSeeker.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// size returns the number of bytes the file holds in memory.
+func (f *file) size() int64 {
+	return f.fi.Size() + int64(len(f.gzbuf)) + int64(len(f.brbuf))
+}
+
+// checksum returns the CRC-32 of the content and the compressed copies of
+// the file.
+func (f *file) checksum() uint32 {
+	sum := crc32.ChecksumIEEE(f.buf)
+	sum = crc32.Update(sum, crc32.IEEETable, f.gzbuf)
+	return crc32.Update(sum, crc32.IEEETable, f.brbuf)
+}
+
+// encoded returns the cached content of the file compressed with enc, or
+// nil without it.
+func (f *file) encoded(enc string) []byte {
+	switch enc {
+	case "gzip":
+		return f.gzbuf
+	case "br":
+		return f.brbuf
+	}
+
+	return nil
+}
+
+// cacheable reports whether the file holds its whole content in memory and
+// the origin allows caching it.
+func (f *file) cacheable() bool {
+	return !f.partial && !f.streamed && !f.spooled && !f.meta && !f.fi.noStore
 }
 
-func (f *file) Close() error                             { return nil }
 func (f *file) Stat() (os.FileInfo, error)               { return f.fi, nil }
 func (f *file) Readdir(count int) ([]os.FileInfo, error) { return nil, io.EOF }
 
-// returns a read clone of the file
-func (f *file) readClone() http.File {
-	if f.buf == nil {
-		// todo
-		panic("copy a readClone")
+// Readers returns the number of open read clones of the file.
+func (f *file) Readers() int {
+	return int(atomic.LoadInt32(&f.readers))
+}
+
+// buffer reads the content of a file without a buffer into one, leaving
+// the read position as it was.
+func (f *file) buffer() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.buf != nil {
+		return nil
+	}
+
+	pos, err := f.Seek(0, io.SeekCurrent)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
 	}
+
+	buf, err := ioutil.ReadAll(f.ReadSeeker)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+
+	f.buf = buf
+	return nil
+}
+
+// returns a read clone of the file. All clones share the backing buffer, so
+// a clone costs a bytes.Reader no matter the size of the file. A file
+// without a buffer is read into one first.
+func (f *file) readClone() (http.File, error) {
+	if err := f.buffer(); err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt32(&f.readers, 1)
 	return &file{
 		ReadSeeker: bytes.NewReader(f.buf),
 		fi:         f.fi,
+		gzbuf:      f.gzbuf,
+		brbuf:      f.brbuf,
+		parent:     f,
+	}, nil
+}
+
+// metaClone returns a file with the metadata of the file only.
+func (f *file) metaClone() http.File {
+	return &file{
+		ReadSeeker: &metaReader{size: f.fi.Size()},
+		fi:         f.fi,
+		gzbuf:      f.gzbuf,
+		brbuf:      f.brbuf,
+		meta:       true,
+	}
+}
+
+// errMetaOnly is returned reading a file opened with its metadata only.
+var errMetaOnly = errors.New("filesrv: file opened without content")
+
+// metaReader stands in for the content of a file holding its metadata
+// only. It seeks within the size of the content but can't be read.
+type metaReader struct {
+	size, off int64
+}
+
+func (r *metaReader) Read(p []byte) (int, error) {
+	return 0, errMetaOnly
+}
+
+func (r *metaReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
 	}
+
+	if offset < 0 {
+		return 0, errors.New("filesrv: negative position")
+	}
+
+	r.off = offset
+	return offset, nil
 }
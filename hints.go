@@ -0,0 +1,75 @@
+package filesrv
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+)
+
+// ClientHintRule partitions the cache for paths matching Pattern by the
+// client hint headers listed in Headers. Hint values are rounded up to
+// a small set of buckets to bound the number of partitions.
+type ClientHintRule struct {
+	// Pattern is a path.Match pattern.
+	Pattern string
+
+	// Headers lists the client hints, such as DPR or Viewport-Width.
+	Headers []string
+}
+
+var hintBuckets = map[string][]float64{
+	"Dpr":            {1, 1.5, 2, 3},
+	"Viewport-Width": {320, 640, 768, 1024, 1366, 1600, 1920, 2560},
+	"Width":          {320, 640, 768, 1024, 1366, 1600, 1920, 2560},
+}
+
+// bucketHint rounds the numeric hint value v up to the nearest bucket of
+// the hint. Values of hints without buckets are returned as is.
+func bucketHint(name, v string) (string, bool) {
+	buckets, ok := hintBuckets[name]
+
+	if !ok {
+		return v, v != ""
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+
+	if err != nil || n <= 0 {
+		return "", false
+	}
+
+	b := buckets[len(buckets)-1]
+
+	for _, bucket := range buckets {
+		if n <= bucket {
+			b = bucket
+			break
+		}
+	}
+
+	return strconv.FormatFloat(b, 'f', -1, 64), true
+}
+
+// clientHints returns the bucketed client hints of r for the first rule
+// matching the path of r, and the hint names of the rule.
+func clientHints(rules []ClientHintRule, r *http.Request) (http.Header, []string) {
+	for _, rule := range rules {
+		if ok, _ := path.Match(rule.Pattern, r.URL.Path); !ok {
+			continue
+		}
+
+		h := make(http.Header)
+
+		for _, name := range rule.Headers {
+			name = http.CanonicalHeaderKey(name)
+
+			if v, ok := bucketHint(name, r.Header.Get(name)); ok {
+				h.Set(name, v)
+			}
+		}
+
+		return h, rule.Headers
+	}
+
+	return nil, nil
+}
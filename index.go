@@ -0,0 +1,96 @@
+package filesrv
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// indexFileSystem opens directory names, ending in a slash, as the first
+// of a list of index files which exists. The matching index file of each
+// directory is remembered and tried first on later opens.
+type indexFileSystem struct {
+	fs    http.FileSystem
+	names []string
+	match map[string]string // dir -> index name
+	mu    sync.Mutex
+}
+
+func newIndexFileSystem(fs http.FileSystem, names []string) *indexFileSystem {
+	return &indexFileSystem{
+		fs:    fs,
+		names: names,
+		match: make(map[string]string),
+	}
+}
+
+func (fs *indexFileSystem) Open(name string) (http.File, error) {
+	return fs.OpenContext(context.Background(), name)
+}
+
+func (fs *indexFileSystem) OpenContext(ctx context.Context, name string) (http.File, error) {
+	// the query of a directory is kept on its index file
+	var query string
+
+	if i := strings.IndexByte(name, '?'); i >= 0 {
+		name, query = name[:i], name[i:]
+	}
+
+	if !strings.HasSuffix(name, "/") {
+		return openContext(ctx, fs.fs, name+query)
+	}
+
+	fs.mu.Lock()
+	index, ok := fs.match[name]
+	fs.mu.Unlock()
+
+	if ok {
+		if f, err := openContext(ctx, fs.fs, name+index+query); err == nil {
+			return f, nil
+		}
+	}
+
+	err := error(http.ErrMissingFile)
+
+	for _, index := range fs.names {
+		var f http.File
+		f, err = openContext(ctx, fs.fs, name+index+query)
+
+		if err != nil {
+			continue
+		}
+
+		fs.mu.Lock()
+		fs.match[name] = index
+		fs.mu.Unlock()
+		return f, nil
+	}
+
+	fs.mu.Lock()
+	delete(fs.match, name)
+	fs.mu.Unlock()
+	return nil, err
+}
+
+func (fs *indexFileSystem) delContext(ctx context.Context, name string) bool {
+	d, ok := fs.fs.(deleter)
+
+	if !ok {
+		return false
+	}
+
+	var query string
+
+	if i := strings.IndexByte(name, '?'); i >= 0 {
+		name, query = name[:i], name[i:]
+	}
+
+	if strings.HasSuffix(name, "/") {
+		fs.mu.Lock()
+		name += fs.match[name]
+		fs.mu.Unlock()
+	}
+
+	return d.delContext(ctx, name+query)
+}
@@ -0,0 +1,141 @@
+package filesrv
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errOverloaded = errors.New("filesrv: overloaded")
+
+// loadMeter accounts for the large transfers in progress and the bytes
+// written per second by all responses.
+type loadMeter struct {
+	maxTransfers int64
+	maxBandwidth int64
+	largeSize    int64
+	active       int64 // large transfers in progress
+	mu           sync.Mutex
+	window       time.Time // start of the current second
+	bytes        int64     // bytes written in the current second
+	lastBytes    int64     // bytes written in the previous second
+}
+
+func newLoadMeter(opt *ServeOptions) *loadMeter {
+	return &loadMeter{
+		maxTransfers: int64(opt.MaxTransfers),
+		maxBandwidth: opt.MaxBandwidth,
+		largeSize:    opt.LargeTransferSize,
+		window:       time.Now(),
+	}
+}
+
+// advance moves the window to the current second. Called with mu held.
+func (m *loadMeter) advance(now time.Time) {
+	switch d := now.Sub(m.window); {
+	case d >= 2*time.Second:
+		m.lastBytes, m.bytes = 0, 0
+		m.window = now
+	case d >= time.Second:
+		m.lastBytes, m.bytes = m.bytes, 0
+		m.window = m.window.Add(time.Second)
+	}
+}
+
+func (m *loadMeter) add(n int) {
+	m.mu.Lock()
+	m.advance(time.Now())
+	m.bytes += int64(n)
+	m.mu.Unlock()
+}
+
+// rate returns the bytes written per second.
+func (m *loadMeter) rate() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(time.Now())
+
+	if m.bytes > m.lastBytes {
+		return m.bytes
+	}
+
+	return m.lastBytes
+}
+
+// overloaded reports whether a new large transfer should be rejected.
+func (m *loadMeter) overloaded() bool {
+	if m.maxTransfers > 0 && atomic.LoadInt64(&m.active) >= m.maxTransfers {
+		return true
+	}
+
+	return m.maxBandwidth > 0 && m.rate() >= m.maxBandwidth
+}
+
+// loadWriter accounts a response to a loadMeter and rejects it with HTTP 503
+// when it's a large transfer and the server is overloaded.
+type loadWriter struct {
+	http.ResponseWriter
+	m           *loadMeter
+	large       bool
+	rejected    bool
+	wroteHeader bool
+}
+
+func (w *loadWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+	size, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+
+	if (code == http.StatusOK || code == http.StatusPartialContent) && err == nil && size >= w.m.largeSize {
+		if w.m.overloaded() {
+			w.reject()
+			return
+		}
+
+		w.large = true
+		atomic.AddInt64(&w.m.active, 1)
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loadWriter) reject() {
+	w.rejected = true
+	h := w.Header()
+
+	for _, k := range []string{"Content-Length", "Content-Range", "Accept-Ranges", "Etag", "Last-Modified"} {
+		h.Del(k)
+	}
+
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Retry-After", "1")
+	w.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+	w.ResponseWriter.Write([]byte("Service Unavailable\n"))
+}
+
+func (w *loadWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.rejected {
+		return 0, errOverloaded
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	w.m.add(n)
+	return n, err
+}
+
+// done ends the accounting of the response.
+func (w *loadWriter) done() {
+	if w.large {
+		atomic.AddInt64(&w.m.active, -1)
+	}
+}
@@ -0,0 +1,38 @@
+package filesrv
+
+import (
+	"github.com/simonz05/util/log"
+)
+
+// Logger logs the progress and errors of filesystems, caches and file
+// servers. A nil Logger in the options of a component means the util/log
+// package, which components logged with before they took a Logger, so
+// their zero options keep logging; use DiscardLogger for no output.
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// DiscardLogger is a Logger which discards all output.
+var DiscardLogger Logger = discardLogger{}
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, v ...interface{}) {}
+func (discardLogger) Println(v ...interface{})               {}
+
+// stdLogger logs with the util/log package.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) { log.Printf(format, v...) }
+func (stdLogger) Println(v ...interface{})               { log.Println(v...) }
+
+// loggerOrDefault returns l, or a logger logging with the util/log package
+// when l is nil.
+func loggerOrDefault(l Logger) Logger {
+	if l == nil {
+		return stdLogger{}
+	}
+
+	return l
+}
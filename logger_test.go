@@ -0,0 +1,66 @@
+package filesrv
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/simonz05/util/assert"
+)
+
+// recordingLogger records the lines logged.
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+}
+
+func (l *recordingLogger) Println(v ...interface{}) {
+	l.Printf("%s", fmt.Sprintln(v...))
+}
+
+func (l *recordingLogger) logged(prefix string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestLogger")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+	originLog, cacheLog := &recordingLogger{}, &recordingLogger{}
+	remote := NewWithOptions(origin.URL, RemoteOptions{Logger: originLog})
+	fs := NewCacheWithOptions(remote, CacheOptions{MaxItems: 10, InvalidatePeriod: -1, Logger: cacheLog})
+	defer fs.Close()
+
+	f, err := fs.Open("/file")
+	ast.Nil(err)
+	f.Close()
+	ast.Equal(true, originLog.logged("origin: /file"))
+	ast.Equal(false, originLog.logged("cache: "))
+	ast.Equal(true, cacheLog.logged("cache: /file"))
+	ast.Equal(false, cacheLog.logged("origin: "))
+
+	// failed opens are logged by the warmer
+	warmLog := &recordingLogger{}
+	ast.Equal(0, preload(fs, []string{"../file"}, WarmOptions{Logger: warmLog}))
+	ast.Equal(true, warmLog.logged("warm: ../file"))
+}
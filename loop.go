@@ -0,0 +1,46 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrLoopDetected is returned when the origin detects a request loop.
+var ErrLoopDetected = errors.New("filesrv: loop detected")
+
+// loopDetected reports whether the CDN-Loop header (RFC 8586) of r lists
+// id, meaning the request already passed this instance.
+func loopDetected(r *http.Request, id string) bool {
+	for _, v := range r.Header["Cdn-Loop"] {
+		for _, hop := range strings.Split(v, ",") {
+			if i := strings.Index(hop, ";"); i >= 0 {
+				hop = hop[:i]
+			}
+
+			if strings.TrimSpace(hop) == id {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// withLoop returns a copy of ctx carrying the CDN-Loop header of r with id
+// appended, to send on origin requests.
+func withLoop(ctx context.Context, r *http.Request, id string) context.Context {
+	hops := id
+
+	if v := strings.Join(r.Header["Cdn-Loop"], ", "); v != "" {
+		hops = v + ", " + id
+	}
+
+	return context.WithValue(ctx, loopKey, hops)
+}
+
+func loopHeader(ctx context.Context) string {
+	hops, _ := ctx.Value(loopKey).(string)
+	return hops
+}
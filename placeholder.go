@@ -0,0 +1,127 @@
+package filesrv
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// PlaceholderRule serves a placeholder for uncached images with names
+// starting with Prefix, typically a directory of large images, while the
+// image is fetched into the cache in the background. Clients get the image
+// once it's cached on a later request. Files are images by their content
+// type or extension; the origin is asked for their metadata first, so
+// missing files and files smaller than MinSize are served as usual.
+type PlaceholderRule struct {
+	Prefix string
+
+	// Placeholder is the name of the file served in place of the
+	// uncached image.
+	Placeholder string
+
+	// MinSize is the size in bytes from which images get a placeholder.
+	// Zero means any size.
+	MinSize int64
+}
+
+// cacheChecker is implemented by filesystems which can tell whether a file
+// is cached.
+type cacheChecker interface {
+	cached(ctx context.Context, name string) bool
+}
+
+type placeholders struct {
+	rules    []PlaceholderRule
+	mu       sync.Mutex
+	fetching map[string]bool
+	log      Logger
+}
+
+func newPlaceholders(rules []PlaceholderRule, log Logger) *placeholders {
+	return &placeholders{rules: rules, fetching: make(map[string]bool), log: log}
+}
+
+// match returns the rule for name or nil when no rule applies.
+func (p *placeholders) match(name string) *PlaceholderRule {
+	for i, rule := range p.rules {
+		if strings.HasPrefix(name, rule.Prefix) && name != rule.Placeholder {
+			return &p.rules[i]
+		}
+	}
+
+	return nil
+}
+
+// serve serves the placeholder for name when it's an uncached image and
+// starts fetching name in the background. It returns false when the
+// request should be served as usual.
+func (p *placeholders) serve(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name string, opt *ServeOptions) bool {
+	rule := p.match(name)
+	cc, ok := fs.(cacheChecker)
+
+	if rule == nil || !ok || cc.cached(r.Context(), name) {
+		return false
+	}
+
+	// the metadata isn't cached, a missing file is served as usual
+	f, err := openContext(withHeadRequest(r.Context()), fs, name)
+
+	if err != nil {
+		return false
+	}
+
+	d, err := f.Stat()
+	f.Close()
+
+	if err != nil || d.Size() < rule.MinSize || !isImage(name, d) {
+		return false
+	}
+
+	go p.fetch(context.WithoutCancel(r.Context()), fs, name)
+	w.Header().Set("Cache-Control", "no-store")
+	serveFile(w, r, fs, rule.Placeholder, opt)
+	return true
+}
+
+// isImage reports whether the file name with the info d is an image by its
+// content type or extension.
+func isImage(name string, d os.FileInfo) bool {
+	if fi, ok := d.(fileInfo); ok && strings.HasPrefix(fi.contentType, "image/") {
+		return true
+	}
+
+	return strings.HasPrefix(mime.TypeByExtension(path.Ext(name)), "image/")
+}
+
+// fetch opens name to have it cached unless it's already being fetched.
+func (p *placeholders) fetch(ctx context.Context, fs http.FileSystem, name string) {
+	key := cacheKey(name, originHeader(ctx))
+	p.mu.Lock()
+
+	if p.fetching[key] {
+		p.mu.Unlock()
+		return
+	}
+
+	p.fetching[key] = true
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.fetching, key)
+		p.mu.Unlock()
+	}()
+
+	f, err := openContext(ctx, fs, name)
+
+	if err != nil {
+		p.log.Printf("placeholder: %s: %v", name, err)
+		return
+	}
+
+	f.Close()
+}
@@ -0,0 +1,146 @@
+package filesrv
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// purger is implemented by caches which can remove a file and its
+// variants.
+type purger interface {
+	purge(name string) int
+}
+
+// logged is implemented by caches which log to a Logger, which their purge
+// listeners log to as well.
+type logged interface {
+	logger() Logger
+}
+
+// PurgeBroadcaster propagates purges between the caches of several nodes
+// serving the same origin. See CacheOptions.Broadcaster.
+type PurgeBroadcaster interface {
+	// Publish sends a purge message to the other nodes: a name purged,
+	// or a purge of all entries or of a surrogate key encoded by the
+	// cache. Messages are opaque to the broadcaster.
+	Publish(msg string) error
+
+	// Subscribe calls fn with the messages published by the other nodes.
+	// A node may receive its own messages as well.
+	Subscribe(fn func(msg string))
+}
+
+// PurgeListener reads purge events pushed by the origin as a stream of
+// server-sent events. The data of each event, of type purge or without a
+// type, is a path which is removed from the cache.
+type PurgeListener struct {
+	wg     sync.WaitGroup
+	url    string
+	p      purger
+	retry  time.Duration
+	cancel context.CancelFunc
+	log    Logger
+}
+
+// NewPurgeListener connects to the event stream at url and purges the
+// paths it receives from fs. The stream is reconnected when it ends.
+func NewPurgeListener(url string, fs http.FileSystem) (*PurgeListener, error) {
+	p, ok := fs.(purger)
+
+	if !ok {
+		return nil, errors.New("filesrv: filesystem can't purge")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pl := &PurgeListener{
+		url:    url,
+		p:      p,
+		retry:  time.Second,
+		cancel: cancel,
+		log:    stdLogger{},
+	}
+
+	if l, ok := fs.(logged); ok {
+		pl.log = l.logger()
+	}
+
+	pl.wg.Add(1)
+	go func() {
+		pl.run(ctx)
+		pl.wg.Done()
+	}()
+
+	return pl, nil
+}
+
+func (pl *PurgeListener) run(ctx context.Context) {
+	for {
+		err := pl.read(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pl.retry):
+			pl.log.Printf("purge listener: %v, reconnecting", err)
+		}
+	}
+}
+
+// read purges the paths of the event stream until it ends.
+func (pl *PurgeListener) read(ctx context.Context) error {
+	req, err := http.NewRequest("GET", pl.url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	sc := bufio.NewScanner(res.Body)
+	event := ""
+
+	for sc.Scan() {
+		line := sc.Text()
+
+		switch {
+		case line == "":
+			event = ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(line[len("event:"):])
+		case strings.HasPrefix(line, "data:") && (event == "" || event == "purge"):
+			name := strings.TrimSpace(line[len("data:"):])
+			n := pl.p.purge(name)
+			pl.log.Printf("purge listener: %s (%d)", name, n)
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	return errors.New("stream closed")
+}
+
+// Close stops listening for purge events.
+func (pl *PurgeListener) Close() error {
+	pl.cancel()
+	pl.wg.Wait()
+	return nil
+}
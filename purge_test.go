@@ -0,0 +1,212 @@
+package filesrv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simonz05/util/assert"
+)
+
+func TestPurgeListener(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestPurgeListener")
+	fs := newFakeFs()
+	cache := NewCache(fs, 10, 64)
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+
+	for _, name := range []string{"/file1", "/file2", "/file3"} {
+		fs.files[name] = newFile(name)
+		_, err := cache.Open(name)
+		ast.Nil(err)
+	}
+
+	events := make(chan string)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case ev := <-events:
+				fmt.Fprint(w, ev)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer origin.Close()
+
+	pl, err := NewPurgeListener(origin.URL, cache)
+	ast.Nil(err)
+	defer pl.Close()
+
+	events <- "data: /file1\n\n"
+	events <- "event: ping\ndata: /file2\n\n"
+	events <- "event: purge\ndata: /file3\n\n"
+	events <- ": done\n\n"
+
+	for i := 0; i < 100; i++ {
+		mc.mux.RLock()
+		_, ok := mc.cache["/file3"]
+		mc.mux.RUnlock()
+
+		if !ok {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mc.mux.RLock()
+	defer mc.mux.RUnlock()
+	_, ok1 := mc.cache["/file1"]
+	_, ok2 := mc.cache["/file2"]
+	_, ok3 := mc.cache["/file3"]
+	ast.Equal(false, ok1)
+	ast.Equal(true, ok2)
+	ast.Equal(false, ok3)
+}
+
+func TestCachePurgeVariants(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCachePurgeVariants")
+	fs := &hintFs{}
+	cache := NewCache(fs, 10, 64).(*memoryCacheFilesystem)
+	defer cache.Close()
+
+	for _, dpr := range []string{"", "1", "2"} {
+		h := make(http.Header)
+
+		if dpr != "" {
+			h.Set("DPR", dpr)
+		}
+
+		_, err := cache.OpenContext(withOriginHeader(context.Background(), h), "/img")
+		ast.Nil(err)
+	}
+
+	_, err := cache.Open("/imgx")
+	ast.Nil(err)
+	ast.Equal(3, cache.purge("/img"))
+	ast.Equal(1, len(cache.cache))
+}
+
+func TestCachePurge(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCachePurge")
+	fs := newFakeFs()
+	files := []string{"/file1", "/file2", "/file3"}
+
+	for _, name := range files {
+		fs.files[name] = newFile(name)
+	}
+
+	cache := NewCache(fs, 10, 1024)
+	defer cache.Close()
+	mc := cache.(*memoryCacheFilesystem)
+
+	for _, name := range files {
+		f, err := cache.Open(name)
+		ast.Nil(err)
+		f.Close()
+	}
+
+	p := cache.(Purger)
+	ast.Equal(true, p.Purge("/file1"))
+	ast.Equal(false, p.Purge("/file1"))
+	ast.Equal(2, mc.evictList.Len())
+
+	p.PurgeAll()
+	ast.Equal(0, mc.evictList.Len())
+	ast.Equal(0, len(mc.cache))
+	ast.Equal(int64(0), mc.size)
+
+	f, err := cache.Open("/file2")
+	ast.Nil(err)
+	f.Close()
+	ast.Equal(2, fs.filesStat["/file2"])
+}
+
+// memBroadcaster delivers purges to the subscribers of the same process.
+type memBroadcaster struct {
+	mu   sync.Mutex
+	subs []func(msg string)
+}
+
+func (b *memBroadcaster) Publish(msg string) error {
+	b.mu.Lock()
+	subs := b.subs
+	b.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(msg)
+	}
+
+	return nil
+}
+
+func (b *memBroadcaster) Subscribe(fn func(msg string)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, fn)
+}
+
+func TestCachePurgeBroadcast(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCachePurgeBroadcast")
+	fs := newFakeFs()
+	fs.files["/file1"] = newFile("/file1")
+	fs.files["/file2"] = newFile("/file2")
+	fs.files["/file3"] = newFile("/file3")
+	fs.files["/file3"].fi.surrogateKeys = []string{"product-42"}
+	b := &memBroadcaster{}
+	var nodes []*memoryCacheFilesystem
+
+	for i := 0; i < 3; i++ {
+		cache := NewCacheWithOptions(fs, CacheOptions{MaxItems: 10, MaxSize: 1024, Broadcaster: b})
+		defer cache.Close()
+		nodes = append(nodes, cache.(*memoryCacheFilesystem))
+
+		for _, name := range []string{"/file1", "/file2", "/file3"} {
+			f, err := cache.Open(name)
+			ast.Nil(err)
+			f.Close()
+		}
+	}
+
+	ast.Equal(true, nodes[0].Purge("/file1"))
+
+	for _, mc := range nodes {
+		_, ok1 := mc.cache["/file1"]
+		_, ok2 := mc.cache["/file2"]
+		ast.Equal(false, ok1)
+		ast.Equal(true, ok2)
+	}
+
+	// a purge of a file the node doesn't hold still reaches the others
+	f, err := nodes[2].Open("/file1")
+	ast.Nil(err)
+	f.Close()
+	ast.Equal(false, nodes[0].Purge("/file1"))
+	_, ok := nodes[2].cache["/file1"]
+	ast.Equal(false, ok)
+
+	// purges of surrogate keys and of everything propagate as well
+	ast.Equal(1, nodes[1].PurgeSurrogateKey("product-42"))
+
+	for _, mc := range nodes {
+		_, ok2 := mc.cache["/file2"]
+		_, ok3 := mc.cache["/file3"]
+		ast.Equal(true, ok2)
+		ast.Equal(false, ok3)
+	}
+
+	nodes[2].PurgeAll()
+
+	for _, mc := range nodes {
+		ast.Equal(0, len(mc.cache))
+	}
+}
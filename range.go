@@ -0,0 +1,116 @@
+package filesrv
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	errOutsideRange     = errors.New("filesrv: read outside of the fetched range")
+	errNegativePosition = errors.New("filesrv: negative position")
+)
+
+// singleRange returns the Range header of r when it asks for a single
+// range which can be fetched from the origin as is. Multiple ranges are
+// fetched as whole files.
+func singleRange(r *http.Request) string {
+	rng := r.Header.Get("Range")
+
+	if !strings.HasPrefix(rng, "bytes=") || strings.Contains(rng, ",") {
+		return ""
+	}
+
+	return rng
+}
+
+// ifRangeMatches reports whether the If-Range validator v, an ETag or a
+// date, matches the file with the info fi, in which case a range of the
+// file is served. An ETag matches by strong comparison, a date by the
+// second. An empty validator always matches.
+func ifRangeMatches(v string, fi fileInfo) bool {
+	if v == "" {
+		return true
+	}
+
+	if strings.HasPrefix(v, `"`) || strings.HasPrefix(v, "W/") {
+		return !strings.HasPrefix(v, "W/") && v == fi.etag
+	}
+
+	t, err := http.ParseTime(v)
+	return err == nil && !fi.modtime.IsZero() && t.Unix() == fi.modtime.Unix()
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes first-last/size".
+func parseContentRange(s string) (first, size int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, false
+	}
+
+	i := strings.Index(s, "-")
+	j := strings.Index(s, "/")
+
+	if i < 0 || j < i {
+		return 0, 0, false
+	}
+
+	first, err := strconv.ParseInt(s[len("bytes "):i], 10, 64)
+
+	if err != nil {
+		return 0, 0, false
+	}
+
+	size, err = strconv.ParseInt(s[j+1:], 10, 64)
+
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return first, size, true
+}
+
+// rangeReader reads a window of a file fetched with a range request. It
+// seeks within the whole file but fails reads outside of the window.
+type rangeReader struct {
+	buf  []byte // the window
+	off  int64  // offset of the window
+	size int64  // size of the whole file
+	pos  int64
+}
+
+func newRangeReader(buf []byte, off, size int64) *rangeReader {
+	return &rangeReader{buf: buf, off: off, size: size, pos: off}
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.pos < r.off || r.pos >= r.off+int64(len(r.buf)) {
+		return 0, errOutsideRange
+	}
+
+	n := copy(p, r.buf[r.pos-r.off:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+
+	if offset < 0 {
+		return 0, errNegativePosition
+	}
+
+	r.pos = offset
+	return offset, nil
+}
@@ -2,48 +2,353 @@ package filesrv
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"mime"
+	"net"
 	"net/http"
-	"os"
+	"net/url"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+)
+
+// ErrContentLength is returned when the origin sends a body which doesn't
+// match its Content-Length.
+var ErrContentLength = errors.New("filesrv: body does not match Content-Length")
+
+// ErrFileTooLarge is returned when the origin sends a body larger than the
+// maximum file size held in memory.
+var ErrFileTooLarge = errors.New("filesrv: file exceeds maximum size")
+
+// ErrOriginRedirect is returned when the origin redirects a request and
+// redirects are rejected.
+var ErrOriginRedirect = errors.New("filesrv: origin redirected")
+
+// ErrOriginUnavailable is wrapped with the error of the last origin when no
+// origin can be reached or all respond with a server error.
+var ErrOriginUnavailable = errors.New("filesrv: origin unavailable")
+
+// notModifiedError is returned opening a file for a conditional request
+// which the origin answered with 304 Not Modified. It holds the headers of
+// the origin response.
+type notModifiedError struct {
+	header http.Header
+}
+
+func (e *notModifiedError) Error() string { return "filesrv: not modified" }
+
+// redirectError is returned opening a file the origin redirects when
+// redirects are relayed to the client.
+type redirectError struct {
+	status   int
+	location string
+}
+
+func (e *redirectError) Error() string {
+	return fmt.Sprintf("filesrv: origin redirected with %d to %s", e.status, e.location)
+}
+
+// RedirectPolicy selects how redirects of the origin are handled.
+type RedirectPolicy int
+
+const (
+	// RedirectFollow follows redirects up to a maximum number, after which
+	// the fetch fails.
+	RedirectFollow RedirectPolicy = iota
 
-	"github.com/simonz05/util/log"
+	// RedirectReject fails fetches the origin redirects with
+	// ErrOriginRedirect.
+	RedirectReject
+
+	// RedirectRelay passes redirects of the origin on to the client.
+	// Locations on the origin are relayed as paths of the file server.
+	RedirectRelay
 )
 
+// defaultMaxRedirects is the number of redirects followed when
+// RemoteOptions.MaxRedirects is zero.
+const defaultMaxRedirects = 10
+
+// ErrNotModified is returned by Refresh when the file didn't change on the
+// origin.
+var ErrNotModified = errors.New("filesrv: not modified")
+
+var (
+	errRangeNotSatisfiable = errors.New("filesrv: range not satisfiable")
+	errRangeFallback       = errors.New("filesrv: range can't be fetched")
+	errHeadFallback        = errors.New("filesrv: metadata can't be fetched")
+	errServerError         = errors.New("filesrv: origin server error")
+)
+
+// RemoteOptions configures a filesystem created by NewWithOptions.
+type RemoteOptions struct {
+	// LengthRetries is the number of times a fetch is retried when the
+	// body doesn't match the advertised Content-Length.
+	LengthRetries int
+
+	// Client is the client used for requests to the origin. Nil means a
+	// client waiting up to 30 seconds for the response header, without
+	// bounding how long a body takes to read.
+	Client *http.Client
+
+	// StreamThreshold is the size in bytes above which files are streamed
+	// from the origin to the client as they're read instead of being
+	// buffered. Streamed files aren't cached. Zero means all files are
+	// buffered.
+	StreamThreshold int64
+
+	// SpoolDir is a directory files larger than SpoolThreshold bytes are
+	// written to as they're fetched, instead of being held in memory.
+	// Spooled files take precedence over streamed ones and aren't cached.
+	// Empty disables spooling; zero SpoolThreshold means 1 MiB.
+	SpoolDir       string
+	SpoolThreshold int64
+
+	// Logger logs fetches and failovers.
+	Logger Logger
+
+	// Observer, if set, is notified of every request to the origins.
+	Observer OriginObserver
+
+	// Redirects selects how redirects of the origins are handled, with
+	// MaxRedirects the number of redirects followed. Zero MaxRedirects
+	// means 10. Unless redirects are followed, a cached file the origin
+	// starts redirecting is evicted when it's revalidated.
+	Redirects    RedirectPolicy
+	MaxRedirects int
+
+	// MaxFileSize is the size in bytes above which bodies read into memory
+	// are rejected with ErrFileTooLarge. Streamed and spooled bodies aren't
+	// limited. Zero means 1 GiB, a negative number means no limit.
+	MaxFileSize int64
+
+	// MaxFetches caps the number of concurrent requests to the origins.
+	// Further fetches wait for a request to complete. Streamed and spooled
+	// bodies are read past the cap. Zero or a negative number means no
+	// limit.
+	MaxFetches int
+
+	// Header is sent on every request to the origins, including
+	// revalidations, such as an Authorization header for a private
+	// bucket or a User-Agent.
+	Header http.Header
+
+	// Failover lists origins tried in order when the origin can't be
+	// reached or responds with a server error.
+	Failover []string
+
+	// ContentTypes maps file extensions, such as ".wasm", to the content
+	// type of files with the extension. It takes precedence over the
+	// Content-Type header of the origin.
+	ContentTypes map[string]string
+
+	// NoSniff never guesses the content type of files from their content.
+	// Files without a content type from the origin or their extension are
+	// application/octet-stream.
+	NoSniff bool
+
+	// DisableETag leaves the ETag of files empty when the origin sends
+	// none, instead of generating one from the content. Such files are
+	// validated by their modification time alone.
+	DisableETag bool
+
+	// ETagHash returns the hash ETags are generated with. Nil means MD5;
+	// a non-cryptographic hash such as CRC-32 hashes large files many
+	// times faster.
+	ETagHash func() hash.Hash
+}
+
+// OriginObserver observes requests to the origins, such as to record
+// metrics.
+type OriginObserver interface {
+	// Observe is called when a request completes with its duration,
+	// including reading a body held in memory, the size of the body and
+	// the status of the response. The size of a body which is streamed
+	// or spooled is its Content-Length, -1 when unknown. The status is
+	// zero when no response was received.
+	Observe(d time.Duration, size int64, status int)
+}
+
+// defaultClient is used for origin requests when no client is configured.
+// Connecting and waiting for the response header are bounded by its
+// transport; reading a body is bounded only by the request context, so
+// large bodies which are streamed or spooled aren't cut off.
+var defaultClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+	},
+}
+
 type remoteFileSystem struct {
-	origin string
+	origins []string
+	opt     RemoteOptions
+	client  *http.Client
+	errors  originErrors
+	bytes   int64         // body bytes fetched
+	fetches int64         // requests sent
+	sem     chan struct{} // slots of concurrent fetches, nil without a limit
+	types   map[string]string
+	header  http.Header // sent on every request
+	log     Logger
 }
 
-func getContentType(r *http.Response, rd io.ReadSeeker, name string) (string, error) {
-	const sniffLen = 512
-	ctypes, haveType := r.Header["Content-Type"]
-	var ctype string
+// defaultMaxFileSize is the maximum size of bodies read into memory when
+// RemoteOptions.MaxFileSize is zero.
+const defaultMaxFileSize = 1 << 30
 
-	if !haveType {
-		ctype = mime.TypeByExtension(filepath.Ext(name))
+// Origin error categories.
+const (
+	OriginErrorDNS     = "dns"
+	OriginErrorRefused = "refused"
+	OriginErrorTLS     = "tls"
+	OriginErrorTimeout = "timeout"
+	OriginErrorHTTP5xx = "http5xx"
+	OriginErrorOther   = "other"
+)
 
-		if ctype == "" {
-			// read a chunk to decide between utf-8 text and binary
-			var buf [sniffLen]byte
-			n, _ := io.ReadFull(rd, buf[:])
-			ctype = http.DetectContentType(buf[:n])
-			_, err := rd.Seek(0, os.SEEK_SET) // rewind to output whole file
+// originErrors counts failed origin fetches by category.
+type originErrors struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
 
-			if err != nil {
-				return "", err
-			}
+func (e *originErrors) inc(category string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.counts == nil {
+		e.counts = make(map[string]int64)
+	}
+
+	e.counts[category]++
+}
+
+func (e *originErrors) snapshot() map[string]int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m := make(map[string]int64, len(e.counts))
+
+	for k, v := range e.counts {
+		m[k] = v
+	}
+
+	return m
+}
+
+// classifyOriginError returns the category of an error returned by the
+// HTTP client for a request to the origin.
+func classifyOriginError(err error) string {
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return OriginErrorDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return OriginErrorRefused
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &certErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return OriginErrorTLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return OriginErrorTimeout
+	}
+
+	return OriginErrorOther
+}
+
+// OriginErrors returns the number of failed origin fetches by category:
+// DNS failures, refused connections, TLS errors, timeouts and HTTP 5xx
+// responses. Fetches cancelled by the caller aren't counted.
+func (fs *remoteFileSystem) OriginErrors() map[string]int64 {
+	return fs.errors.snapshot()
+}
+
+// sniffLen is the number of bytes used to detect the content type.
+const sniffLen = 512
+
+// getContentType returns the content type of name fetched with the
+// response r. Without a Content-Type header or a known extension the type
+// is sniffed from the start of rd, which is left at offset 0, or is
+// application/octet-stream unless sniff is set.
+func getContentType(r *http.Response, rd io.ReadSeeker, name string, sniff bool) (string, error) {
+	if ctypes, haveType := r.Header["Content-Type"]; haveType {
+		if len(ctypes) > 0 {
+			return ctypes[0], nil
 		}
-	} else if len(ctypes) > 0 {
-		ctype = ctypes[0]
+
+		return "", nil
 	}
 
-	return ctype, nil
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype, nil
+	} else if !sniff {
+		return "application/octet-stream", nil
+	}
+
+	if _, err := rd.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	// read a chunk to decide between utf-8 text and binary
+	var buf [sniffLen]byte
+	n, err := io.ReadFull(rd, buf[:])
+
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	// rewind to output whole file
+	if _, err := rd.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	if n == 0 {
+		return "application/octet-stream", nil
+	}
+
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// contentType returns the content type of name fetched with the response
+// r, which is the configured type of its extension if any.
+func (fs *remoteFileSystem) contentType(r *http.Response, rd io.ReadSeeker, name string) (string, error) {
+	if ctype := fs.typeOverride(name); ctype != "" {
+		return ctype, nil
+	}
+
+	return getContentType(r, rd, name, !fs.opt.NoSniff)
+}
+
+// typeOverride returns the content type configured for the extension of
+// name, if any.
+func (fs *remoteFileSystem) typeOverride(name string) string {
+	return fs.types[strings.ToLower(filepath.Ext(name))]
 }
 
 func getModtime(r *http.Response) (modtime time.Time) {
@@ -55,68 +360,741 @@ func getModtime(r *http.Response) (modtime time.Time) {
 	return
 }
 
-func getETag(r *http.Response, rd io.ReadSeeker) (etag string) {
-	etag = r.Header.Get("Etag")
-	etag = strings.Trim(etag, "\"")
+// getETag returns the ETag of the origin response r. A weak ETag keeps its
+// W/ prefix; an ETag the origin sent without quotes is quoted.
+func getETag(r *http.Response) string {
+	return parseETag(r.Header.Get("Etag"))
+}
+
+// parseETag returns the entity tag v, such as W/"abc", with its opaque tag
+// quoted.
+func parseETag(v string) string {
+	v = strings.TrimSpace(v)
+	weak := strings.HasPrefix(v, "W/")
+	v = strings.Trim(strings.TrimPrefix(v, "W/"), `"`)
 
-	if etag == "" {
-		hash := md5.New()
-		io.Copy(hash, rd)
-		etag = hex.EncodeToString(hash.Sum(nil))
+	if v == "" {
+		return ""
+	} else if weak {
+		return `W/"` + v + `"`
 	}
 
-	return
+	return `"` + v + `"`
+}
+
+// etag returns the ETag of the origin response r, or a strong one
+// generated from the content rd when the origin sends none, leaving rd at
+// offset 0.
+func (fs *remoteFileSystem) etag(r *http.Response, rd io.ReadSeeker) (string, error) {
+	if etag := getETag(r); etag != "" || fs.opt.DisableETag {
+		return etag, nil
+	}
+
+	if _, err := rd.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	newHash := fs.opt.ETagHash
+
+	if newHash == nil {
+		newHash = md5.New
+	}
+
+	h := newHash()
+
+	if _, err := io.Copy(h, rd); err != nil {
+		return "", err
+	}
+
+	if _, err := rd.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`, nil
+}
+
+// originInfo returns the file info of name fetched from the URL path taken
+// from the headers of the origin response res.
+func originInfo(res *http.Response, path, name string) fileInfo {
+	vary := varyHeaders(res)
+	return fileInfo{
+		basename:      name[strings.LastIndex(name, "/")+1:],
+		url:           path,
+		modtime:       getModtime(res),
+		surrogateKeys: strings.Fields(res.Header.Get("Surrogate-Key")),
+		via:           strings.Join(res.Header["Via"], ", "),
+		cacheControl:  res.Header.Get("Cache-Control"),
+		noStore:       noStore(res.Header.Get("Cache-Control")) || vary == nil,
+		vary:          vary,
+	}
+}
+
+// varyHeaders returns the canonical names of the request headers listed in
+// the Vary header of res, or nil for "Vary: *". Accept-Encoding is left out
+// since files are fetched unencoded.
+func varyHeaders(res *http.Response) []string {
+	vary := []string{}
+
+	for _, v := range res.Header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+
+			switch name {
+			case "*":
+				return nil
+			case "", "Accept-Encoding":
+				continue
+			}
+
+			vary = append(vary, name)
+		}
+	}
+
+	return vary
+}
+
+// noStore reports whether the Cache-Control header value cc forbids shared
+// caches from storing the response or serving it without revalidation.
+func noStore(cc string) bool {
+	for _, d := range strings.Split(cc, ",") {
+		if i := strings.Index(d, "="); i >= 0 {
+			d = d[:i]
+		}
+
+		switch strings.ToLower(strings.TrimSpace(d)) {
+		case "no-store", "no-cache", "private":
+			return true
+		}
+	}
+
+	return false
+}
+
+// fetch gets path from the origin with the request method and reads the
+// body. The body of a HEAD request is closed and the buffer returned nil.
+// Bodies larger than the stream or spool threshold aren't read; the
+// response is returned with a nil buffer and its body left open for the
+// caller to stream or spool and close. The fetch is aborted when ctx is
+// done, returning the context error.
+func (fs *remoteFileSystem) fetch(ctx context.Context, method, path string, header http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, path, nil)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for k, v := range fs.header {
+		req.Header[k] = v
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if hops := loopHeader(ctx); hops != "" {
+		req.Header.Set("CDN-Loop", hops)
+	}
+
+	if fs.sem != nil {
+		select {
+		case fs.sem <- struct{}{}:
+			defer func() { <-fs.sem }()
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	var status int
+	var size int64
+
+	if obs := fs.opt.Observer; obs != nil {
+		start := time.Now()
+		defer func() { obs.Observe(time.Since(start), size, status) }()
+	}
+
+	atomic.AddInt64(&fs.fetches, 1)
+	res, err := fs.client.Do(req)
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+
+		fs.errors.inc(classifyOriginError(err))
+		return nil, nil, err
+	}
+
+	status, size = res.StatusCode, res.ContentLength
+
+	fs.log.Println(path, res.ContentLength, res)
+
+	if res.StatusCode >= 500 && res.StatusCode != http.StatusLoopDetected {
+		fs.errors.inc(OriginErrorHTTP5xx)
+		res.Body.Close()
+		return nil, nil, errServerError
+	}
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		res.Body.Close()
+		return nil, nil, &notModifiedError{header: res.Header}
+	case http.StatusRequestedRangeNotSatisfiable:
+		res.Body.Close()
+		return nil, nil, errRangeNotSatisfiable
+	case http.StatusLoopDetected:
+		res.Body.Close()
+		return nil, nil, ErrLoopDetected
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		// redirects are only returned when they aren't followed
+		res.Body.Close()
+
+		if fs.opt.Redirects != RedirectRelay {
+			return nil, nil, ErrOriginRedirect
+		}
+
+		loc, err := fs.relayLocation(res)
+
+		if err != nil {
+			return nil, nil, ErrOriginRedirect
+		}
+
+		return nil, nil, &redirectError{status: res.StatusCode, location: loc}
+	}
+
+	ok := res.StatusCode == http.StatusOK || res.StatusCode == http.StatusPartialContent && header.Get("Range") != ""
+
+	if !ok || res.ContentLength == 0 {
+		res.Body.Close()
+		return nil, nil, http.ErrMissingFile
+	}
+
+	if method == "HEAD" {
+		res.Body.Close()
+		return res, nil, nil
+	}
+
+	if t := fs.opt.StreamThreshold; t > 0 && res.ContentLength > t || fs.spools(res.ContentLength) {
+		res.Body = &countingBody{ReadCloser: res.Body, n: &fs.bytes}
+		return res, nil, nil
+	}
+
+	if max := fs.maxFileSize(); max > 0 && res.ContentLength > max {
+		res.Body.Close()
+		return nil, nil, ErrFileTooLarge
+	}
+
+	buf, spool, err := fs.readBody(res)
+
+	if spool {
+		return res, nil, nil
+	}
+
+	res.Body.Close()
+
+	// a chunked body has an unknown length of -1
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	} else if err == io.ErrUnexpectedEOF || err == nil && res.ContentLength >= 0 && int64(len(buf)) != res.ContentLength {
+		return nil, nil, ErrContentLength
+	} else if err != nil {
+		return nil, nil, err
+	} else if len(buf) == 0 {
+		return nil, nil, http.ErrMissingFile
+	}
+
+	size = int64(len(buf))
+	atomic.AddInt64(&fs.bytes, size)
+	return res, buf, nil
+}
+
+// readBody reads the body of res. A body of unknown length outgrowing the
+// spool threshold isn't read to the end; instead res is left to be spooled
+// with the part read put back in front of the body. A body read to the end
+// is at most the maximum file size.
+func (fs *remoteFileSystem) readBody(res *http.Response) ([]byte, bool, error) {
+	if fs.opt.SpoolDir == "" || res.ContentLength >= 0 {
+		return fs.readAll(res.Body)
+	}
+
+	t := fs.spoolThreshold()
+	head, err := ioutil.ReadAll(io.LimitReader(res.Body, t+1))
+
+	if err != nil {
+		return nil, false, err
+	} else if int64(len(head)) <= t {
+		if max := fs.maxFileSize(); max > 0 && int64(len(head)) > max {
+			return nil, false, ErrFileTooLarge
+		}
+
+		return head, false, nil
+	}
+
+	atomic.AddInt64(&fs.bytes, int64(len(head)))
+	body := res.Body
+	res.Body = &countingBody{
+		ReadCloser: struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), body), body},
+		n: &fs.bytes,
+	}
+
+	return nil, true, nil
+}
+
+// readAll reads r to the end, failing with ErrFileTooLarge once more than
+// the maximum file size is read.
+func (fs *remoteFileSystem) readAll(r io.Reader) ([]byte, bool, error) {
+	max := fs.maxFileSize()
+
+	if max <= 0 {
+		buf, err := ioutil.ReadAll(r)
+		return buf, false, err
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+
+	if err == nil && int64(len(buf)) > max {
+		return nil, false, ErrFileTooLarge
+	}
+
+	return buf, false, err
+}
+
+// maxFileSize returns the maximum size of bodies read into memory, or a
+// negative number for no limit.
+func (fs *remoteFileSystem) maxFileSize() int64 {
+	if fs.opt.MaxFileSize == 0 {
+		return defaultMaxFileSize
+	}
+
+	return fs.opt.MaxFileSize
+}
+
+// countingBody adds the bytes read from a response body to n.
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	return n, err
+}
+
+// OriginFetches returns the number of requests sent to the origin for
+// files.
+func (fs *remoteFileSystem) OriginFetches() int64 {
+	return atomic.LoadInt64(&fs.fetches)
+}
+
+// OriginBytes returns the number of body bytes fetched from the origin.
+func (fs *remoteFileSystem) OriginBytes() int64 {
+	return atomic.LoadInt64(&fs.bytes)
 }
 
 func (fs *remoteFileSystem) Open(name string) (http.File, error) {
-	log.Printf("origin: %s\n", name)
-	path := fs.origin + name
-	res, err := http.DefaultClient.Get(path)
+	return fs.OpenContext(context.Background(), name)
+}
+
+// OpenContext opens name sending the origin headers of ctx along with the
+// request. The request to the origin is cancelled when ctx is done. When
+// ctx carries a byte range only that range is fetched, and the file
+// returned fails reads outside of it.
+//
+// The origins are tried in order, moving on when an origin can't be reached
+// or responds with a server error. A file missing on an origin isn't looked
+// up on the next. When all origins fail an error wrapping
+// ErrOriginUnavailable and the error of the last origin is returned.
+func (fs *remoteFileSystem) OpenContext(ctx context.Context, name string) (http.File, error) {
+	fs.log.Printf("origin: %s\n", name)
+	var err error
+
+	for _, origin := range fs.origins {
+		var f http.File
+		f, err = fs.openOrigin(ctx, origin+name, name)
+
+		if !failover(ctx, err) {
+			return f, err
+		}
+
+		fs.log.Printf("origin: %s: %v", origin+name, err)
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrOriginUnavailable, err)
+}
+
+// Refresh fetches name again unless it's unchanged since the version with
+// etag and modtime, in which case ErrNotModified is returned and the
+// version is kept. The origin is asked with If-None-Match when etag is set,
+// otherwise with If-Modified-Since.
+func (fs *remoteFileSystem) Refresh(ctx context.Context, name, etag string, modtime time.Time) (http.File, error) {
+	h := make(http.Header, len(originHeader(ctx))+1)
+
+	for k, v := range originHeader(ctx) {
+		h[k] = v
+	}
+
+	if etag != "" {
+		h.Set("If-None-Match", etag)
+	} else if !modtime.IsZero() {
+		h.Set("If-Modified-Since", modtime.UTC().Format(http.TimeFormat))
+	}
+
+	// the whole file is refreshed, whatever the client has
+	ctx = withOriginRange(withOriginHeader(ctx, h), "", "")
+	ctx = withConditional(ctx, "", "")
+	f, err := fs.OpenContext(ctx, name)
+
+	if _, ok := err.(*notModifiedError); ok {
+		return nil, ErrNotModified
+	}
+
+	return f, err
+}
+
+// checkRedirect returns the redirect check of an origin client with the
+// redirect policy p following up to max redirects.
+func checkRedirect(p RedirectPolicy, max int) func(*http.Request, []*http.Request) error {
+	if max == 0 {
+		max = defaultMaxRedirects
+	}
+
+	return func(req *http.Request, via []*http.Request) error {
+		if p != RedirectFollow {
+			// the redirect response is returned to fetch
+			return http.ErrUseLastResponse
+		} else if len(via) >= max {
+			return fmt.Errorf("filesrv: stopped after %d redirects", max)
+		}
+
+		return nil
+	}
+}
+
+// relayLocation returns the location of the redirect response res as
+// relayed to the client: a path of the file server for locations on an
+// origin, the absolute URL otherwise.
+func (fs *remoteFileSystem) relayLocation(res *http.Response) (string, error) {
+	u, err := res.Location()
+
+	if err != nil {
+		return "", err
+	}
+
+	loc := u.String()
+
+	for _, origin := range fs.origins {
+		if strings.HasPrefix(loc, origin+"/") {
+			return loc[len(origin):], nil
+		}
+	}
+
+	return loc, nil
+}
+
+// failover reports whether a fetch with ctx which failed with err is tried
+// on the next origin. Fetches cancelled by the caller aren't.
+func failover(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var urlErr *url.Error
+	return err == errServerError || errors.As(err, &urlErr)
+}
+
+// openOrigin opens name fetching it from path. The validators of a
+// conditional request in ctx are passed along, returning a
+// *notModifiedError when the origin answers with 304.
+func (fs *remoteFileSystem) openOrigin(ctx context.Context, path, name string) (http.File, error) {
+	header := originHeader(ctx)
+
+	if inm, ims := conditional(ctx); inm != "" || ims != "" {
+		h := make(http.Header, len(header)+2)
+
+		for k, v := range header {
+			h[k] = v
+		}
+
+		if inm != "" {
+			h.Set("If-None-Match", inm)
+		}
+
+		if ims != "" {
+			h.Set("If-Modified-Since", ims)
+		}
+
+		header = h
+	}
+
+	if headRequest(ctx) {
+		if f, err := fs.openHead(ctx, path, name, header); err != errHeadFallback {
+			return f, err
+		}
+	}
+
+	if rng, ifRange := originRange(ctx); rng != "" {
+		if f, err := fs.openRange(ctx, path, name, header, rng, ifRange); err != errRangeFallback {
+			return f, err
+		}
+	}
+
+	res, buf, err := fs.fetchRetry(ctx, path, header)
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer res.Body.Close()
-	log.Println(path, res.ContentLength, res)
+	return fs.newFile(res, buf, path, name)
+}
+
+// fetchRetry fetches path retrying on ErrContentLength.
+func (fs *remoteFileSystem) fetchRetry(ctx context.Context, path string, header http.Header) (*http.Response, []byte, error) {
+	res, buf, err := fs.fetch(ctx, "GET", path, header)
 
-	if res.StatusCode != http.StatusOK || res.ContentLength <= 0 {
-		return nil, http.ErrMissingFile
+	for i := 0; err == ErrContentLength && i < fs.opt.LengthRetries; i++ {
+		fs.log.Printf("origin: %s: %v, retrying", path, err)
+		res, buf, err = fs.fetch(ctx, "GET", path, header)
 	}
 
-	buf, err := ioutil.ReadAll(res.Body)
+	return res, buf, err
+}
+
+// openHead opens the metadata of name with a HEAD request to path. It
+// returns errHeadFallback when the response doesn't tell the length,
+// content type or ETag the file would have, in which case the whole file
+// is fetched instead.
+func (fs *remoteFileSystem) openHead(ctx context.Context, path, name string, header http.Header) (http.File, error) {
+	res, _, err := fs.fetch(ctx, "HEAD", path, header)
 
 	if err != nil {
 		return nil, err
 	}
 
+	contentType := fs.typeOverride(name)
+
+	if ctypes, haveType := res.Header["Content-Type"]; contentType == "" && haveType {
+		contentType = ctypes[0]
+	} else if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(name))
+	}
+
+	etag := getETag(res)
+
+	if res.ContentLength < 0 || contentType == "" || etag == "" && !fs.opt.DisableETag {
+		return nil, errHeadFallback
+	}
+
+	f := &file{ReadSeeker: &metaReader{size: res.ContentLength}, meta: true, fi: originInfo(res, path, name)}
+	f.fi.size = int(res.ContentLength)
+	f.fi.contentType = contentType
+	f.fi.etag = etag
+
+	return f, nil
+}
+
+// openRange fetches the byte range rng of path, passing the If-Range
+// validator ifRange along when set. It returns errRangeFallback when the
+// origin can't serve the range, in which case the whole file is fetched
+// instead.
+func (fs *remoteFileSystem) openRange(ctx context.Context, path, name string, header http.Header, rng, ifRange string) (http.File, error) {
+	h := make(http.Header, len(header)+2)
+
+	for k, v := range header {
+		h[k] = v
+	}
+
+	h.Set("Range", rng)
+
+	if ifRange != "" {
+		h.Set("If-Range", ifRange)
+	}
+
+	res, buf, err := fs.fetchRetry(ctx, path, h)
+
+	if err == errRangeNotSatisfiable {
+		return nil, errRangeFallback
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the origin ignored the range, or the If-Range validator didn't
+	// match, and sent the whole file
+	if res.StatusCode == http.StatusOK {
+		return fs.newFile(res, buf, path, name)
+	}
+
+	first, size, ok := parseContentRange(res.Header.Get("Content-Range"))
+
+	if !ok {
+		if buf == nil {
+			res.Body.Close()
+		}
+
+		return nil, errRangeFallback
+	}
+
+	var rd io.ReadSeeker
+
+	if buf == nil {
+		sr, err := newStreamReader(res.Body, first, size, sniffLen)
+
+		if err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+
+		rd, buf = sr, sr.head
+	} else {
+		rd = newRangeReader(buf, first, size)
+	}
+
+	contentType := fs.typeOverride(name)
+
+	if contentType == "" {
+		contentType = res.Header.Get("Content-Type")
+	}
+
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(name))
+	}
+
+	if contentType == "" && first == 0 && !fs.opt.NoSniff {
+		contentType = http.DetectContentType(buf)
+	} else if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	f := &file{ReadSeeker: rd, partial: true, fi: originInfo(res, path, name)}
+	f.fi.size = int(size)
+	f.fi.contentType = contentType
+	f.fi.etag = getETag(res)
+
+	return f, nil
+}
+
+// newFile returns the file of a whole body fetched from the origin. A nil
+// buf means the body is spooled or streamed.
+func (fs *remoteFileSystem) newFile(res *http.Response, buf []byte, path, name string) (http.File, error) {
+	if buf == nil && (fs.spools(res.ContentLength) || res.ContentLength < 0) {
+		return fs.newSpoolFile(res, path, name)
+	} else if buf == nil {
+		return fs.newStreamFile(res, path, name)
+	}
+
 	rd := bytes.NewReader(buf)
-	contentType, err := getContentType(res, rd, name)
+	contentType, err := fs.contentType(res, rd, name)
 
 	if err != nil {
 		return nil, err
 	}
 
-	etag := getETag(res, rd)
-	modtime := getModtime(res)
+	etag, err := fs.etag(res, rd)
 
-	f := &file{
-		ReadSeeker: rd,
-		buf:        buf,
-		fi: fileInfo{
-			size:        rd.Len(),
-			modtime:     modtime,
-			basename:    path,
-			contentType: contentType,
-			etag:        etag,
-		},
+	if err != nil {
+		return nil, err
+	}
+
+	f := &file{ReadSeeker: rd, buf: buf, fi: originInfo(res, path, name)}
+	f.fi.size = len(buf)
+	f.fi.contentType = contentType
+	f.fi.etag = etag
+
+	return f, nil
+}
+
+// newStreamFile returns a file reading the body of res as it's served.
+// Streamed files aren't cached and their ETag is the origin's, if any.
+func (fs *remoteFileSystem) newStreamFile(res *http.Response, path, name string) (http.File, error) {
+	rd, err := newStreamReader(res.Body, 0, res.ContentLength, sniffLen)
+
+	if err != nil {
+		res.Body.Close()
+		return nil, err
 	}
 
+	contentType, err := fs.contentType(res, rd, name)
+
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	f := &file{ReadSeeker: rd, streamed: true, fi: originInfo(res, path, name)}
+	f.fi.size = int(res.ContentLength)
+	f.fi.contentType = contentType
+	f.fi.etag = getETag(res)
+
 	return f, nil
 }
 
 func New(origin string) http.FileSystem {
-	return &remoteFileSystem{
-		origin: origin,
+	return NewWithOptions(origin, RemoteOptions{})
+}
+
+// NewWithClient returns a filesystem fetching files from origin with
+// client.
+func NewWithClient(origin string, client *http.Client) http.FileSystem {
+	return NewWithOptions(origin, RemoteOptions{Client: client})
+}
+
+// NewWithOptions returns a filesystem fetching files from origin
+// configured by opt.
+func NewWithOptions(origin string, opt RemoteOptions) http.FileSystem {
+	client := opt.Client
+
+	if client == nil {
+		client = defaultClient
 	}
+
+	if opt.Redirects != RedirectFollow || opt.MaxRedirects != 0 {
+		c := *client
+		c.CheckRedirect = checkRedirect(opt.Redirects, opt.MaxRedirects)
+		client = &c
+	}
+
+	fs := &remoteFileSystem{
+		origins: append([]string{origin}, opt.Failover...),
+		opt:     opt,
+		client:  client,
+		log:     loggerOrDefault(opt.Logger),
+	}
+
+	if n := opt.MaxFetches; n > 0 {
+		fs.sem = make(chan struct{}, n)
+	}
+
+	for k, v := range opt.Header {
+		if fs.header == nil {
+			fs.header = make(http.Header)
+		}
+
+		fs.header[http.CanonicalHeaderKey(k)] = v
+	}
+
+	for ext, ctype := range opt.ContentTypes {
+		if fs.types == nil {
+			fs.types = make(map[string]string)
+		}
+
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+
+		fs.types[strings.ToLower(ext)] = ctype
+	}
+
+	return fs
+}
+
+// httpClient returns the client used for requests to the origin.
+func (fs *remoteFileSystem) httpClient() *http.Client {
+	return fs.client
+}
+
+// staticHeader returns the header sent on every request to the origin.
+func (fs *remoteFileSystem) staticHeader() http.Header {
+	return fs.header
 }
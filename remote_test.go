@@ -0,0 +1,852 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/simonz05/util/assert"
+)
+
+// lengthOrigin advertises a Content-Length longer than the body for the
+// first bad responses.
+type lengthOrigin struct {
+	content string
+	bad     int
+	hits    int
+	mu      sync.Mutex
+}
+
+func (o *lengthOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	o.hits++
+	lie := o.hits <= o.bad
+	o.mu.Unlock()
+
+	if lie {
+		w.Header().Set("Content-Length", "100")
+	}
+
+	w.Write([]byte(o.content))
+}
+
+func TestRemoteContentLength(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteContentLength")
+	tests := []struct {
+		bad     int
+		retries int
+		hits    int
+		err     error
+	}{
+		{0, 0, 1, nil},
+		{1, 0, 1, ErrContentLength},
+		{1, 1, 2, nil},
+		{3, 2, 3, ErrContentLength},
+	}
+
+	for _, tt := range tests {
+		origin := &lengthOrigin{content: "truncated", bad: tt.bad}
+		server := httptest.NewServer(origin)
+		fs := NewWithOptions(server.URL, RemoteOptions{LengthRetries: tt.retries})
+		f, err := fs.Open("/file")
+		server.Close()
+
+		ast.Equal(tt.err, err)
+		ast.Equal(tt.hits, origin.hits)
+
+		if err == nil {
+			f.Seek(0, io.SeekStart)
+			body, _ := ioutil.ReadAll(f)
+			ast.Equal("truncated", string(body))
+		}
+	}
+}
+
+func TestRemoteDisableETag(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteDisableETag")
+	modtime := time.Date(2015, 9, 1, 15, 3, 1, 0, time.UTC)
+	var head http.Header
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			head = r.Header
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Last-Modified", modtime.Format(http.TimeFormat))
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+
+	for _, disable := range []bool{false, true} {
+		fs := NewWithOptions(origin.URL, RemoteOptions{DisableETag: disable})
+		server := httptest.NewServer(FileServer(fs))
+		res, err := http.Get(server.URL + "/file")
+		ast.Nil(err)
+		res.Body.Close()
+		server.Close()
+		_, haveETag := res.Header["Etag"]
+		ast.Equal(!disable, haveETag)
+	}
+
+	fs := NewWithOptions(origin.URL, RemoteOptions{DisableETag: true})
+	f, err := fs.Open("/file")
+	ast.Nil(err)
+	ci := &cacheInvalidator{log: DiscardLogger}
+	uptodate, err := ci.check(f.(*file).fi)
+	ast.Nil(err)
+	ast.Equal(true, uptodate)
+	ast.Equal(modtime.Format(http.TimeFormat), head.Get("If-Modified-Since"))
+	_, haveETag := head["If-None-Match"]
+	ast.Equal(false, haveETag)
+}
+
+func TestRemoteOpenContext(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteOpenContext")
+	release := make(chan bool)
+	defer close(release)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// block either before sending the headers or mid-body
+		if r.URL.Path == "/body" {
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+		}
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer origin.Close()
+
+	for _, path := range []string{"/body", "/header"} {
+		fs := New(origin.URL)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := fs.(*remoteFileSystem).OpenContext(ctx, path)
+		cancel()
+		ast.Equal(context.DeadlineExceeded, err)
+	}
+}
+
+func TestClassifyOriginError(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestClassifyOriginError")
+	tests := []struct {
+		err      error
+		category string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "origin"}, OriginErrorDNS},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, OriginErrorRefused},
+		{tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, OriginErrorTLS},
+		{&net.OpError{Op: "remote error", Err: tls.AlertError(40)}, OriginErrorTLS},
+		{&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, OriginErrorTLS},
+		{x509.HostnameError{Host: "origin"}, OriginErrorTLS},
+		{errors.New("tls: not a TLS error"), OriginErrorOther},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, OriginErrorTimeout},
+		{io.EOF, OriginErrorOther},
+	}
+
+	for _, tt := range tests {
+		err := &url.Error{Op: "Get", URL: "http://origin/file", Err: tt.err}
+		ast.Equal(tt.category, classifyOriginError(err))
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRemoteOriginErrors(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteOriginErrors")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	fs := New(origin.URL).(*remoteFileSystem)
+
+	_, err := fs.Open("/file")
+	ast.Equal(true, errors.Is(err, ErrOriginUnavailable))
+	origin.Close()
+	_, err = fs.Open("/file")
+	ast.NotNil(err)
+
+	errs := fs.OriginErrors()
+	ast.Equal(int64(1), errs[OriginErrorHTTP5xx])
+	ast.Equal(int64(1), errs[OriginErrorRefused])
+}
+
+func TestRemoteOriginBytes(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteOriginBytes")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+	remote := New(origin.URL).(*remoteFileSystem)
+	cache := NewCache(remote, 10, 1<<20)
+	defer cache.Close()
+	server := httptest.NewServer(FileServer(cache))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		body, _ := getFile(t, server.URL+"/file")
+		ast.Equal("content", body)
+		ast.Equal(int64(len("content")), remote.OriginBytes())
+	}
+
+	ast.Equal(int64(2*len("content")), server.Config.Handler.(*fileHandler).ServedBytes())
+}
+
+// countingTransport counts the requests made through it.
+type countingTransport struct {
+	methods []string
+	mu      sync.Mutex
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.methods = append(t.methods, req.Method)
+	t.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRemoteNewWithClient(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteNewWithClient")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+	transport := &countingTransport{}
+	cache := NewCache(NewWithClient(origin.URL, &http.Client{Transport: transport}), 10, 1<<20)
+	defer cache.Close()
+
+	f, err := cache.Open("/file")
+	ast.Nil(err)
+	f.Close()
+	ast.Nil(cache.(*memoryCacheFilesystem).Revalidate("/file"))
+	ast.Equal("GET HEAD", strings.Join(transport.methods, " "))
+	ast.Equal(defaultClient, New(origin.URL).(*remoteFileSystem).client)
+}
+
+// zeroReaderAt reads zeros.
+type zeroReaderAt struct{}
+
+func (zeroReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+func TestRemoteStreamThreshold(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteStreamThreshold")
+	const size = 100 << 20
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, io.NewSectionReader(zeroReaderAt{}, 0, size))
+	}))
+	defer origin.Close()
+	remote := NewWithOptions(origin.URL, RemoteOptions{StreamThreshold: 10 << 20})
+	cache := NewCache(remote, 10, 512<<20)
+	defer cache.Close()
+	server := httptest.NewServer(FileServer(cache))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/large")
+	ast.Nil(err)
+	n, err := io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	ast.Nil(err)
+	ast.Equal(int64(size), n)
+	ast.Equal(int64(size), remote.(*remoteFileSystem).OriginBytes())
+
+	req, _ := http.NewRequest("GET", server.URL+"/large", nil)
+	req.Header.Set("Range", "bytes=1048576-")
+	res, err = http.DefaultClient.Do(req)
+	ast.Nil(err)
+	n, err = io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	ast.Nil(err)
+	ast.Equal(http.StatusPartialContent, res.StatusCode)
+	ast.Equal(int64(size-1<<20), n)
+
+	ast.Equal(0, len(cache.(*memoryCacheFilesystem).cache))
+}
+
+func TestRemoteChunked(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteChunked")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/empty" {
+			w.(http.Flusher).Flush()
+			return
+		}
+
+		// flushing before the end of the body makes it chunked
+		w.Write([]byte("chunked "))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+	fs := New(origin.URL)
+
+	f, err := fs.Open("/file")
+	ast.Nil(err)
+	f.Seek(0, io.SeekStart)
+	body, _ := ioutil.ReadAll(f)
+	ast.Equal("chunked content", string(body))
+
+	_, err = fs.Open("/empty")
+	ast.Equal(http.ErrMissingFile, err)
+}
+
+func TestRemoteFailover(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteFailover")
+	var hits [3]int32
+	origin := func(i int, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+
+			if r.URL.Path == "/missing" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			} else if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+
+			w.Write([]byte("content"))
+		}))
+	}
+	down := origin(0, http.StatusOK)
+	down.Close()
+	unavailable := origin(1, http.StatusServiceUnavailable)
+	defer unavailable.Close()
+	ok := origin(2, http.StatusOK)
+	defer ok.Close()
+	fs := NewWithOptions(down.URL, RemoteOptions{Failover: []string{unavailable.URL, ok.URL}})
+
+	f, err := fs.Open("/file")
+	ast.Nil(err)
+	f.Seek(0, io.SeekStart)
+	body, _ := ioutil.ReadAll(f)
+	ast.Equal("content", string(body))
+	ast.Equal(int32(1), atomic.LoadInt32(&hits[1]))
+	ast.Equal(int32(1), atomic.LoadInt32(&hits[2]))
+
+	// a missing file isn't looked up on the next origin
+	_, err = fs.Open("/missing")
+	ast.Equal(http.ErrMissingFile, err)
+	ast.Equal(int32(2), atomic.LoadInt32(&hits[1]))
+	ast.Equal(int32(1), atomic.LoadInt32(&hits[2]))
+
+	// a fetch cancelled by the caller isn't tried on the next origin
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fs.(contextOpener).OpenContext(ctx, "/file")
+	ast.Equal(true, errors.Is(err, context.Canceled))
+	ast.Equal(int32(2), atomic.LoadInt32(&hits[1]))
+	ast.Equal(int32(1), atomic.LoadInt32(&hits[2]))
+
+	// the error of the last origin is kept
+	fs = NewWithOptions(down.URL, RemoteOptions{Failover: []string{unavailable.URL}})
+	_, err = fs.Open("/file")
+	ast.Equal(true, errors.Is(err, ErrOriginUnavailable))
+	ast.Equal(true, errors.Is(err, errServerError))
+}
+
+func TestRemoteFileURL(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteFileURL")
+	var heads int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			atomic.AddInt32(&heads, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+
+	f, err := New(origin.URL).Open("/dir/file")
+	ast.Nil(err)
+	fi := f.(*file).fi
+	ast.Equal("file", fi.Name())
+	ast.Equal(origin.URL+"/dir/file", fi.url)
+
+	ci := &cacheInvalidator{log: DiscardLogger}
+	uptodate, err := ci.check(fi)
+	ast.Nil(err)
+	ast.Equal(true, uptodate)
+	ast.Equal(int32(1), atomic.LoadInt32(&heads))
+
+	// files of other filesystems are skipped
+	uptodate, err = ci.check(newFile("local").fi)
+	ast.Nil(err)
+	ast.Equal(true, uptodate)
+	ast.Equal(int32(1), atomic.LoadInt32(&heads))
+}
+
+func TestNoStore(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestNoStore")
+	tests := []struct {
+		cc      string
+		noStore bool
+	}{
+		{"", false},
+		{"public, max-age=60", false},
+		{"no-store", true},
+		{"No-Cache", true},
+		{"private, max-age=60", true},
+		{"max-age=60, private=\"Set-Cookie\"", true},
+	}
+
+	for _, tt := range tests {
+		ast.Equal(tt.noStore, noStore(tt.cc))
+	}
+}
+
+func TestRemoteOriginUnavailable(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteOriginUnavailable")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer origin.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	for _, url := range []string{origin.URL, down.URL} {
+		_, err := New(url).Open("/file")
+		ast.Equal(true, errors.Is(err, ErrOriginUnavailable))
+	}
+}
+
+func TestRemoteSpool(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteSpool")
+	content := bytes.Repeat([]byte("0123456789"), 1<<10)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write(content[:100])
+		case "/sized":
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content)
+		default:
+			w.Write(content)
+		}
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	remote := NewWithOptions(origin.URL, RemoteOptions{SpoolDir: dir, SpoolThreshold: 1000})
+	spooled := func() int {
+		entries, err := ioutil.ReadDir(dir)
+		ast.Nil(err)
+		return len(entries)
+	}
+
+	// bodies of known and unknown length
+	for _, name := range []string{"/sized", "/chunked"} {
+		f, err := remote.Open(name)
+		ast.Nil(err)
+		ast.Equal(true, f.(*file).spooled)
+		ast.Equal(1, spooled())
+		fi, _ := f.Stat()
+		ast.Equal(int64(len(content)), fi.Size())
+		b, err := ioutil.ReadAll(f)
+		ast.Nil(err)
+		ast.Equal(true, bytes.Equal(content, b))
+		ast.Nil(f.Close())
+		ast.Equal(0, spooled())
+	}
+
+	f, err := remote.Open("/small")
+	ast.Nil(err)
+	ast.Equal(false, f.(*file).spooled)
+	ast.Equal(0, spooled())
+	f.Close()
+
+	// spooled files aren't cached
+	cache := NewCache(remote, 10, 1<<20)
+	defer cache.Close()
+	f, err = cache.Open("/chunked")
+	ast.Nil(err)
+	f.Close()
+	ast.Equal(0, len(cache.(*memoryCacheFilesystem).cache))
+	ast.Equal(0, spooled())
+}
+
+func TestRemoteMaxFetches(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteMaxFetches")
+	var inflight, max int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+
+		for {
+			m := atomic.LoadInt32(&max)
+
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+
+	fs := NewWithOptions(origin.URL, RemoteOptions{MaxFetches: 3})
+	var wg sync.WaitGroup
+
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			f, err := fs.Open(fmt.Sprintf("/file%d", i))
+			ast.Nil(err)
+			f.Close()
+		}(i)
+	}
+
+	wg.Wait()
+	ast.Equal(int32(3), atomic.LoadInt32(&max))
+
+	// waiting for a slot is cancelled with the request
+	block := make(chan bool)
+	blocking := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer blocking.Close()
+	defer close(block)
+	fs = NewWithOptions(blocking.URL, RemoteOptions{MaxFetches: 1})
+	go fs.Open("/slow")
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := fs.(*remoteFileSystem).OpenContext(ctx, "/file")
+	ast.Equal(context.DeadlineExceeded, err)
+	ast.Equal(int64(1), fs.(*remoteFileSystem).OriginFetches())
+}
+
+func TestRemoteContentTypes(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteContentTypes")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("\x00asm"))
+	}))
+	defer origin.Close()
+	fs := NewWithOptions(origin.URL, RemoteOptions{ContentTypes: map[string]string{
+		".wasm":       "application/wasm",
+		"webmanifest": "application/manifest+json",
+	}})
+	server := httptest.NewServer(FileServer(fs))
+	defer server.Close()
+
+	tests := []struct {
+		method      string
+		path        string
+		contentType string
+	}{
+		{"GET", "/app.wasm", "application/wasm"},
+		{"GET", "/APP.WASM", "application/wasm"},
+		{"HEAD", "/app.wasm", "application/wasm"},
+		{"GET", "/site.webmanifest", "application/manifest+json"},
+		{"GET", "/app.bin", "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		res, err := http.DefaultClient.Do(req)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal(http.StatusOK, res.StatusCode)
+		ast.Equal(tt.contentType, res.Header.Get("Content-Type"))
+	}
+}
+
+func TestRemoteSniffContentType(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteSniffContentType")
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0, 1, 2, 3}, 1000)...)
+	files := map[string][]byte{
+		"/image":  png,
+		"/binary": {0, 1, 2},
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// keep net/http from sniffing a type itself
+		w.Header()["Content-Type"] = nil
+		w.Write(files[r.URL.Path])
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+	}{
+		{"/image", "image/png"},
+		{"/binary", "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		f, err := New(origin.URL).Open(tt.name)
+		ast.Nil(err)
+		ast.Equal(tt.contentType, f.(*file).fi.contentType)
+		sum := md5.Sum(files[tt.name])
+		ast.Equal(`"`+hex.EncodeToString(sum[:])+`"`, f.(*file).fi.etag)
+
+		// the file reads from the start after sniffing and hashing
+		body, err := ioutil.ReadAll(f)
+		ast.Nil(err)
+		ast.Equal(true, bytes.Equal(files[tt.name], body))
+		f.Close()
+	}
+}
+
+func TestRemoteETag(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteETag")
+	content := []byte("content")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if etag := r.URL.Query().Get("etag"); etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+
+		w.Write(content)
+	}))
+	defer origin.Close()
+	server := httptest.NewServer(FileServer(New(origin.URL)))
+	defer server.Close()
+	sum := md5.Sum(content)
+
+	tests := []struct {
+		etag string
+		want string
+	}{
+		{`W/"abc"`, `W/"abc"`},
+		{`"abc"`, `"abc"`},
+		{`abc`, `"abc"`},
+		{``, `"` + hex.EncodeToString(sum[:]) + `"`},
+	}
+
+	for _, tt := range tests {
+		path := server.URL + "/file?etag=" + url.QueryEscape(tt.etag)
+		res, err := http.Get(path)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal(http.StatusOK, res.StatusCode)
+		ast.Equal(tt.want, res.Header.Get("ETag"))
+
+		// the ETag validates conditional requests
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("If-None-Match", tt.want)
+		res, err = http.DefaultClient.Do(req)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal(http.StatusNotModified, res.StatusCode)
+	}
+}
+
+func TestRemoteETagHash(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteETagHash")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+	h := fnv.New64a()
+	h.Write([]byte("content"))
+	want := `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+
+	// the ETag is the same for every fetch of the content
+	for i := 0; i < 2; i++ {
+		fs := NewWithOptions(origin.URL, RemoteOptions{ETagHash: func() hash.Hash { return fnv.New64a() }})
+		f, err := fs.Open("/file")
+		ast.Nil(err)
+		ast.Equal(want, f.(*file).fi.etag)
+		f.Close()
+	}
+}
+
+func BenchmarkETagHash(b *testing.B) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4<<20/16)
+	res := &http.Response{Header: make(http.Header)}
+	hashes := []struct {
+		name    string
+		newHash func() hash.Hash
+	}{
+		{"md5", nil},
+		{"fnv", func() hash.Hash { return fnv.New64a() }},
+		{"crc32", func() hash.Hash { return crc32.NewIEEE() }},
+	}
+
+	for _, h := range hashes {
+		b.Run(h.name, func(b *testing.B) {
+			fs := NewWithOptions("", RemoteOptions{ETagHash: h.newHash}).(*remoteFileSystem)
+			b.SetBytes(int64(len(content)))
+
+			for i := 0; i < b.N; i++ {
+				if _, err := fs.etag(res, bytes.NewReader(content)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoteMaxFileSize(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteMaxFileSize")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("chunked") != "" {
+			w.(http.Flusher).Flush()
+		}
+
+		w.Write(bytes.Repeat([]byte("x"), 100))
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		path string
+		max  int64
+		err  error
+	}{
+		{"/file", 100, nil},
+		{"/file", 99, ErrFileTooLarge},
+		{"/file?chunked=1", 99, ErrFileTooLarge},
+		{"/file?chunked=1", -1, nil},
+	}
+
+	for _, tt := range tests {
+		fs := NewWithOptions(origin.URL, RemoteOptions{MaxFileSize: tt.max})
+		f, err := fs.Open(tt.path)
+		ast.Equal(tt.err, err)
+
+		if f != nil {
+			f.Close()
+		}
+	}
+
+	// oversized files are a bad gateway, not missing
+	server := httptest.NewServer(FileServer(NewWithOptions(origin.URL, RemoteOptions{MaxFileSize: 10})))
+	defer server.Close()
+	res, err := http.Get(server.URL + "/file")
+	ast.Nil(err)
+	res.Body.Close()
+	ast.Equal(http.StatusBadGateway, res.StatusCode)
+}
+
+// recordingObserver records the sizes and statuses of origin requests.
+type recordingObserver struct {
+	mu       sync.Mutex
+	sizes    []int64
+	statuses []int
+}
+
+func (o *recordingObserver) Observe(d time.Duration, size int64, status int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sizes = append(o.sizes, size)
+	o.statuses = append(o.statuses, status)
+}
+
+func TestRemoteObserver(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteObserver")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write([]byte("content"))
+	}))
+	obs := &recordingObserver{}
+	fs := NewWithOptions(origin.URL, RemoteOptions{Observer: obs})
+
+	f, err := fs.Open("/file")
+	ast.Nil(err)
+	f.Close()
+	_, err = fs.Open("/missing")
+	ast.Equal(http.ErrMissingFile, err)
+	origin.Close()
+	_, err = fs.Open("/file")
+	ast.Equal(true, errors.Is(err, ErrOriginUnavailable))
+
+	ast.Equal(fmt.Sprint([]int64{7, 19, 0}), fmt.Sprint(obs.sizes))
+	ast.Equal(fmt.Sprint([]int{200, 404, 0}), fmt.Sprint(obs.statuses))
+}
+
+func TestRemoteHeader(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoteHeader")
+	var mu sync.Mutex
+	var requests []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.Header.Get("Authorization")+" "+r.Header.Get("User-Agent"))
+		mu.Unlock()
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+	remote := NewWithOptions(origin.URL, RemoteOptions{Header: http.Header{
+		"authorization": {"Bearer token"},
+		"User-Agent":    {"filesrv-test"},
+	}})
+	cache := NewCacheWithOptions(remote, CacheOptions{MaxItems: 10, InvalidatePeriod: 10 * time.Millisecond})
+	defer cache.Close()
+
+	f, err := cache.Open("/file")
+	ast.Nil(err)
+	f.Close()
+
+	// conditional refetches
+	_, err = remote.(refresher).Refresh(context.Background(), "/file", `"v1"`, time.Time{})
+	ast.Equal(ErrNotModified, err)
+
+	// revalidations by the invalidator
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		n := len(requests)
+		mu.Unlock()
+
+		if n >= 3 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	ast.Equal(true, len(requests) >= 3)
+	ast.Equal("GET Bearer token filesrv-test", requests[0])
+	ast.Equal("GET Bearer token filesrv-test", requests[1])
+	ast.Equal("HEAD Bearer token filesrv-test", requests[2])
+}
@@ -5,17 +5,287 @@
 package filesrv
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
-func serveFile(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name string) {
-	f, err := fs.Open(name)
+// readError is returned by openFile when a file opens but can't be read.
+type readError struct {
+	err error
+}
+
+func (e *readError) Error() string { return "filesrv: read: " + e.err.Error() }
+
+// deleter is implemented by caches which can drop the entry of a file
+// opened with a context.
+type deleter interface {
+	delContext(ctx context.Context, name string) bool
+}
+
+// probe reads a byte of f at its current position and rewinds it.
+func probe(f http.File) error {
+	var b [1]byte
+	pos, err := f.Seek(0, io.SeekCurrent)
 
 	if err != nil {
+		return err
+	}
+
+	if _, err := f.Read(b[:]); err != nil && err != io.EOF {
+		return err
+	}
+
+	_, err = f.Seek(pos, io.SeekStart)
+	return err
+}
+
+// openFile opens name from fs. With RetryOnReadError set the file is probed
+// before anything is written to the client; a file which fails to read is
+// dropped from the cache and opened once more. Files opened for HEAD
+// requests have no content to probe.
+func openFile(ctx context.Context, fs http.FileSystem, name string, opt *ServeOptions) (http.File, error) {
+	f, err := openContext(ctx, fs, name)
+
+	if err != nil || !opt.RetryOnReadError || headRequest(ctx) {
+		return f, err
+	}
+
+	if err = probe(f); err == nil {
+		return f, nil
+	}
+
+	loggerOrDefault(opt.Logger).Printf("serve: %s: %v, retrying", name, err)
+	f.Close()
+
+	if d, ok := fs.(deleter); ok {
+		d.delContext(ctx, name)
+	}
+
+	f, err = openContext(ctx, fs, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = probe(f); err != nil {
+		f.Close()
+		return nil, &readError{err}
+	}
+
+	return f, nil
+}
+
+// precompressed lists the encodings of precompressed sibling files by the
+// extension added to the name of the file, in order of preference.
+var precompressed = []struct{ enc, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// openPrecompressed opens the precompressed sibling of the file name in
+// the first encoding the client accepts, setting the Content-Encoding and
+// the Content-Type of the file name. It returns a nil file when the client
+// accepts none of the encodings or the origin has none of the siblings.
+func openPrecompressed(ctx context.Context, w http.ResponseWriter, r *http.Request, fs http.FileSystem, name string, opt *ServeOptions) http.File {
+	// the sibling is served whole, as are all encoded responses, and the
+	// validators of the client are checked against the sibling once it's
+	// open
+	ctx = withConditional(withOriginRange(ctx, "", ""), "", "")
+
+	for _, p := range precompressed {
+		if !acceptsEncoding(r, p.enc) {
+			continue
+		}
+
+		f, err := openFile(ctx, fs, name+p.ext, opt)
+
+		if err != nil {
+			continue
+		}
+
+		ctype := mime.TypeByExtension(path.Ext(name))
+
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+
+		w.Header().Set("Content-Encoding", p.enc)
+		w.Header().Set("Content-Type", ctype)
+		return f
+	}
+
+	return nil
+}
+
+// acceptsHTML reports whether the Accept header of r lists HTML, as the
+// requests of browsers navigating to a page do.
+func acceptsHTML(r *http.Request) bool {
+	for _, v := range r.Header["Accept"] {
+		for _, part := range strings.Split(v, ",") {
+			if i := strings.Index(part, ";"); i >= 0 {
+				part = part[:i]
+			}
+
+			switch strings.ToLower(strings.TrimSpace(part)) {
+			case "text/html", "application/xhtml+xml":
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// notModifiedHeaders are the headers of a 304 response of the origin
+// relayed to the client.
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+// writeNotModified relays a 304 response of the origin with the headers h.
+func writeNotModified(w http.ResponseWriter, h http.Header) {
+	for _, k := range notModifiedHeaders {
+		if v := h.Values(k); len(v) > 0 {
+			w.Header()[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// countingFile records the bytes read from and the first read error of
+// the underlying file.
+type countingFile struct {
+	http.File
+	n   int64
+	err error
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.n += int64(n)
+
+	if err != nil && err != io.EOF && f.err == nil {
+		f.err = err
+	}
+
+	return n, err
+}
+
+// serveError responds with the error page of code, or a plain text error
+// when there's none.
+func serveError(w http.ResponseWriter, r *http.Request, code int, opt *ServeOptions) {
+	page, ok := opt.ErrorPages[code]
+
+	if !ok && code == http.StatusNotFound {
 		http.NotFound(w, r)
 		return
+	} else if !ok {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(page)
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name string, opt *ServeOptions) {
+	ctx := r.Context()
+	encoded := false
+
+	if opt.NoSniff {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+
+	// only headers are sent for HEAD requests, so the content isn't fetched
+	if r.Method == "HEAD" {
+		ctx = withHeadRequest(ctx)
+	}
+
+	if enc := w.Header().Get("Content-Encoding"); enc != "" && enc != "identity" {
+		encoded = true
+	} else if rng := singleRange(r); rng != "" && r.Method != "HEAD" {
+		// uncached files are fetched from the origin by the range only,
+		// or whole when the origin finds the If-Range validator stale
+		ctx = withOriginRange(ctx, rng, r.Header.Get("If-Range"))
+	}
+
+	// a miss of a conditional request asks the origin to answer with 304
+	// instead of the file
+	if r.Method == "GET" || r.Method == "HEAD" {
+		ctx = withConditional(ctx, r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since"))
+	}
+
+	var status *CacheStatus
+
+	if opt.CacheStatusHeader {
+		ctx, status = cacheStatus(ctx)
+	}
+
+	var f http.File
+	var err error
+
+	if opt.Precompressed && !encoded && !strings.HasSuffix(name, "/") {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if f = openPrecompressed(ctx, w, r, fs, name, opt); f != nil {
+			encoded = true
+		}
+	}
+
+	if f == nil {
+		f, err = openFile(ctx, fs, name, opt)
+	}
+
+	// A range the origin sent for an If-Range validator which doesn't
+	// match the file as served, such as an ETag generated by the server,
+	// isn't enough for the whole response. A cached file is served as
+	// cached: a validator matching a stale copy gets a range of the copy,
+	// which is the version the client has the rest of.
+	if ff, ok := f.(*file); ok && ff.partial && !ifRangeMatches(r.Header.Get("If-Range"), ff.fi) {
+		f.Close()
+		f, err = openFile(withOriginRange(ctx, "", ""), fs, name, opt)
+	}
+
+	if status != nil && status.Load() != CacheNone {
+		w.Header().Set("X-Cache", status.Load().String())
+	}
+
+	switch err := err.(type) {
+	case nil:
+	case *notModifiedError:
+		writeNotModified(w, err.header)
+		return
+	case *redirectError:
+		http.Redirect(w, r, err.location, err.status)
+		return
+	case *readError:
+		serveError(w, r, http.StatusInternalServerError, opt)
+		return
+	default:
+		if err == ErrTooManyReaders {
+			serveError(w, r, http.StatusServiceUnavailable, opt)
+		} else if err == ErrLoopDetected {
+			serveError(w, r, http.StatusLoopDetected, opt)
+		} else if errors.Is(err, ErrOriginUnavailable) || err == ErrContentLength || err == ErrFileTooLarge || err == ErrOriginRedirect {
+			serveError(w, r, http.StatusBadGateway, opt)
+		} else if fallback := opt.NotFoundFallback; err == http.ErrMissingFile && fallback != "" && name != fallback && acceptsHTML(r) {
+			// navigations of single-page apps are routed by the app
+			w.Header().Add("Vary", "Accept")
+			serveFile(w, r, fs, fallback, opt)
+		} else {
+			serveError(w, r, http.StatusNotFound, opt)
+		}
+		return
 	}
 
 	defer f.Close()
@@ -31,6 +301,8 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name
 
 		if ok && ff.fi.contentType != "" {
 			w.Header().Set("Content-Type", ff.fi.contentType)
+		} else if opt.NoSniff {
+			w.Header().Set("Content-Type", "application/octet-stream")
 		}
 	}
 
@@ -42,12 +314,264 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name
 		}
 	}
 
-	// serveContent will check modification time
-	http.ServeContent(w, r, d.Name(), d.ModTime(), f)
+	if ff, ok := f.(*file); ok && len(ff.fi.vary) > 0 {
+		w.Header().Add("Vary", strings.Join(ff.fi.vary, ", "))
+	}
+
+	if ff, ok := f.(*file); ok && len(ff.fi.surrogateKeys) > 0 {
+		w.Header().Set("Surrogate-Key", strings.Join(ff.fi.surrogateKeys, " "))
+	}
+
+	if _, haveCacheControl := w.Header()["Cache-Control"]; !haveCacheControl {
+		if ff, ok := f.(*file); ok && ff.fi.cacheControl != "" {
+			w.Header().Set("Cache-Control", ff.fi.cacheControl)
+		} else if opt.MaxAge > 0 {
+			w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(opt.MaxAge/time.Second)))
+		}
+	}
+
+	if opt.Via != "" {
+		via := opt.Via
+
+		if ff, ok := f.(*file); ok && ff.fi.via != "" {
+			via = ff.fi.via + ", " + via
+		}
+
+		w.Header().Set("Via", via)
+	}
+
+	// responses from the cache carry their age, so caches downstream
+	// know how fresh they are
+	if ff, ok := f.(*file); ok && !ff.cached.IsZero() {
+		w.Header().Set("Age", strconv.FormatInt(int64(time.Since(ff.cached)/time.Second), 10))
+	}
+
+	var content http.File = f
+
+	if ff, ok := f.(*file); ok && opt.Compress && !encoded && !ff.partial {
+		minSize := opt.CompressMinSize
+
+		if minSize == 0 {
+			minSize = defaultCompressMinSize
+		}
+
+		if compressible(w.Header().Get("Content-Type")) && d.Size() >= minSize {
+			if !opt.Precompressed {
+				w.Header().Add("Vary", "Accept-Encoding")
+			}
+
+			encs := []string{"gzip", "deflate"}
+
+			if opt.Brotli {
+				encs = []string{"br", "gzip", "deflate"}
+			}
+
+			enc := acceptEncoding(r, encs...)
+
+			// serve the compressed copies held by the cache
+			if buf := ff.encoded(enc); buf != nil {
+				setContentEncoding(w.Header(), enc)
+				content = &file{ReadSeeker: bytes.NewReader(buf), fi: ff.fi}
+				encoded = true
+			} else if enc != "" {
+				quality := opt.BrotliQuality
+
+				if quality == 0 {
+					quality = defaultBrotliQuality
+				}
+
+				cw := newCompressWriter(w, enc, quality)
+				defer cw.Close()
+				w = cw
+				encoded = true
+			}
+		}
+	}
+
+	// ranges of encoded content would be ranges of the encoded bytes, so
+	// respond with the whole content
+	if encoded {
+		r = r.Clone(r.Context())
+		r.Header.Del("Range")
+		w = &noRangesWriter{w}
+	}
+
+	// serveContent will check modification time. A read error after the
+	// headers are written leaves the response short of its Content-Length,
+	// which makes the client discard it and the connection close.
+	cf := &countingFile{File: content}
+	http.ServeContent(w, r, d.Name(), d.ModTime(), cf)
+
+	if cf.err != nil {
+		loggerOrDefault(opt.Logger).Printf("serve: %s: %v after %d bytes", name, cf.err, cf.n)
+	}
+}
+
+// countingWriter adds the bytes written to a response to n.
+type countingWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+// noRangesWriter drops the Accept-Ranges header of a response.
+type noRangesWriter struct {
+	http.ResponseWriter
+}
+
+func (w *noRangesWriter) WriteHeader(code int) {
+	w.Header().Del("Accept-Ranges")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// StatusHeaderHandler returns a handler adding the headers of the status
+// of each response of h, like ServeOptions.StatusHeaders, for handlers
+// around a file server such as rate limiters.
+func StatusHeaderHandler(h http.Handler, headers map[int]http.Header) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&statusHeaderWriter{ResponseWriter: w, headers: headers}, r)
+	})
+}
+
+// statusHeaderWriter adds headers to a response depending on its status.
+type statusHeaderWriter struct {
+	http.ResponseWriter
+	headers     map[int]http.Header
+	wroteHeader bool
+}
+
+func (w *statusHeaderWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	for k, v := range w.headers[code] {
+		w.Header()[k] = v
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusHeaderWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+// ServeOptions configures a handler created by FileServerWithOptions.
+type ServeOptions struct {
+	// Logger logs failed reads.
+	Logger Logger
+
+	// RetryOnReadError reopens a file once when it fails to read before
+	// anything is written to the client.
+	RetryOnReadError bool
+
+	// IndexFiles lists the index file names tried in order for requests
+	// ending in a slash.
+	IndexFiles []string
+
+	// TrackTransfers keeps track of responses in progress. See Transfers.
+	TrackTransfers bool
+
+	// ClientHints partitions cached responses by client hint headers. The
+	// first rule matching the request path applies.
+	ClientHints []ClientHintRule
+
+	// ForwardHeaders lists request headers sent along on origin requests.
+	// Files are cached separately for each combination of the header
+	// values, so forwarding headers with many values, such as
+	// Authorization, splits the cache accordingly. Files the origin varies
+	// by request headers which aren't forwarded aren't cached.
+	ForwardHeaders []string
+
+	// StatusHeaders maps response status codes to headers set on responses
+	// with the status. They cover responses of the file server only; see
+	// StatusHeaderHandler for the responses of handlers around it.
+	StatusHeaders map[int]http.Header
+
+	// New transfers of LargeTransferSize bytes or more are rejected with
+	// HTTP 503 while MaxTransfers of them are in progress or while all
+	// responses are written at MaxBandwidth bytes per second or more. Zero
+	// MaxTransfers and MaxBandwidth mean no limit.
+	LargeTransferSize int64
+	MaxTransfers      int
+	MaxBandwidth      int64
+
+	// MaxAge is sent as the max-age of a Cache-Control header on
+	// responses for files without a Cache-Control header of the origin.
+	// Zero means no Cache-Control header is sent.
+	MaxAge time.Duration
+
+	// Compress compresses responses of text, JavaScript, JSON, XML and SVG
+	// files of at least CompressMinSize bytes with gzip or deflate when
+	// the client accepts it. Zero CompressMinSize means 1024 bytes.
+	Compress        bool
+	CompressMinSize int64
+
+	// Brotli compresses with brotli as well when Compress is set, for
+	// clients preferring it or accepting it as much as gzip. BrotliQuality
+	// ranges from 0, fastest, to 11, smallest. Zero means 4.
+	Brotli        bool
+	BrotliQuality int
+
+	// NotFoundFallback is the name of the file served, such as
+	// "/index.html", for files missing on the origin when the request
+	// accepts HTML, so single-page apps route their own paths. Requests
+	// of other files, such as scripts and images, still get HTTP 404.
+	NotFoundFallback string
+
+	// ErrorPages maps status codes, such as 404 for missing files and 502
+	// for an unavailable origin, to HTML pages sent with the status in
+	// place of the plain text error.
+	ErrorPages map[int][]byte
+
+	// NoSniff sends X-Content-Type-Options: nosniff on every response and
+	// serves files without a content type as application/octet-stream
+	// instead of guessing the type from their content.
+	NoSniff bool
+
+	// Precompressed serves the sibling name.br or name.gz of a file from
+	// the filesystem, when the client accepts brotli or gzip and the
+	// sibling exists, with the Content-Encoding of the sibling and the
+	// Content-Type of the file. Files without siblings are served as is.
+	// Each sibling is looked up on every request for an uncached file.
+	Precompressed bool
+
+	// CacheStatusHeader sets the X-Cache header of responses for files
+	// opened from a cache to HIT or MISS.
+	CacheStatusHeader bool
+
+	// Via is appended to the Via header of the origin response, such as
+	// "1.1 filesrv". Empty means no Via header is sent.
+	Via string
+
+	// InstanceID identifies the server in the CDN-Loop header sent on
+	// origin requests. Requests which already passed the server are
+	// refused with HTTP 508. Empty disables loop detection.
+	InstanceID string
+
+	// Placeholders serves placeholders for uncached files while they're
+	// fetched. The first rule matching the request path applies.
+	Placeholders []PlaceholderRule
 }
 
 type fileHandler struct {
-	root http.FileSystem
+	root      http.FileSystem
+	opt       ServeOptions
+	transfers *transferTracker
+	load      *loadMeter
+	holders   *placeholders
+	served    int64 // response body bytes written
 }
 
 // FileServer returns a handler that serves HTTP requests
@@ -58,10 +582,73 @@ type fileHandler struct {
 //
 //     http.Handle("/", http.FileServer(http.Dir("/tmp")))
 func FileServer(root http.FileSystem) http.Handler {
-	return &fileHandler{root}
+	return &fileHandler{root: root}
+}
+
+// FileServerWithOptions returns a handler like FileServer configured by
+// opt.
+func FileServerWithOptions(root http.FileSystem, opt ServeOptions) http.Handler {
+	if len(opt.IndexFiles) > 0 {
+		root = newIndexFileSystem(root, opt.IndexFiles)
+	}
+
+	h := &fileHandler{root: root, opt: opt, transfers: newTransferTracker()}
+
+	if opt.MaxTransfers > 0 || opt.MaxBandwidth > 0 {
+		h.load = newLoadMeter(&opt)
+	}
+
+	if len(opt.Placeholders) > 0 {
+		h.holders = newPlaceholders(opt.Placeholders, loggerOrDefault(opt.Logger))
+	}
+
+	return h
+}
+
+// ServedBytes returns the number of response body bytes written by the
+// handler.
+func (f *fileHandler) ServedBytes() int64 {
+	return atomic.LoadInt64(&f.served)
+}
+
+// Transfers returns the responses in progress when the handler tracks
+// transfers.
+func (f *fileHandler) Transfers() []Transfer {
+	if f.transfers == nil {
+		return nil
+	}
+
+	return f.transfers.list()
 }
 
 func (f *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w = &countingWriter{ResponseWriter: w, n: &f.served}
+
+	if f.opt.TrackTransfers {
+		tw := f.transfers.add(w, r)
+		defer f.transfers.del(tw)
+		w = tw
+	}
+
+	if f.load != nil {
+		lw := &loadWriter{ResponseWriter: w, m: f.load}
+		defer lw.done()
+		w = lw
+	}
+
+	if len(f.opt.StatusHeaders) > 0 {
+		w = &statusHeaderWriter{ResponseWriter: w, headers: f.opt.StatusHeaders}
+	}
+
+	if id := f.opt.InstanceID; id != "" {
+		if loopDetected(r, id) {
+			http.Error(w, "Loop Detected", http.StatusLoopDetected)
+			return
+		}
+
+		r = r.WithContext(withLoop(r.Context(), r, id))
+	}
+
 	upath := r.URL.Path
 
 	if !strings.HasPrefix(upath, "/") {
@@ -69,9 +656,43 @@ func (f *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.URL.Path = upath
 	}
 
+	r = r.WithContext(withRequestHeader(r.Context(), r.Header))
+	h, vary := clientHints(f.opt.ClientHints, r)
+
+	if len(f.opt.ForwardHeaders) > 0 {
+		if h == nil {
+			h = make(http.Header)
+		}
+
+		for _, name := range f.opt.ForwardHeaders {
+			name = http.CanonicalHeaderKey(name)
+
+			if v, ok := r.Header[name]; ok {
+				h[name] = v
+			}
+		}
+
+		vary = append(append([]string(nil), vary...), f.opt.ForwardHeaders...)
+	}
+
+	if vary != nil {
+		w.Header().Add("Vary", strings.Join(vary, ", "))
+		r = r.WithContext(withForwarded(withOriginHeader(r.Context(), h), vary))
+	}
+
+	name := path.Clean(upath)
+
+	if len(f.opt.IndexFiles) > 0 && strings.HasSuffix(upath, "/") && name != "/" {
+		name += "/"
+	}
+
 	if q := r.URL.RawQuery; q != "" {
-		upath += "?" + q
+		name += "?" + q
+	}
+
+	if f.holders != nil && f.holders.serve(w, r, f.root, name, &f.opt) {
+		return
 	}
 
-	serveFile(w, r, f.root, path.Clean(upath))
+	serveFile(w, r, f.root, name, &f.opt)
 }
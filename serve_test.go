@@ -1,12 +1,23 @@
 package filesrv
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/simonz05/util/assert"
 	"github.com/simonz05/util/httputil"
 )
@@ -15,6 +26,7 @@ func TestServeConcurrent(t *testing.T) {
 	ast := assert.NewAssertWithName(t, "TestServeConcurrent")
 	fs := newFakeFs()
 	cache := NewCache(fs, 2, 64)
+	defer cache.Close()
 	files := []string{"file1", "file2", "file3"}
 	wg := sync.WaitGroup{}
 
@@ -72,3 +84,1514 @@ func getFile(t *testing.T, uri string) (string, error) {
 
 	return string(body), nil
 }
+
+// errReader reads n bytes from its content and then fails.
+type errReader struct {
+	*bytes.Reader
+	n int64
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	off, _ := r.Seek(0, io.SeekCurrent)
+
+	if off >= r.n {
+		return 0, errors.New("read error")
+	}
+
+	if rem := r.n - off; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+
+	return r.Reader.Read(p)
+}
+
+// flakyFs returns files failing to read for the first bad opens.
+type flakyFs struct {
+	content string
+	after   int64
+	bad     int
+	opens   int
+	dels    int
+}
+
+func (fs *flakyFs) Open(name string) (http.File, error) {
+	f := newFile(fs.content)
+	fs.opens++
+
+	if fs.opens <= fs.bad {
+		f.ReadSeeker = &errReader{bytes.NewReader(f.buf), fs.after}
+	}
+
+	return f, nil
+}
+
+func (fs *flakyFs) delContext(ctx context.Context, name string) bool {
+	fs.dels++
+	return true
+}
+
+func TestServeRetryOnReadError(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeRetryOnReadError")
+	tests := []struct {
+		bad    int
+		after  int64
+		status int
+		opens  int
+		dels   int
+	}{
+		{0, 0, http.StatusOK, 1, 0},
+		{1, 0, http.StatusOK, 2, 1},
+		{2, 0, http.StatusInternalServerError, 2, 1},
+	}
+
+	for _, tt := range tests {
+		fs := &flakyFs{content: "content", bad: tt.bad, after: tt.after}
+		server := httptest.NewServer(FileServerWithOptions(fs, ServeOptions{RetryOnReadError: true}))
+		res, err := http.Get(server.URL + "/file")
+		ast.Nil(err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		server.Close()
+
+		ast.Equal(tt.status, res.StatusCode)
+		ast.Equal(tt.opens, fs.opens)
+		ast.Equal(tt.dels, fs.dels)
+
+		if tt.status == http.StatusOK {
+			ast.Equal("content", string(body))
+		}
+	}
+}
+
+func TestServeReadErrorAfterWrite(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeReadErrorAfterWrite")
+	fs := &flakyFs{content: "content", bad: 2, after: 3}
+	server := httptest.NewServer(FileServerWithOptions(fs, ServeOptions{RetryOnReadError: true}))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/file")
+	ast.Nil(err)
+	defer res.Body.Close()
+	ast.Equal(http.StatusOK, res.StatusCode)
+	ast.Equal(int64(len("content")), res.ContentLength)
+
+	// the response is cut short of its Content-Length
+	body, err := ioutil.ReadAll(res.Body)
+	ast.NotNil(err)
+	ast.Equal("con", string(body))
+	ast.Equal(1, fs.opens)
+}
+
+func TestServeIndexFiles(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeIndexFiles")
+	fs := newFakeFs()
+	fs.files["/docs/index.htm"] = newFile("docs index")
+	fs.files["/default.html"] = newFile("root index")
+	opt := ServeOptions{IndexFiles: []string{"index.html", "index.htm", "default.html"}}
+	server := httptest.NewServer(FileServerWithOptions(fs, opt))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		content, err := getFile(t, server.URL+"/docs/")
+		ast.Nil(err)
+		ast.Equal("docs index", content)
+	}
+
+	// the matching candidate is remembered
+	ast.Equal(1+2, fs.openCnt)
+
+	content, err := getFile(t, server.URL+"/")
+	ast.Nil(err)
+	ast.Equal("root index", content)
+
+	res, err := http.Get(server.URL + "/empty/")
+	ast.Nil(err)
+	res.Body.Close()
+	ast.Equal(http.StatusNotFound, res.StatusCode)
+}
+
+func TestServeIndexFilesOrigin(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeIndexFilesOrigin")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/docs/index.html" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write([]byte("<html>docs</html>"))
+	}))
+	defer origin.Close()
+
+	for _, index := range [][]string{nil, {"index.html"}} {
+		fs := NewCache(New(origin.URL), 10, 1024)
+		defer fs.Close()
+		server := httptest.NewServer(FileServerWithOptions(fs, ServeOptions{IndexFiles: index}))
+		res, err := http.Get(server.URL + "/docs/")
+		ast.Nil(err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		server.Close()
+
+		if index == nil {
+			ast.Equal(http.StatusNotFound, res.StatusCode)
+		} else {
+			ast.Equal(http.StatusOK, res.StatusCode)
+			ast.Equal("<html>docs</html>", string(body))
+			ast.Equal("text/html; charset=utf-8", res.Header.Get("Content-Type"))
+		}
+	}
+}
+
+// blockingReader blocks reads after the first until release is closed.
+type blockingReader struct {
+	*bytes.Reader
+	release chan bool
+	reads   int
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	if r.reads++; r.reads > 1 {
+		<-r.release
+	}
+
+	if len(p) > 4 {
+		p = p[:4]
+	}
+
+	return r.Reader.Read(p)
+}
+
+func TestServeTransfers(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeTransfers")
+	fs := newFakeFs()
+	f := newFile("large content")
+	release := make(chan bool)
+	f.ReadSeeker = &blockingReader{Reader: bytes.NewReader(f.buf), release: release}
+	fs.files["/large"] = f
+	h := FileServerWithOptions(fs, ServeOptions{TrackTransfers: true}).(*fileHandler)
+	server := httptest.NewServer(h)
+	defer server.Close()
+	done := make(chan bool)
+
+	go func() {
+		content, _ := getFile(t, server.URL+"/large")
+		ast.Equal("large content", content)
+		done <- true
+	}()
+
+	var transfers []Transfer
+
+	for i := 0; i < 100; i++ {
+		if transfers = h.Transfers(); len(transfers) == 1 && transfers[0].Sent > 0 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ast.Equal(1, len(transfers))
+	ast.Equal("/large", transfers[0].Path)
+	ast.Equal(int64(4), transfers[0].Sent)
+	ast.Equal(int64(len("large content")), transfers[0].Size)
+
+	close(release)
+	<-done
+
+	for i := 0; i < 100 && len(h.Transfers()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ast.Equal(0, len(h.Transfers()))
+}
+
+// hintFs serves files whose content is the DPR origin header.
+type hintFs struct {
+	dprs []string
+	mu   sync.Mutex
+}
+
+func (fs *hintFs) Open(name string) (http.File, error) {
+	return fs.OpenContext(context.Background(), name)
+}
+
+func (fs *hintFs) OpenContext(ctx context.Context, name string) (http.File, error) {
+	dpr := originHeader(ctx).Get("DPR")
+	fs.mu.Lock()
+	fs.dprs = append(fs.dprs, dpr)
+	fs.mu.Unlock()
+	return newFile("dpr " + dpr), nil
+}
+
+func TestServeClientHints(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeClientHints")
+	fs := &hintFs{}
+	cache := NewCache(fs, 10, 1024)
+	defer cache.Close()
+	opt := ServeOptions{
+		ClientHints: []ClientHintRule{{Pattern: "/img/*", Headers: []string{"DPR"}}},
+	}
+	server := httptest.NewServer(FileServerWithOptions(cache, opt))
+	defer server.Close()
+
+	tests := []struct {
+		path    string
+		dpr     string
+		content string
+	}{
+		{"/img/a.png", "1.8", "dpr 2"},
+		{"/img/a.png", "2", "dpr 2"},
+		{"/img/a.png", "1", "dpr 1"},
+		{"/img/a.png", "0.5", "dpr 1"},
+		{"/img/a.png", "", "dpr "},
+		{"/img/a.png", "4", "dpr 3"},
+		{"/other.png", "2", "dpr "},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", server.URL+tt.path, nil)
+		req.Header.Set("DPR", tt.dpr)
+		res, err := http.DefaultClient.Do(req)
+		ast.Nil(err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		ast.Equal(tt.content, string(body))
+	}
+
+	ast.Equal([]string{"2", "1", "", "3", ""}, fs.dprs)
+	ast.Equal(5, len(cache.(*memoryCacheFilesystem).cache))
+}
+
+func TestBucketHint(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestBucketHint")
+	tests := []struct {
+		name string
+		in   string
+		out  string
+		ok   bool
+	}{
+		{"Dpr", "1", "1", true},
+		{"Dpr", "1.2", "1.5", true},
+		{"Dpr", "2.5", "3", true},
+		{"Dpr", "x", "", false},
+		{"Viewport-Width", "500", "640", true},
+		{"Viewport-Width", "4000", "2560", true},
+		{"Save-Data", "on", "on", true},
+	}
+
+	for _, tt := range tests {
+		out, ok := bucketHint(tt.name, tt.in)
+		ast.Equal(tt.out, out)
+		ast.Equal(tt.ok, ok)
+	}
+}
+
+func TestServeRangeEncoded(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeRangeEncoded")
+	fs := newFakeFs()
+	fs.files["/file"] = newFile("0123456789")
+	fileServer := FileServer(fs)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("enc") != "" {
+			w.Header().Set("Content-Encoding", r.URL.Query().Get("enc"))
+		}
+
+		r.URL.RawQuery = ""
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		enc    string
+		status int
+		ranges string
+		body   string
+	}{
+		{"", http.StatusPartialContent, "bytes", "234"},
+		{"identity", http.StatusPartialContent, "bytes", "234"},
+		{"gzip", http.StatusOK, "", "0123456789"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", server.URL+"/file?enc="+tt.enc, nil)
+		req.Header.Set("Range", "bytes=2-4")
+		req.Header.Set("Accept-Encoding", "identity")
+		res, err := http.DefaultClient.Do(req)
+		ast.Nil(err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		ast.Equal(tt.status, res.StatusCode)
+		ast.Equal(tt.ranges, res.Header.Get("Accept-Ranges"))
+		ast.Equal(tt.body, string(body))
+	}
+}
+
+func TestServeStatusHeaders(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeStatusHeaders")
+	fs := newFakeFs()
+	fs.files["/file"] = newFile("content")
+	opt := ServeOptions{
+		StatusHeaders: map[int]http.Header{
+			http.StatusNotFound: {"Cache-Control": {"max-age=60"}},
+		},
+	}
+	server := httptest.NewServer(FileServerWithOptions(fs, opt))
+	defer server.Close()
+
+	tests := []struct {
+		path         string
+		status       int
+		cacheControl string
+	}{
+		{"/file", http.StatusOK, ""},
+		{"/missing", http.StatusNotFound, "max-age=60"},
+	}
+
+	for _, tt := range tests {
+		res, err := http.Get(server.URL + tt.path)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal(tt.status, res.StatusCode)
+		ast.Equal(tt.cacheControl, res.Header.Get("Cache-Control"))
+	}
+}
+
+func TestServeLoadLimit(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeLoadLimit")
+	fs := newFakeFs()
+	f := newFile("large content")
+	release := make(chan bool)
+	f.ReadSeeker = &blockingReader{Reader: bytes.NewReader(f.buf), release: release}
+	fs.files["/large"] = f
+	fs.files["/other"] = newFile("other content")
+	fs.files["/small"] = newFile("small")
+	opt := ServeOptions{LargeTransferSize: 8, MaxTransfers: 1, MaxBandwidth: 1 << 20}
+	h := FileServerWithOptions(fs, opt).(*fileHandler)
+	server := httptest.NewServer(h)
+	defer server.Close()
+	done := make(chan bool)
+
+	go func() {
+		content, _ := getFile(t, server.URL+"/large")
+		ast.Equal("large content", content)
+		done <- true
+	}()
+
+	for i := 0; i < 100 && atomic.LoadInt64(&h.load.active) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/other", http.StatusServiceUnavailable},
+		{"/small", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		res, err := http.Get(server.URL + tt.path)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal(tt.status, res.StatusCode)
+	}
+
+	close(release)
+	<-done
+
+	for i := 0; i < 100 && atomic.LoadInt64(&h.load.active) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res, err := http.Get(server.URL + "/other")
+	ast.Nil(err)
+	res.Body.Close()
+	ast.Equal(http.StatusOK, res.StatusCode)
+
+	// Simulate the aggregate bandwidth at the ceiling.
+	h.load.add(1 << 20)
+	res, err = http.Get(server.URL + "/other")
+	ast.Nil(err)
+	res.Body.Close()
+	ast.Equal(http.StatusServiceUnavailable, res.StatusCode)
+	ast.Equal("1", res.Header.Get("Retry-After"))
+}
+
+func TestServePlaceholders(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServePlaceholders")
+	fs := newFakeFs()
+	fs.files["/img/large.jpg"] = newFile("large image")
+	fs.files["/img/small.jpg"] = newFile("small")
+	fs.files["/img/large.txt"] = newFile("large text")
+	fs.files["/placeholder"] = newFile("placeholder")
+	cache := NewCache(fs, 10, 1<<20)
+	defer cache.Close()
+	opt := ServeOptions{
+		Placeholders: []PlaceholderRule{{Prefix: "/img/", Placeholder: "/placeholder", MinSize: 10}},
+	}
+	server := httptest.NewServer(FileServerWithOptions(cache, opt))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/img/large.jpg")
+	ast.Nil(err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	ast.Equal("placeholder", string(body))
+	ast.Equal("no-store", res.Header.Get("Cache-Control"))
+
+	mc := cache.(*memoryCacheFilesystem)
+
+	for i := 0; i < 100 && !mc.cached(context.Background(), "/img/large.jpg"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	content, _ := getFile(t, server.URL+"/img/large.jpg")
+	ast.Equal("large image", content)
+
+	// small images, other files and missing files are served as usual
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/img/small.jpg", http.StatusOK, "small"},
+		{"/img/large.txt", http.StatusOK, "large text"},
+		{"/img/missing.jpg", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		res, err := http.Get(server.URL + tt.path)
+		ast.Nil(err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		ast.Equal(tt.status, res.StatusCode)
+
+		if tt.status == http.StatusOK {
+			ast.Equal(tt.body, string(body))
+		}
+	}
+}
+
+func TestServeRangeOrigin(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeRangeOrigin")
+	content := strings.Repeat("0123456789", 100)
+	var ranges []string
+	var mu sync.Mutex
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	defer origin.Close()
+	cache := NewCache(New(origin.URL), 10, 1<<20)
+	defer cache.Close()
+	server := httptest.NewServer(FileServerWithOptions(cache, ServeOptions{RetryOnReadError: true}))
+	defer server.Close()
+
+	tests := []struct {
+		rng          string
+		originRange  string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"bytes=10-19", "bytes=10-19", http.StatusPartialContent, "bytes 10-19/1000", content[10:20]},
+		{"bytes=-5", "bytes=-5", http.StatusPartialContent, "bytes 995-999/1000", content[995:]},
+		{"bytes=2000-", "", http.StatusRequestedRangeNotSatisfiable, "bytes */1000", ""},
+		{"bytes=0-1,5-6", "", http.StatusPartialContent, "", ""},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", server.URL+"/file", nil)
+		req.Header.Set("Range", tt.rng)
+		res, err := http.DefaultClient.Do(req)
+		ast.Nil(err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		ast.Equal(tt.status, res.StatusCode)
+		ast.Equal(tt.contentRange, res.Header.Get("Content-Range"))
+		mu.Lock()
+		ast.Equal(tt.originRange, ranges[len(ranges)-1])
+		mu.Unlock()
+
+		if tt.status == http.StatusPartialContent {
+			ast.Equal("bytes", res.Header.Get("Accept-Ranges"))
+		}
+
+		if tt.body != "" {
+			ast.Equal(tt.body, string(body))
+		}
+
+		// the whole file is cached by the full fetches only
+		cache.(*memoryCacheFilesystem).del("/file")
+	}
+}
+
+func TestServeVia(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeVia")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/proxied" {
+			w.Header().Set("Via", "1.1 origin-cache")
+		}
+
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+	server := httptest.NewServer(FileServerWithOptions(New(origin.URL), ServeOptions{Via: "1.1 filesrv"}))
+	defer server.Close()
+
+	tests := []struct {
+		path string
+		via  string
+	}{
+		{"/file", "1.1 filesrv"},
+		{"/proxied", "1.1 origin-cache, 1.1 filesrv"},
+	}
+
+	for _, tt := range tests {
+		res, err := http.Get(server.URL + tt.path)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal(tt.via, res.Header.Get("Via"))
+	}
+}
+
+func TestServeRedirects(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeRedirects")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusFound)
+		case "/away":
+			http.Redirect(w, r, "http://example.com/file", http.StatusMovedPermanently)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusTemporaryRedirect)
+		case "/new":
+			w.Write([]byte("new content"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	tests := []struct {
+		policy   RedirectPolicy
+		path     string
+		status   int
+		location string
+		body     string
+	}{
+		{RedirectFollow, "/old", http.StatusOK, "", "new content"},
+		{RedirectFollow, "/loop", http.StatusBadGateway, "", ""},
+		{RedirectReject, "/old", http.StatusBadGateway, "", ""},
+		{RedirectReject, "/new", http.StatusOK, "", "new content"},
+		{RedirectRelay, "/old", http.StatusFound, "/new", ""},
+		{RedirectRelay, "/away", http.StatusMovedPermanently, "http://example.com/file", ""},
+	}
+
+	for _, tt := range tests {
+		fs := NewWithOptions(origin.URL, RemoteOptions{Redirects: tt.policy, MaxRedirects: 3})
+		server := httptest.NewServer(FileServer(fs))
+		res, err := client.Get(server.URL + tt.path)
+		ast.Nil(err)
+		b, err := ioutil.ReadAll(res.Body)
+		ast.Nil(err)
+		res.Body.Close()
+		server.Close()
+
+		ast.Equal(tt.status, res.StatusCode)
+		ast.Equal(tt.location, res.Header.Get("Location"))
+
+		if tt.status == http.StatusOK {
+			ast.Equal(tt.body, string(b))
+		}
+	}
+}
+
+func TestServeLoopDetected(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeLoopDetected")
+	var h http.Handler
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		h.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	// the server is its own origin
+	h = FileServerWithOptions(New(server.URL), ServeOptions{InstanceID: "a"})
+
+	res, err := http.Get(server.URL + "/file")
+	ast.Nil(err)
+	res.Body.Close()
+	ast.Equal(http.StatusLoopDetected, res.StatusCode)
+	ast.Equal(int32(2), atomic.LoadInt32(&hits))
+
+	req, _ := http.NewRequest("GET", server.URL+"/file", nil)
+	req.Header.Set("CDN-Loop", "b, a; v=1")
+	res, err = http.DefaultClient.Do(req)
+	ast.Nil(err)
+	res.Body.Close()
+	ast.Equal(http.StatusLoopDetected, res.StatusCode)
+	ast.Equal(int32(3), atomic.LoadInt32(&hits))
+}
+
+func TestServeCacheControl(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeCacheControl")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/origin" {
+			w.Header().Set("Cache-Control", "private, max-age=10")
+		}
+
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		maxAge       time.Duration
+		path         string
+		cacheControl string
+	}{
+		{0, "/file", ""},
+		{time.Hour, "/file", "public, max-age=3600"},
+		{time.Hour, "/origin", "private, max-age=10"},
+		{0, "/origin", "private, max-age=10"},
+	}
+
+	for _, tt := range tests {
+		server := httptest.NewServer(FileServerWithOptions(New(origin.URL), ServeOptions{MaxAge: tt.maxAge}))
+		res, err := http.Get(server.URL + tt.path)
+		ast.Nil(err)
+		res.Body.Close()
+		server.Close()
+		ast.Equal(tt.cacheControl, res.Header.Get("Cache-Control"))
+	}
+}
+
+func TestServeCompress(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeCompress")
+	content := strings.Repeat("compressible content ", 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("small"))
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(content))
+		default:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(content))
+		}
+	}))
+	defer origin.Close()
+
+	server := httptest.NewServer(FileServerWithOptions(New(origin.URL), ServeOptions{Compress: true}))
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		encoding       string
+	}{
+		{"/file.txt", "gzip", "gzip"},
+		{"/file.txt", "deflate, gzip;q=0.5", "deflate"},
+		{"/file.txt", "gzip;q=0, deflate", "deflate"},
+		{"/file.txt", "br", ""},
+		{"/file.txt", "", ""},
+		{"/small.txt", "gzip", ""},
+		{"/image.png", "gzip", ""},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", server.URL+tt.path, nil)
+
+		if tt.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+
+		res, err := client.Do(req)
+		ast.Nil(err)
+		ast.Equal(tt.encoding, res.Header.Get("Content-Encoding"))
+
+		var body io.Reader = res.Body
+
+		switch tt.encoding {
+		case "gzip":
+			ast.Equal(false, res.Header.Get("Content-Length") == strconv.Itoa(len(content)))
+			body, err = gzip.NewReader(res.Body)
+			ast.Nil(err)
+		case "deflate":
+			body = flate.NewReader(res.Body)
+		}
+
+		b, err := ioutil.ReadAll(body)
+		ast.Nil(err)
+		res.Body.Close()
+
+		if tt.path == "/small.txt" {
+			ast.Equal("small", string(b))
+		} else {
+			ast.Equal(content, string(b))
+		}
+
+		if tt.encoding != "" {
+			ast.Equal(true, strings.HasSuffix(res.Header.Get("ETag"), "-"+tt.encoding+`"`))
+		}
+	}
+
+	// responses of compressible files vary by encoding
+	req, _ := http.NewRequest("GET", server.URL+"/file.txt", nil)
+	res, err := client.Do(req)
+	ast.Nil(err)
+	res.Body.Close()
+	ast.Equal("Accept-Encoding", res.Header.Get("Vary"))
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestAcceptEncoding")
+	tests := []struct {
+		header string
+		enc    string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.2, deflate;q=0.8", "deflate"},
+		{"gzip;q=0", ""},
+		{"br, identity", ""},
+	}
+
+	for _, tt := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+
+		if tt.header != "" {
+			r.Header.Set("Accept-Encoding", tt.header)
+		}
+
+		ast.Equal(tt.enc, acceptEncoding(r, "gzip", "deflate"))
+	}
+
+	// brotli is preferred over gzip unless the client prefers gzip
+	brotliTests := []struct {
+		header string
+		enc    string
+	}{
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"br", "br"},
+		{"identity", ""},
+	}
+
+	for _, tt := range brotliTests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		ast.Equal(tt.enc, acceptEncoding(r, "br", "gzip", "deflate"))
+	}
+}
+
+func TestServeCachedGzip(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeCachedGzip")
+	content := strings.Repeat("compressible content ", 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+	}))
+	defer origin.Close()
+
+	cache := NewCacheWithOptions(New(origin.URL), CacheOptions{MaxItems: 10, GzipMaxSize: 1 << 20})
+	defer cache.Close()
+	server := httptest.NewServer(FileServerWithOptions(cache, ServeOptions{Compress: true}))
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", server.URL+"/file.txt", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := client.Do(req)
+		ast.Nil(err)
+		ast.Equal("gzip", res.Header.Get("Content-Encoding"))
+		ast.Equal(true, res.ContentLength > 0 && res.ContentLength < int64(len(content)))
+
+		gz, err := gzip.NewReader(res.Body)
+		ast.Nil(err)
+		b, err := ioutil.ReadAll(gz)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal(content, string(b))
+	}
+}
+
+func TestServePrecompressed(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServePrecompressed")
+	content := "console.log('app');"
+	gzipped := gzipBytes([]byte(content))
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app.js", "/plain.js":
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Write([]byte(content))
+		case "/app.js.gz":
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Write(gzipped)
+		case "/app.js.br":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("brotli"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	server := httptest.NewServer(FileServerWithOptions(New(origin.URL), ServeOptions{Precompressed: true}))
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{"/app.js", "gzip", "gzip", string(gzipped)},
+		{"/app.js", "gzip, br", "br", "brotli"},
+		{"/app.js", "br;q=0, gzip", "gzip", string(gzipped)},
+		{"/app.js", "deflate", "", content},
+		{"/app.js", "", "", content},
+		{"/plain.js", "gzip, br", "", content},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", server.URL+tt.path, nil)
+		req.Header.Set("Range", "bytes=0-3")
+
+		if tt.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+
+		res, err := client.Do(req)
+		ast.Nil(err)
+		b, err := ioutil.ReadAll(res.Body)
+		ast.Nil(err)
+		res.Body.Close()
+
+		ast.Equal(tt.encoding, res.Header.Get("Content-Encoding"))
+		ast.Equal("Accept-Encoding", res.Header.Get("Vary"))
+
+		// the type is of the file, not the sibling
+		ast.Equal(true, strings.Contains(res.Header.Get("Content-Type"), "javascript"))
+
+		if tt.encoding != "" {
+			ast.Equal(http.StatusOK, res.StatusCode)
+			ast.Equal(tt.body, string(b))
+		} else {
+			ast.Equal(http.StatusPartialContent, res.StatusCode)
+			ast.Equal(tt.body[:4], string(b))
+		}
+	}
+}
+
+func TestServeBrotli(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeBrotli")
+	content := strings.Repeat("compressible content ", 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+	}))
+	defer origin.Close()
+
+	cache := NewCacheWithOptions(New(origin.URL), CacheOptions{MaxItems: 10, BrotliMaxSize: 1 << 20, BrotliQuality: 11})
+	defer cache.Close()
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	tests := []struct {
+		fs             http.FileSystem
+		acceptEncoding string
+		encoding       string
+	}{
+		{New(origin.URL), "gzip, deflate, br", "br"},
+		{New(origin.URL), "br;q=0.5, gzip", "gzip"},
+		{New(origin.URL), "identity", ""},
+		{cache, "br", "br"},
+		{cache, "br", "br"},
+	}
+
+	for _, tt := range tests {
+		server := httptest.NewServer(FileServerWithOptions(tt.fs, ServeOptions{Compress: true, Brotli: true, BrotliQuality: 1}))
+		req, _ := http.NewRequest("GET", server.URL+"/file.txt", nil)
+		req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		res, err := client.Do(req)
+		ast.Nil(err)
+		ast.Equal(tt.encoding, res.Header.Get("Content-Encoding"))
+
+		var body io.Reader = res.Body
+
+		switch tt.encoding {
+		case "br":
+			body = brotli.NewReader(res.Body)
+		case "gzip":
+			body, err = gzip.NewReader(res.Body)
+			ast.Nil(err)
+		}
+
+		b, err := ioutil.ReadAll(body)
+		ast.Nil(err)
+		res.Body.Close()
+		server.Close()
+		ast.Equal(content, string(b))
+
+		// the cache serves its copy compressed at its own quality
+		if tt.fs == cache {
+			ast.Equal(true, res.ContentLength > 0 && res.ContentLength < int64(len(content)))
+		}
+	}
+}
+
+func TestServeOriginUnavailable(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeOriginUnavailable")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte("content"))
+		}
+	}))
+	defer origin.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		origin string
+		path   string
+		status int
+	}{
+		{origin.URL, "/file", http.StatusOK},
+		{origin.URL, "/missing", http.StatusNotFound},
+		{origin.URL, "/error", http.StatusBadGateway},
+		{down.URL, "/file", http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		cache := NewCache(New(tt.origin), 10, 1024)
+		server := httptest.NewServer(FileServer(cache))
+		res, err := http.Get(server.URL + tt.path)
+		ast.Nil(err)
+		res.Body.Close()
+		server.Close()
+		cache.Close()
+		ast.Equal(tt.status, res.StatusCode)
+	}
+}
+
+func TestServeCacheStatusHeader(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeCacheStatusHeader")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+
+	cache, uncounted := NewCache(New(origin.URL), 10, 1024), NewCache(New(origin.URL), 10, 1024)
+	defer cache.Close()
+	defer uncounted.Close()
+
+	tests := []struct {
+		fs      http.FileSystem
+		enabled bool
+		want    []string
+	}{
+		{cache, true, []string{"MISS", "HIT"}},
+		{uncounted, false, []string{"", ""}},
+		{New(origin.URL), true, []string{"", ""}},
+	}
+
+	for _, tt := range tests {
+		server := httptest.NewServer(FileServerWithOptions(tt.fs, ServeOptions{CacheStatusHeader: tt.enabled}))
+
+		for _, want := range tt.want {
+			res, err := http.Get(server.URL + "/file")
+			ast.Nil(err)
+			res.Body.Close()
+			ast.Equal(want, res.Header.Get("X-Cache"))
+		}
+
+		server.Close()
+	}
+}
+
+func TestServeAge(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeAge")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+
+	cache := NewCache(New(origin.URL), 10, 1024)
+	defer cache.Close()
+	server := httptest.NewServer(FileServer(cache))
+	defer server.Close()
+
+	age := func(method string) (string, bool) {
+		req, _ := http.NewRequest(method, server.URL+"/file", nil)
+		res, err := http.DefaultClient.Do(req)
+		ast.Nil(err)
+		res.Body.Close()
+		_, ok := res.Header["Age"]
+		return res.Header.Get("Age"), ok
+	}
+
+	// the miss is served from the origin
+	_, ok := age("GET")
+	ast.Equal(false, ok)
+
+	v, _ := age("GET")
+	ast.Equal("0", v)
+
+	time.Sleep(1100 * time.Millisecond)
+	v, _ = age("GET")
+	ast.Equal("1", v)
+
+	v, _ = age("HEAD")
+	ast.Equal("1", v)
+}
+
+func TestServeConditional(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeConditional")
+	var fetches, notModified int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=60")
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		atomic.AddInt32(&fetches, 1)
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		warm        bool   // the file is cached first
+		ifNoneMatch string // of the client
+		status      int
+		fetches     int32 // of the file after the conditional request
+		notModified int32 // answered by the origin
+	}{
+		{true, `"v1"`, http.StatusNotModified, 0, 0},
+		{false, `"v1"`, http.StatusNotModified, 1, 1},
+		{false, `"v0"`, http.StatusOK, 1, 0},
+	}
+
+	for _, tt := range tests {
+		cache := NewCache(New(origin.URL), 10, 1024)
+		server := httptest.NewServer(FileServer(cache))
+
+		if tt.warm {
+			res, err := http.Get(server.URL + "/file")
+			ast.Nil(err)
+			res.Body.Close()
+		}
+
+		atomic.StoreInt32(&fetches, 0)
+		atomic.StoreInt32(&notModified, 0)
+		req, _ := http.NewRequest("GET", server.URL+"/file", nil)
+		req.Header.Set("If-None-Match", tt.ifNoneMatch)
+		res, err := http.DefaultClient.Do(req)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal(tt.status, res.StatusCode)
+		ast.Equal(`"v1"`, res.Header.Get("ETag"))
+		ast.Equal(tt.notModified, atomic.LoadInt32(&notModified))
+
+		// a file answered with 304 is cached in the background, so the
+		// next request is a hit or joins its fetch
+		res, err = http.Get(server.URL + "/file")
+		ast.Nil(err)
+		b, err := ioutil.ReadAll(res.Body)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal("content", string(b))
+		ast.Equal(tt.fetches, atomic.LoadInt32(&fetches))
+
+		server.Close()
+		cache.Close()
+	}
+
+	// the 304 is relayed without a cache as well
+	server := httptest.NewServer(FileServer(New(origin.URL)))
+	defer server.Close()
+	req, _ := http.NewRequest("HEAD", server.URL+"/file", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	res, err := http.DefaultClient.Do(req)
+	ast.Nil(err)
+	res.Body.Close()
+	ast.Equal(http.StatusNotModified, res.StatusCode)
+	ast.Equal("max-age=60", res.Header.Get("Cache-Control"))
+}
+
+func TestServeNotFoundFallback(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeNotFoundFallback")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>app</html>"))
+		case "/app.js":
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Write([]byte("app()"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	server := httptest.NewServer(FileServerWithOptions(New(origin.URL), ServeOptions{NotFoundFallback: "/index.html"}))
+	defer server.Close()
+
+	tests := []struct {
+		path   string
+		accept string
+		status int
+		body   string
+	}{
+		{"/app.js", "*/*", http.StatusOK, "app()"},
+		{"/settings/profile", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8", http.StatusOK, "<html>app</html>"},
+		{"/settings/profile", "application/xhtml+xml", http.StatusOK, "<html>app</html>"},
+		{"/missing.js", "*/*", http.StatusNotFound, ""},
+		{"/missing.png", "image/avif,image/webp,*/*", http.StatusNotFound, ""},
+		{"/settings/profile", "", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", server.URL+tt.path, nil)
+
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		ast.Nil(err)
+		b, err := ioutil.ReadAll(res.Body)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal(tt.status, res.StatusCode)
+
+		if tt.status == http.StatusOK {
+			ast.Equal(tt.body, string(b))
+		}
+	}
+}
+
+func TestServeNoSniff(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeNoSniff")
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0, 1, 2, 3}, 100)...)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// keep net/http from sniffing a type itself
+		w.Header()["Content-Type"] = nil
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(png))
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		noSniff     bool
+		path        string
+		rng         string
+		contentType string
+	}{
+		{false, "/image", "", "image/png"},
+		{false, "/image", "bytes=0-99", "image/png"},
+		{true, "/image", "", "application/octet-stream"},
+		{true, "/image", "bytes=0-99", "application/octet-stream"},
+		{true, "/image.png", "", "image/png"},
+	}
+
+	for _, tt := range tests {
+		fs := NewWithOptions(origin.URL, RemoteOptions{NoSniff: tt.noSniff})
+		server := httptest.NewServer(FileServerWithOptions(fs, ServeOptions{NoSniff: tt.noSniff}))
+		req, _ := http.NewRequest("GET", server.URL+tt.path, nil)
+
+		if tt.rng != "" {
+			req.Header.Set("Range", tt.rng)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal(tt.contentType, res.Header.Get("Content-Type"))
+		ast.Equal(tt.noSniff, res.Header.Get("X-Content-Type-Options") == "nosniff")
+		server.Close()
+	}
+}
+
+func TestServeForwardHeaders(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeForwardHeaders")
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte(r.Header.Get("Accept-Language") + "|" + r.Header.Get("X-Other")))
+	}))
+	defer origin.Close()
+
+	opt := ServeOptions{ForwardHeaders: []string{"accept-language"}}
+	cache := NewCache(New(origin.URL), 10, 1024)
+	defer cache.Close()
+	server := httptest.NewServer(FileServerWithOptions(cache, opt))
+	defer server.Close()
+
+	tests := []struct {
+		lang string
+		body string
+		hits int32
+	}{
+		{"en", "en|", 1},
+		{"de", "de|", 2},
+		{"en", "en|", 2},
+		{"", "|", 3},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", server.URL+"/file", nil)
+		req.Header.Set("X-Other", "not forwarded")
+
+		if tt.lang != "" {
+			req.Header.Set("Accept-Language", tt.lang)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		ast.Nil(err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		ast.Equal(http.StatusOK, res.StatusCode)
+		ast.Equal(tt.body, string(body))
+		ast.Equal("accept-language", res.Header.Get("Vary"))
+		ast.Equal(tt.hits, atomic.LoadInt32(&hits))
+	}
+}
+
+func TestServeHead(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeHead")
+	content := strings.Repeat("0123456789", 100)
+	var methods []string
+	var mu sync.Mutex
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+
+		if r.URL.Path == "/file" {
+			w.Header().Set("ETag", `"v1"`)
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	defer origin.Close()
+	cache := NewCache(New(origin.URL), 10, 1<<20)
+	defer cache.Close()
+	server := httptest.NewServer(FileServer(cache))
+	defer server.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		origin string // method of the origin request, if any
+	}{
+		{"HEAD", "/file", "HEAD"},
+		{"HEAD", "/noetag", "HEAD,GET"}, // the ETag is generated from the content
+		{"GET", "/file", "GET"},
+		{"HEAD", "/file", ""},
+	}
+
+	for _, tt := range tests {
+		mu.Lock()
+		methods = nil
+		mu.Unlock()
+		req, _ := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		res, err := http.DefaultClient.Do(req)
+		ast.Nil(err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		ast.Equal(http.StatusOK, res.StatusCode)
+		ast.Equal(int64(len(content)), res.ContentLength)
+		ast.Equal("text/plain", res.Header.Get("Content-Type"))
+		ast.Equal(true, res.Header.Get("ETag") != "")
+		mu.Lock()
+		ast.Equal(tt.origin, strings.Join(methods, ","))
+		mu.Unlock()
+
+		if tt.method == "GET" {
+			ast.Equal(content, string(body))
+		}
+	}
+}
+
+func TestServeIfRange(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeIfRange")
+	content := strings.Repeat("0123456789", 100)
+	modtime := time.Date(2015, 9, 1, 15, 3, 1, 0, time.UTC)
+	var fetches []string
+	var mu sync.Mutex
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches = append(fetches, r.Header.Get("Range")+"|"+r.Header.Get("If-Range"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain")
+
+		if r.URL.Path != "/generated" {
+			w.Header().Set("ETag", `"v1"`)
+		}
+
+		if r.URL.Path == "/sloppy" {
+			r.Header.Del("If-Range")
+		}
+
+		http.ServeContent(w, r, "", modtime, strings.NewReader(content))
+	}))
+	defer origin.Close()
+	cache := NewCache(New(origin.URL), 10, 1<<20)
+	defer cache.Close()
+	server := httptest.NewServer(FileServer(cache))
+	defer server.Close()
+
+	tests := []struct {
+		path    string
+		ifRange string
+		cached  bool
+		status  int
+		fetch   string // origin request, if any
+	}{
+		// the origin decides for uncached files
+		{"/file", `"v1"`, false, http.StatusPartialContent, `bytes=10-19|"v1"`},
+		{"/file", `"v0"`, false, http.StatusOK, `bytes=10-19|"v0"`},
+		{"/file", `W/"v1"`, false, http.StatusOK, `bytes=10-19|W/"v1"`},
+		{"/file", modtime.Format(http.TimeFormat), false, http.StatusPartialContent, "bytes=10-19|" + modtime.Format(http.TimeFormat)},
+		{"/file", modtime.Add(-time.Hour).Format(http.TimeFormat), false, http.StatusOK, "bytes=10-19|" + modtime.Add(-time.Hour).Format(http.TimeFormat)},
+
+		// the origin matches a date, the ETag is generated by the server
+		{"/generated", modtime.Format(http.TimeFormat), false, http.StatusPartialContent, "bytes=10-19|" + modtime.Format(http.TimeFormat)},
+
+		// the range of an origin ignoring If-Range is dropped
+		{"/sloppy", `"v0"`, false, http.StatusOK, `bytes=10-19|"v0",|`},
+
+		// cached files are served as cached
+		{"/file", `"v1"`, true, http.StatusPartialContent, ""},
+		{"/file", `"v0"`, true, http.StatusOK, ""},
+		{"/file", modtime.Format(http.TimeFormat), true, http.StatusPartialContent, ""},
+	}
+
+	for _, tt := range tests {
+		cache.(*memoryCacheFilesystem).del(tt.path)
+
+		if tt.cached {
+			res, err := http.Get(server.URL + tt.path)
+			ast.Nil(err)
+			res.Body.Close()
+		}
+
+		mu.Lock()
+		fetches = nil
+		mu.Unlock()
+		req, _ := http.NewRequest("GET", server.URL+tt.path, nil)
+		req.Header.Set("Range", "bytes=10-19")
+		req.Header.Set("If-Range", tt.ifRange)
+		res, err := http.DefaultClient.Do(req)
+		ast.Nil(err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		ast.Equal(tt.status, res.StatusCode)
+		mu.Lock()
+		ast.Equal(tt.fetch, strings.Join(fetches, ","))
+		mu.Unlock()
+
+		if tt.status == http.StatusOK {
+			ast.Equal(content, string(body))
+		} else {
+			ast.Equal(content[10:20], string(body))
+		}
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestIfRangeMatches")
+	modtime := time.Date(2015, 9, 1, 15, 3, 1, 0, time.UTC)
+	fi := fileInfo{etag: `"v1"`, modtime: modtime}
+
+	tests := []struct {
+		v     string
+		match bool
+	}{
+		{"", true},
+		{`"v1"`, true},
+		{`"v2"`, false},
+		{`W/"v1"`, false},
+		{modtime.Format(http.TimeFormat), true},
+		{modtime.Add(time.Second).Format(http.TimeFormat), false},
+		{"garbage", false},
+	}
+
+	for _, tt := range tests {
+		ast.Equal(tt.match, ifRangeMatches(tt.v, fi))
+	}
+
+	// a weak ETag never matches
+	ast.Equal(false, ifRangeMatches(`W/"v1"`, fileInfo{etag: `W/"v1"`}))
+}
+
+func TestServeErrorPages(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeErrorPages")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte("content"))
+		}
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		pages       map[int][]byte
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{nil, "/missing", http.StatusNotFound, "text/plain; charset=utf-8", "404 page not found\n"},
+		{nil, "/error", http.StatusBadGateway, "text/plain; charset=utf-8", "Bad Gateway\n"},
+		{map[int][]byte{404: []byte("<p>gone</p>")}, "/missing", http.StatusNotFound, "text/html; charset=utf-8", "<p>gone</p>"},
+		{map[int][]byte{404: []byte("<p>gone</p>")}, "/error", http.StatusBadGateway, "text/plain; charset=utf-8", "Bad Gateway\n"},
+		{map[int][]byte{502: []byte("<p>down</p>")}, "/error", http.StatusBadGateway, "text/html; charset=utf-8", "<p>down</p>"},
+		{map[int][]byte{502: []byte("<p>down</p>")}, "/file", http.StatusOK, "text/plain; charset=utf-8", "content"},
+	}
+
+	for _, tt := range tests {
+		server := httptest.NewServer(FileServerWithOptions(New(origin.URL), ServeOptions{ErrorPages: tt.pages}))
+		res, err := http.Get(server.URL + tt.path)
+		ast.Nil(err)
+		b, err := ioutil.ReadAll(res.Body)
+		ast.Nil(err)
+		res.Body.Close()
+		server.Close()
+		ast.Equal(tt.status, res.StatusCode)
+		ast.Equal(tt.contentType, res.Header.Get("Content-Type"))
+		ast.Equal(tt.body, string(b))
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/simonz05/filesrv"
+)
+
+// accessEntry is a line of the access log.
+type accessEntry struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Proto    string    `json:"proto"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"duration"` // seconds
+	Client   string    `json:"client"`
+	Referer  string    `json:"referer,omitempty"`
+	Agent    string    `json:"agent,omitempty"`
+	Cache    string    `json:"cache,omitempty"`
+}
+
+// combined formats the entry in the combined log format followed by the
+// duration and the cache status.
+func (e *accessEntry) combined() string {
+	field := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+
+		return s
+	}
+
+	return fmt.Sprintf("%s - - [%s] %s %d %d %s %s %.3f %s",
+		e.Client,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.Path+" "+e.Proto),
+		e.Status,
+		e.Bytes,
+		strconv.Quote(field(e.Referer)),
+		strconv.Quote(field(e.Agent)),
+		e.Duration,
+		field(e.Cache))
+}
+
+// statusRecorder records the status and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// accessLogHandler returns middleware writing a line per request to out in
+// format, "json" or "combined".
+func accessLogHandler(format string, out io.Writer) (func(http.Handler) http.Handler, error) {
+	if format != "json" && format != "combined" {
+		return nil, fmt.Errorf("server: invalid log format %q", format)
+	}
+
+	var mu sync.Mutex
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			var cache filesrv.CacheStatus
+			h.ServeHTTP(rec, r.WithContext(filesrv.WithCacheStatus(r.Context(), &cache)))
+
+			client, err := clientAddr(r, ratelimiter.TrustedHops)
+
+			if err != nil {
+				client = r.RemoteAddr
+			}
+
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+
+			e := &accessEntry{
+				Time:     start,
+				Method:   r.Method,
+				Path:     r.URL.RequestURI(),
+				Proto:    r.Proto,
+				Status:   rec.status,
+				Bytes:    rec.bytes,
+				Duration: time.Since(start).Seconds(),
+				Client:   client,
+				Referer:  r.Referer(),
+				Agent:    r.UserAgent(),
+				Cache:    cache.Load().String(),
+			}
+			var line []byte
+
+			if format == "json" {
+				line, _ = json.Marshal(e)
+			} else {
+				line = []byte(e.combined())
+			}
+
+			mu.Lock()
+			out.Write(append(line, '\n'))
+			mu.Unlock()
+		})
+	}, nil
+}
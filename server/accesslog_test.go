@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/simonz05/filesrv"
+	"github.com/simonz05/util/assert"
+)
+
+func TestAccessLog(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestAccessLog")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+	fs := filesrv.NewCache(filesrv.New(origin.URL), 10, 1024)
+	defer fs.Close()
+
+	var buf bytes.Buffer
+	accessLog, err := accessLogHandler("json", &buf)
+	ast.Nil(err)
+	h := accessLog(filesrv.FileServer(fs))
+
+	for _, cache := range []string{"MISS", "HIT"} {
+		buf.Reset()
+		req, _ := http.NewRequest("GET", "/file.txt?v=1", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("User-Agent", "test")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		var e accessEntry
+		ast.Nil(json.Unmarshal(buf.Bytes(), &e))
+		ast.Equal("GET", e.Method)
+		ast.Equal("/file.txt?v=1", e.Path)
+		ast.Equal(http.StatusOK, e.Status)
+		ast.Equal(int64(len("content")), e.Bytes)
+		ast.Equal("10.0.0.1", e.Client)
+		ast.Equal("test", e.Agent)
+		ast.Equal(cache, e.Cache)
+	}
+
+	accessLog, err = accessLogHandler("combined", &buf)
+	ast.Nil(err)
+	buf.Reset()
+	req, _ := http.NewRequest("GET", "/missing", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	accessLog(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), req)
+	line := buf.String()
+	ast.Equal(true, strings.HasPrefix(line, "10.0.0.1 - - ["))
+	ast.Equal(true, strings.Contains(line, `] "GET /missing HTTP/1.1" 404 19 "-" "-" `))
+	ast.Equal(true, strings.HasSuffix(line, " -\n"))
+
+	_, err = accessLogHandler("xml", &buf)
+	ast.NotNil(err)
+}
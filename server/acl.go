@@ -5,17 +5,28 @@
 package server
 
 import (
+	"fmt"
 	"net"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/hashicorp/golang-lru"
 	"github.com/juju/ratelimit"
 	"github.com/simonz05/util/log"
 )
 
+// defaultBuckets is the number of buckets a rate limiter holds unless
+// set with SetBuckets.
+const defaultBuckets = 10000
+
 // Ratelimiter
 type Ratelimiter struct {
-	buckets *lru.Cache
+	buckets   *lru.Cache
+	global    *ratelimit.Bucket // nil without a global limit
+	evictions int64             // updated atomically
 
 	// FillRate fills buckets at the rate of tokens per second up to max
 	// capacity.
@@ -23,50 +34,213 @@ type Ratelimiter struct {
 
 	// Capacity sets max capacity of buckets. See FillRate.
 	Capacity int64
+
+	// AddrFallback selects how requests are handled when the client address
+	// can't be parsed.
+	AddrFallback AddrFallback
+
+	// TrustedHops is the number of proxies in front of the server which
+	// append to X-Forwarded-For. The client address is the one added by
+	// the outermost of them. Zero takes the left-most address, which the
+	// client can forge.
+	TrustedHops int
+
+	// Rules limits requests for matching paths by the first matching rule
+	// instead of FillRate and Capacity. Each client has a bucket per rule.
+	// Paths no rule matches aren't limited per client by TakePath when
+	// FillRate is zero.
+	Rules []RateRule
+}
+
+// RateRule limits requests for paths matching Pattern to Rate per second
+// with bursts of Capacity per client. A Pattern ending in a slash matches
+// the paths it prefixes, other patterns match paths as path.Match does.
+type RateRule struct {
+	Pattern  string
+	Rate     float64
+	Capacity int64
+}
+
+// match reports whether the rule applies to the path p.
+func (rr RateRule) match(p string) bool {
+	if strings.HasSuffix(rr.Pattern, "/") {
+		return strings.HasPrefix(p, rr.Pattern)
+	}
+
+	ok, _ := path.Match(rr.Pattern, p)
+	return ok
+}
+
+// validate reports a malformed pattern or limit of the rule.
+func (rr RateRule) validate() error {
+	if _, err := path.Match(rr.Pattern, ""); err != nil || rr.Pattern == "" {
+		return fmt.Errorf("server: invalid rate limit pattern %q", rr.Pattern)
+	}
+
+	if rr.Rate <= 0 || rr.Capacity <= 0 {
+		return fmt.Errorf("server: invalid rate limit for %q", rr.Pattern)
+	}
+
+	return nil
+}
+
+// AddrFallback selects how ratelimitHandler handles requests with a client
+// address which can't be parsed.
+type AddrFallback int
+
+const (
+	// AddrFallbackError responds with HTTP 500.
+	AddrFallbackError AddrFallback = iota
+
+	// AddrFallbackRaw rate limits on the raw remote address.
+	AddrFallbackRaw
+
+	// AddrFallbackSkip serves the request without rate limiting.
+	AddrFallbackSkip
+)
+
+// parseAddrFallback parses the config names error, raw and skip.
+func parseAddrFallback(s string) (AddrFallback, error) {
+	switch s {
+	case "", "error":
+		return AddrFallbackError, nil
+	case "raw":
+		return AddrFallbackRaw, nil
+	case "skip":
+		return AddrFallbackSkip, nil
+	}
+
+	return AddrFallbackError, fmt.Errorf("server: invalid address fallback %q", s)
 }
 
 func NewRatelimiter() *Ratelimiter {
-	buckets, _ := lru.New(10000)
-	return &Ratelimiter{
-		buckets:  buckets,
+	r := &Ratelimiter{
 		FillRate: 1,
 		Capacity: 10,
 	}
+	r.buckets, _ = lru.NewWithEvict(defaultBuckets, func(key, value interface{}) {
+		atomic.AddInt64(&r.evictions, 1)
+	})
+	return r
+}
+
+// SetBuckets sets the number of buckets held, evicting the least recently
+// used buckets past n. Zero means 10000. A client whose bucket was evicted
+// gets a full bucket on its next request, so too few buckets for the
+// clients seen let them exceed their limit; each bucket costs a few hundred
+// bytes.
+func (r *Ratelimiter) SetBuckets(n int) {
+	if n <= 0 {
+		n = defaultBuckets
+	}
+
+	r.buckets.Resize(n)
+}
+
+// Buckets returns the number of buckets held.
+func (r *Ratelimiter) Buckets() int {
+	return r.buckets.Len()
+}
+
+// Evictions returns the number of buckets evicted to stay within the
+// number of buckets held. Steady evictions mean clients are rate limited
+// less than configured.
+func (r *Ratelimiter) Evictions() int64 {
+	return atomic.LoadInt64(&r.evictions)
 }
 
 // Take takes a token from key's bucket. If there is an available token it
 // returns true.
 func (r *Ratelimiter) Take(key string) bool {
-	v, ok := r.buckets.Get(key)
+	return r.take(key, r.FillRate, r.Capacity)
+}
 
-	var bucket *ratelimit.Bucket
+// TakePath takes a token from key's bucket of the first rule matching the
+// path p, or from key's bucket when no rule matches. If there is an
+// available token, or no rule matches and FillRate is zero, it returns
+// true.
+func (r *Ratelimiter) TakePath(key, p string) bool {
+	for i, rr := range r.Rules {
+		if rr.match(p) {
+			return r.take(key+"#"+strconv.Itoa(i), rr.Rate, rr.Capacity)
+		}
+	}
+
+	if r.FillRate <= 0 {
+		return true
+	}
+
+	return r.Take(key)
+}
+
+func (r *Ratelimiter) take(key string, rate float64, capacity int64) bool {
+	v, ok := r.buckets.Get(key)
 
-	// new
+	// new, or evicted since the last request. A bucket added concurrently
+	// for the same key is used instead.
 	if !ok {
-		bucket = ratelimit.NewBucketWithRate(r.FillRate, r.Capacity)
-		r.buckets.Add(key, bucket)
-	} else {
-		bucket, _ = v.(*ratelimit.Bucket)
+		bucket := ratelimit.NewBucketWithRate(rate, capacity)
+
+		if v, ok, _ = r.buckets.PeekOrAdd(key, bucket); !ok {
+			v = bucket
+		}
 	}
 
-	return bucket.Take(1) == 0
+	return v.(*ratelimit.Bucket).Take(1) == 0
+}
+
+// SetGlobalRate limits all requests together to rate per second with
+// bursts of capacity, on top of the per key limit. Zero rate removes the
+// global limit.
+func (r *Ratelimiter) SetGlobalRate(rate float64, capacity int64) {
+	if rate <= 0 {
+		r.global = nil
+		return
+	}
+
+	r.global = ratelimit.NewBucketWithRate(rate, capacity)
+}
+
+// TakeGlobal takes a token from the global bucket. If there is an
+// available token or no global limit it returns true.
+func (r *Ratelimiter) TakeGlobal() bool {
+	return r.global == nil || r.global.TakeAvailable(1) == 1
 }
 
 var ratelimiter = NewRatelimiter()
 
-// ratelimitHandler wraps an http.Handler with per host request throttling.
-// Responds with HTTP 429 when throttled.
+// ratelimitHandler wraps an http.Handler with global and per host request
+// throttling, limited by path by the rules of the rate limiter. Responds
+// with HTTP 429 when throttled.
 func ratelimitHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		host, err := clientAddr(r)
+		if !ratelimiter.TakeGlobal() {
+			log.Println("server: global rate-limited")
+			rateLimited.Add(1)
+			http.Error(w, "Too many requests", 429)
+			return
+		}
+
+		host, err := clientAddr(r, ratelimiter.TrustedHops)
 
 		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+			switch ratelimiter.AddrFallback {
+			case AddrFallbackRaw:
+				log.Printf("server: %v, rate limiting on %q", err, r.RemoteAddr)
+				host = r.RemoteAddr
+			case AddrFallbackSkip:
+				log.Printf("server: %v, not rate limiting", err)
+				h.ServeHTTP(w, r)
+				return
+			default:
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
 		}
 
-		if !ratelimiter.Take(host) {
+		if !ratelimiter.TakePath(host, r.URL.Path) {
 			log.Println("server: host rate-limited", host)
+			rateLimited.Add(1)
 			http.Error(w, "Too many requests", 429)
 			return
 		}
@@ -75,13 +249,45 @@ func ratelimitHandler(h http.Handler) http.Handler {
 	})
 }
 
-func clientAddr(r *http.Request) (string, error) {
-	addr := r.Header.Get("X-Forwarded-For")
+// clientAddr returns the client IP of r. It's taken from X-Forwarded-For,
+// skipping the addresses appended by the trusted hops, and from the remote
+// address when the header is absent or malformed.
+func clientAddr(r *http.Request, hops int) (string, error) {
+	var addrs []string
+
+	for _, v := range r.Header["X-Forwarded-For"] {
+		for _, addr := range strings.Split(v, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
+		}
+	}
+
+	if len(addrs) > 0 {
+		i := 0
+
+		if hops > 0 && hops < len(addrs) {
+			i = len(addrs) - hops
+		}
+
+		if ip := parseIP(addrs[i]); ip != nil {
+			return ip.String(), nil
+		}
 
-	if addr != "" {
-		return addr, nil
+		log.Printf("server: malformed X-Forwarded-For %q", strings.Join(addrs, ", "))
 	}
 
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	return host, err
 }
+
+// parseIP parses an IP address optionally followed by a port.
+func parseIP(s string) net.IP {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+
+	return nil
+}
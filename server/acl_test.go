@@ -0,0 +1,236 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/simonz05/filesrv/config"
+	"github.com/simonz05/util/assert"
+)
+
+func TestRatelimitAddrFallback(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRatelimitAddrFallback")
+	defer func(rl *Ratelimiter) { ratelimiter = rl }(ratelimiter)
+
+	tests := []struct {
+		fallback AddrFallback
+		status   int
+		buckets  int
+	}{
+		{AddrFallbackError, http.StatusInternalServerError, 0},
+		{AddrFallbackRaw, http.StatusOK, 1},
+		{AddrFallbackSkip, http.StatusOK, 0},
+	}
+
+	for _, tt := range tests {
+		ratelimiter = NewRatelimiter()
+		ratelimiter.AddrFallback = tt.fallback
+		h := ratelimitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "malformed"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		ast.Equal(tt.status, w.Code)
+		ast.Equal(tt.buckets, ratelimiter.buckets.Len())
+	}
+}
+
+func TestParseAddrFallback(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestParseAddrFallback")
+
+	for s, fallback := range map[string]AddrFallback{"": AddrFallbackError, "raw": AddrFallbackRaw, "skip": AddrFallbackSkip} {
+		v, err := parseAddrFallback(s)
+		ast.Nil(err)
+		ast.Equal(fallback, v)
+	}
+
+	_, err := parseAddrFallback("open")
+	ast.NotNil(err)
+}
+
+func TestClientAddr(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestClientAddr")
+
+	tests := []struct {
+		xff  []string
+		hops int
+		addr string
+	}{
+		{nil, 0, "10.0.0.1"},
+		{[]string{"1.2.3.4"}, 0, "1.2.3.4"},
+		{[]string{"1.2.3.4, 10.1.1.1, 10.2.2.2"}, 0, "1.2.3.4"},
+		{[]string{"1.2.3.4, 10.1.1.1, 10.2.2.2"}, 2, "10.1.1.1"},
+		{[]string{"1.2.3.4", "10.1.1.1"}, 1, "10.1.1.1"},
+		{[]string{"1.2.3.4"}, 5, "1.2.3.4"},
+		{[]string{"2001:db8::1, 10.1.1.1"}, 0, "2001:db8::1"},
+		{[]string{"[2001:db8::1]:4711"}, 0, "2001:db8::1"},
+		{[]string{"1.2.3.4:4711"}, 0, "1.2.3.4"},
+		{[]string{"unknown, 10.1.1.1"}, 0, "10.0.0.1"},
+		{[]string{""}, 0, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header["X-Forwarded-For"] = tt.xff
+		addr, err := clientAddr(req, tt.hops)
+		ast.Nil(err)
+		ast.Equal(tt.addr, addr)
+	}
+}
+
+func TestRatelimitRules(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRatelimitRules")
+	defer func(rl *Ratelimiter) { ratelimiter = rl }(ratelimiter)
+	ratelimiter = NewRatelimiter()
+	ratelimiter.FillRate, ratelimiter.Capacity = 0.001, 3
+	ratelimiter.Rules = []RateRule{
+		{Pattern: "/downloads/", Rate: 0.001, Capacity: 1},
+		{Pattern: "/*.zip", Rate: 0.001, Capacity: 2},
+	}
+	h := ratelimitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/downloads/a.iso", 200},
+		{"/downloads/b.iso", 429},
+		{"/a.zip", 200},
+		{"/b.zip", 200},
+		{"/c.zip", 429},
+		{"/index.html", 200},
+		{"/index.html", 200},
+		{"/downloads", 200},
+		{"/index.html", 429},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		ast.Equal(tt.status, w.Code)
+	}
+
+	// the buckets of a client are kept per rule
+	ast.Equal(3, ratelimiter.buckets.Len())
+
+	// without a per client limit only paths matching a rule are limited
+	ratelimiter.FillRate, ratelimiter.Capacity = 0, 0
+
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest("GET", "/other.html", nil)
+		req.RemoteAddr = "10.0.0.2:1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		ast.Equal(200, w.Code)
+	}
+
+	ast.Equal(3, ratelimiter.buckets.Len())
+}
+
+func TestRateRuleValidate(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRateRuleValidate")
+	tests := []struct {
+		rule RateRule
+		ok   bool
+	}{
+		{RateRule{"/downloads/", 1, 1}, true},
+		{RateRule{"/*.zip", 0.5, 2}, true},
+		{RateRule{"/[a", 1, 1}, false},
+		{RateRule{"", 1, 1}, false},
+		{RateRule{"/a", 0, 1}, false},
+	}
+
+	for _, tt := range tests {
+		ast.Equal(tt.ok, tt.rule.validate() == nil)
+	}
+}
+
+func TestRatelimitBuckets(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRatelimitBuckets")
+	rl := NewRatelimiter()
+	rl.FillRate, rl.Capacity = 0.001, 1
+	rl.SetBuckets(2)
+
+	ast.Equal(true, rl.Take("a"))
+	ast.Equal(false, rl.Take("a"))
+	ast.Equal(true, rl.Take("b"))
+	ast.Equal(true, rl.Take("c"))
+	ast.Equal(2, rl.Buckets())
+	ast.Equal(int64(1), rl.Evictions())
+
+	// the evicted client starts over with a full bucket
+	ast.Equal(true, rl.Take("a"))
+	ast.Equal(false, rl.Take("c"))
+
+	rl.SetBuckets(0)
+	ast.Equal(true, rl.Take("d"))
+	ast.Equal(3, rl.Buckets())
+}
+
+func TestRatelimitGlobal(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRatelimitGlobal")
+	defer func(rl *Ratelimiter) { ratelimiter = rl }(ratelimiter)
+	ratelimiter = NewRatelimiter()
+	ratelimiter.SetGlobalRate(0.001, 3)
+	h := ratelimitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// each client is within its own limit
+	for i, want := range []int{200, 200, 200, 429, 429} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		ast.Equal(want, w.Code)
+	}
+
+	ratelimiter.SetGlobalRate(0, 0)
+	ast.Equal(true, ratelimiter.TakeGlobal())
+}
+
+func TestRatelimitStatusHeaders(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRatelimitStatusHeaders")
+	defer func(rl *Ratelimiter) { ratelimiter = rl }(ratelimiter)
+	ratelimiter = NewRatelimiter()
+	ratelimiter.SetGlobalRate(0.001, 1)
+
+	conf := &config.Config{StatusHeaders: map[string]map[string]string{
+		"429": {"Retry-After": "1"},
+		"503": {"Retry-After": "5"},
+	}}
+	statusHeaders, err := statusHeaderHandler(conf)
+	ast.Nil(err)
+
+	// in the order of installHandlers
+	h := statusHeaders(timeoutHandler(20 * time.Millisecond)(ratelimitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+		}
+	}))))
+
+	tests := []struct {
+		path       string
+		status     int
+		retryAfter string
+	}{
+		{"/slow", http.StatusServiceUnavailable, "5"},
+		{"/file", http.StatusTooManyRequests, "1"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		ast.Equal(tt.status, w.Code)
+		ast.Equal(tt.retryAfter, w.Header().Get("Retry-After"))
+	}
+
+	_, err = statusHeaderHandler(&config.Config{StatusHeaders: map[string]map[string]string{"x": nil}})
+	ast.NotNil(err)
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/simonz05/filesrv"
+)
+
+// surrogatePurger is implemented by caches which index entries by
+// surrogate key.
+type surrogatePurger interface {
+	PurgeSurrogateKey(key string) int
+}
+
+// manifester is implemented by caches which list their files.
+type manifester interface {
+	Manifest(prefix string) map[string]filesrv.ManifestEntry
+}
+
+// entryLister is implemented by caches which describe their entries.
+type entryLister interface {
+	Entries() []filesrv.CacheEntry
+}
+
+// adminHandler wraps an http.Handler requiring the admin token as a bearer
+// token in the Authorization header. Responds with HTTP 401 otherwise.
+func adminHandler(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// purgeKeyHandler purges all cache entries tagged with the surrogate key
+// given by the key query parameter.
+func purgeKeyHandler(p surrogatePurger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		key := r.FormValue("key")
+
+		if key == "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]int{"purged": p.PurgeSurrogateKey(key)})
+	})
+}
+
+// purgeHandler purges the cache entries of the path given by the path query
+// parameter. Responds with HTTP 404 when the path wasn't cached.
+func purgeHandler(p filesrv.Purger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := r.FormValue("path")
+
+		if name == "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		if !p.Purge(name) {
+			writeJSON(w, http.StatusNotFound, map[string]bool{"purged": false})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]bool{"purged": true})
+	})
+}
+
+// purgeAllHandler empties the cache.
+func purgeAllHandler(p filesrv.Purger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		p.PurgeAll()
+		writeJSON(w, http.StatusOK, map[string]bool{"purged": true})
+	})
+}
+
+// manifestHandler responds with a JSON object describing the cached files
+// under prefix.
+func manifestHandler(m manifester, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.Manifest(prefix))
+	})
+}
+
+// cacheEntriesHandler responds with a JSON list describing the cached
+// files, most recently used first.
+func cacheEntriesHandler(l entryLister) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, l.Entries())
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
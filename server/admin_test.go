@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/simonz05/filesrv"
+	"github.com/simonz05/util/assert"
+)
+
+// fakePurger records purges of the paths it holds.
+type fakePurger struct {
+	paths map[string]bool
+}
+
+func (p *fakePurger) Purge(name string) bool {
+	ok := p.paths[name]
+	delete(p.paths, name)
+	return ok
+}
+
+func (p *fakePurger) PurgeAll() {
+	p.paths = make(map[string]bool)
+}
+
+func TestAdminPurge(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestAdminPurge")
+	p := &fakePurger{paths: map[string]bool{"/foo.js": true, "/bar.js": true}}
+	mux := http.NewServeMux()
+	mux.Handle("/admin/purge", adminHandler("secret", purgeHandler(p)))
+	mux.Handle("/admin/purge-all", adminHandler("secret", purgeAllHandler(p)))
+
+	tests := []struct {
+		method string
+		url    string
+		token  string
+		status int
+		body   string
+	}{
+		{"POST", "/admin/purge?path=/foo.js", "wrong", http.StatusUnauthorized, "Unauthorized\n"},
+		{"GET", "/admin/purge?path=/foo.js", "secret", http.StatusMethodNotAllowed, "Method Not Allowed\n"},
+		{"POST", "/admin/purge", "secret", http.StatusBadRequest, "Bad Request\n"},
+		{"POST", "/admin/purge?path=/foo.js", "secret", http.StatusOK, "{\"purged\":true}\n"},
+		{"POST", "/admin/purge?path=/foo.js", "secret", http.StatusNotFound, "{\"purged\":false}\n"},
+		{"POST", "/admin/purge-all", "secret", http.StatusOK, "{\"purged\":true}\n"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.url, nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		ast.Equal(tt.status, w.Code)
+		ast.Equal(tt.body, w.Body.String())
+	}
+
+	ast.Equal(0, len(p.paths))
+}
+
+func TestCacheEntriesHandler(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCacheEntriesHandler")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"`+r.URL.Path[1:]+`"`)
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer origin.Close()
+
+	cache := filesrv.NewCache(filesrv.New(origin.URL), 10, 1024)
+	defer cache.Close()
+
+	for _, name := range []string{"/a.txt", "/bb.txt"} {
+		f, err := cache.Open(name)
+		ast.Nil(err)
+		f.Close()
+	}
+
+	h := adminHandler("secret", cacheEntriesHandler(cache.(entryLister)))
+
+	tests := []struct {
+		method string
+		token  string
+		status int
+	}{
+		{"GET", "wrong", http.StatusUnauthorized},
+		{"POST", "secret", http.StatusMethodNotAllowed},
+		{"GET", "secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, "/debug/cache", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		ast.Equal(tt.status, w.Code)
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		var entries []filesrv.CacheEntry
+		ast.Nil(json.NewDecoder(w.Body).Decode(&entries))
+		ast.Equal(2, len(entries))
+		ast.Equal("/bb.txt", entries[0].Name)
+		ast.Equal(int64(7), entries[0].Size)
+		ast.Equal("text/plain", entries[0].ContentType)
+		ast.Equal(`"bb.txt"`, entries[0].ETag)
+		ast.Equal(int64(0), entries[0].Age)
+		ast.Equal("/a.txt", entries[1].Name)
+	}
+}
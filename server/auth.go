@@ -0,0 +1,32 @@
+// Copyright 2015 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// basicAuthHandler returns middleware requiring HTTP Basic auth with user
+// and password. Responds with HTTP 401 otherwise.
+func basicAuthHandler(user, password string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, p, ok := r.BasicAuth()
+
+			// compare both to not leak which one is wrong
+			userOk := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+			passwordOk := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+
+			if !ok || !userOk || !passwordOk {
+				w.Header().Set("WWW-Authenticate", `Basic realm="filesrv", charset="UTF-8"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/simonz05/util/assert"
+)
+
+func TestBasicAuth(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestBasicAuth")
+	h := basicAuthHandler("user", "secret")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		user     string
+		password string
+		status   int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"user", "wrong", http.StatusUnauthorized},
+		{"other", "secret", http.StatusUnauthorized},
+		{"user", "secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/file", nil)
+
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		ast.Equal(tt.status, w.Code)
+
+		if tt.status == http.StatusUnauthorized {
+			ast.Equal(`Basic realm="filesrv", charset="UTF-8"`, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2015 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/simonz05/util/log"
+)
+
+// defaultPurgeChannel is the Redis channel purges are published on.
+const defaultPurgeChannel = "filesrv:purge"
+
+// redisTimeout bounds dialing Redis and publishing a purge.
+const redisTimeout = 2 * time.Second
+
+// redisBroadcaster propagates purges between nodes through a Redis pub/sub
+// channel. It speaks just enough of the Redis protocol to AUTH, PUBLISH and
+// SUBSCRIBE: connections are plain TCP, so a Redis server requiring TLS is
+// reached through a local TLS proxy. Pub/sub channels are shared by all
+// databases, so no database is selected.
+type redisBroadcaster struct {
+	addr     string
+	channel  string
+	password string // sent with AUTH when set
+	retry    time.Duration
+
+	mu   sync.Mutex
+	pub  net.Conn // connection purges are published on, dialed lazily
+	rd   *bufio.Reader
+	sub  net.Conn // connection of the subscription
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newRedisBroadcaster(addr, channel, password string) *redisBroadcaster {
+	if channel == "" {
+		channel = defaultPurgeChannel
+	}
+
+	return &redisBroadcaster{
+		addr:     addr,
+		channel:  channel,
+		password: password,
+		retry:    time.Second,
+		done:     make(chan struct{}),
+	}
+}
+
+// dial connects to Redis and authenticates with the password, if any.
+func (b *redisBroadcaster) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, redisTimeout)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rd := bufio.NewReader(conn)
+
+	if b.password != "" {
+		conn.SetDeadline(time.Now().Add(redisTimeout))
+		_, err = conn.Write(redisCommand("AUTH", b.password))
+
+		if err == nil {
+			_, err = readRedisReply(rd)
+		}
+
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+
+		conn.SetDeadline(time.Time{})
+	}
+
+	return conn, rd, nil
+}
+
+// Publish publishes msg on the channel. A failed connection is dialed
+// again on the next publish.
+func (b *redisBroadcaster) Publish(msg string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.pub == nil {
+		conn, rd, err := b.dial()
+
+		if err != nil {
+			return err
+		}
+
+		b.pub, b.rd = conn, rd
+	}
+
+	b.pub.SetDeadline(time.Now().Add(redisTimeout))
+	_, err := b.pub.Write(redisCommand("PUBLISH", b.channel, msg))
+
+	if err == nil {
+		_, err = readRedisReply(b.rd)
+	}
+
+	if err != nil {
+		b.pub.Close()
+		b.pub, b.rd = nil, nil
+	}
+
+	return err
+}
+
+// Subscribe calls fn with the messages published on the channel until the
+// broadcaster is closed. The subscription is reconnected when it fails.
+func (b *redisBroadcaster) Subscribe(fn func(msg string)) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		for {
+			err := b.subscribe(fn)
+
+			select {
+			case <-b.done:
+				return
+			case <-time.After(b.retry):
+				log.Printf("server: purge subscription: %v, reconnecting", err)
+			}
+		}
+	}()
+}
+
+// subscribe reads the messages of a subscription until it fails.
+func (b *redisBroadcaster) subscribe(fn func(msg string)) error {
+	conn, rd, err := b.dial()
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	b.mu.Lock()
+
+	select {
+	case <-b.done:
+		b.mu.Unlock()
+		return errors.New("closed")
+	default:
+		b.sub = conn
+	}
+
+	b.mu.Unlock()
+
+	if _, err := conn.Write(redisCommand("SUBSCRIBE", b.channel)); err != nil {
+		return err
+	}
+
+	for {
+		reply, err := readRedisReply(rd)
+
+		if err != nil {
+			return err
+		}
+
+		// messages are ["message", channel, payload]
+		if msg, ok := reply.([]interface{}); ok && len(msg) == 3 && msg[0] == "message" {
+			if payload, ok := msg[2].(string); ok {
+				fn(payload)
+			}
+		}
+	}
+}
+
+// Close ends the subscription and the connection purges are published on.
+func (b *redisBroadcaster) Close() error {
+	b.mu.Lock()
+	close(b.done)
+
+	if b.sub != nil {
+		b.sub.Close()
+	}
+
+	if b.pub != nil {
+		b.pub.Close()
+		b.pub, b.rd = nil, nil
+	}
+
+	b.mu.Unlock()
+	b.wg.Wait()
+	return nil
+}
+
+// redisCommand encodes a command as an array of bulk strings.
+func redisCommand(args ...string) []byte {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+
+	return buf
+}
+
+// readRedisReply reads a reply: a string for simple and bulk strings, an
+// int64 for integers, nil for null bulk strings and a []interface{} for
+// arrays. Error replies are returned as errors.
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, errors.New("redis: " + line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		buf := make([]byte, n+2)
+
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		arr := make([]interface{}, n)
+
+		for i := range arr {
+			if arr[i], err = readRedisReply(rd); err != nil {
+				return nil, err
+			}
+		}
+
+		return arr, nil
+	}
+
+	return nil, fmt.Errorf("redis: malformed reply %q", line)
+}
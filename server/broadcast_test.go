@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simonz05/util/assert"
+)
+
+// fakeRedis serves the AUTH, PUBLISH and SUBSCRIBE commands of a single
+// channel. Connections authenticate with AUTH first when password is set.
+type fakeRedis struct {
+	ln         net.Listener
+	password   string
+	mu         sync.Mutex
+	subs       []net.Conn
+	subscribed chan bool
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &fakeRedis{ln: ln, password: password, subscribed: make(chan bool, 1)}
+	go r.serve()
+	return r
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.ln.Accept()
+
+		if err != nil {
+			return
+		}
+
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := r.password == ""
+
+	for {
+		cmd, err := readRedisReply(rd)
+
+		if err != nil {
+			return
+		}
+
+		args := cmd.([]interface{})
+		r.mu.Lock()
+
+		switch {
+		case args[0] == "AUTH" && args[1] == r.password:
+			authed = true
+			conn.Write([]byte("+OK\r\n"))
+		case args[0] == "AUTH":
+			conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+		case !authed:
+			conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+		case args[0] == "SUBSCRIBE":
+			r.subs = append(r.subs, conn)
+			conn.Write([]byte("*3\r\n$9\r\nsubscribe\r\n$13\r\nfilesrv:purge\r\n:1\r\n"))
+			r.subscribed <- true
+		case args[0] == "PUBLISH":
+			for _, sub := range r.subs {
+				sub.Write(redisCommand("message", args[1].(string), args[2].(string)))
+			}
+
+			conn.Write([]byte(":1\r\n"))
+		}
+
+		r.mu.Unlock()
+	}
+}
+
+func TestRedisBroadcaster(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRedisBroadcaster")
+	redis := newFakeRedis(t, "")
+	defer redis.ln.Close()
+
+	names := make(chan string, 1)
+	sub := newRedisBroadcaster(redis.ln.Addr().String(), "", "")
+	defer sub.Close()
+	sub.Subscribe(func(name string) { names <- name })
+	<-redis.subscribed
+
+	pub := newRedisBroadcaster(redis.ln.Addr().String(), "", "")
+	defer pub.Close()
+	ast.Nil(pub.Publish("/foo.js"))
+
+	select {
+	case name := <-names:
+		ast.Equal("/foo.js", name)
+	case <-time.After(time.Second):
+		t.Fatal("purge not received")
+	}
+}
+
+func TestRedisBroadcasterAuth(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRedisBroadcasterAuth")
+	redis := newFakeRedis(t, "secret")
+	defer redis.ln.Close()
+
+	names := make(chan string, 1)
+	sub := newRedisBroadcaster(redis.ln.Addr().String(), "", "secret")
+	defer sub.Close()
+	sub.Subscribe(func(name string) { names <- name })
+	<-redis.subscribed
+
+	wrong := newRedisBroadcaster(redis.ln.Addr().String(), "", "wrong")
+	defer wrong.Close()
+	ast.NotNil(wrong.Publish("/foo.js"))
+
+	pub := newRedisBroadcaster(redis.ln.Addr().String(), "", "secret")
+	defer pub.Close()
+	ast.Nil(pub.Publish("/foo.js"))
+
+	select {
+	case name := <-names:
+		ast.Equal("/foo.js", name)
+	case <-time.After(time.Second):
+		t.Fatal("purge not received")
+	}
+}
@@ -5,22 +5,213 @@
 package server
 
 import (
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/simonz05/filesrv"
 	"github.com/simonz05/filesrv/config"
 )
 
 type context struct {
-	filesystem http.FileSystem
+	conf          *config.Config
+	origin        http.FileSystem
+	originURL     string // primary origin
+	originLatency *originHistogram
+	filesystem    http.FileSystem
+	purges        *filesrv.PurgeListener
+	broadcaster   *redisBroadcaster
 }
 
 func newContextFromConfig(conf *config.Config) (*context, error) {
-	c := &context{}
-	c.filesystem = filesrv.NewCache(filesrv.New(conf.Origin), 50, 1024*1024*512)
+	c := &context{conf: conf}
+	primary, failover := conf.Origin, conf.Origins
+
+	if primary == "" && len(failover) > 0 {
+		primary, failover = failover[0], failover[1:]
+	}
+
+	opt := filesrv.RemoteOptions{
+		Failover:        failover,
+		LengthRetries:   conf.OriginLengthRetries,
+		DisableETag:     !conf.GenerateETag,
+		StreamThreshold: conf.OriginStreamThreshold,
+		SpoolThreshold:  conf.OriginSpoolThreshold,
+		MaxFetches:      conf.OriginMaxFetches,
+		MaxFileSize:     conf.OriginMaxFileSize,
+		ContentTypes:    conf.ContentTypes,
+		NoSniff:         conf.NoSniff,
+	}
+
+	if conf.HasTempDir() {
+		opt.SpoolDir = conf.TmpDir
+	}
+
+	for k, v := range conf.OriginHeaders {
+		if opt.Header == nil {
+			opt.Header = make(http.Header)
+		}
+
+		opt.Header.Set(k, v)
+	}
+
+	etagHash, err := parseETagHash(conf.ETagHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	opt.ETagHash = etagHash
+	redirects, err := parseRedirectPolicy(conf.OriginRedirects)
+
+	if err != nil {
+		return nil, err
+	}
+
+	opt.Redirects = redirects
+	opt.MaxRedirects = conf.OriginMaxRedirects
+
+	var origin http.FileSystem
+
+	if root := localRoot(conf); root != "" {
+		origin = filesrv.NewDirWithOptions(root, filesrv.DirOptions{
+			NoSniff:      conf.NoSniff,
+			ContentTypes: conf.ContentTypes,
+			ETagHash:     etagHash,
+			MaxFileSize:  conf.OriginMaxFileSize,
+		})
+	} else {
+		c.originLatency = new(originHistogram)
+		opt.Observer = c.originLatency
+		origin = filesrv.NewWithOptions(primary, opt)
+		c.originURL = primary
+	}
+
+	c.origin = origin
+	period := conf.InvalidatePeriod.Duration
+
+	if period == 0 {
+		period = -1
+	}
+
+	var extTTL map[string]time.Duration
+
+	for ext, ttl := range conf.ExtensionTTL {
+		if extTTL == nil {
+			extTTL = make(map[string]time.Duration)
+		}
+
+		extTTL[ext] = ttl.Duration
+	}
+
+	// purges reach the other nodes through Redis
+	var broadcaster filesrv.PurgeBroadcaster
+
+	if conf.PurgeRedis != "" {
+		c.broadcaster = newRedisBroadcaster(conf.PurgeRedis, conf.PurgeRedisChannel, conf.PurgeRedisPassword)
+		broadcaster = c.broadcaster
+	}
+
+	c.filesystem = filesrv.NewCacheWithOptions(origin, filesrv.CacheOptions{
+		MaxItems:             50,
+		MaxSize:              1024 * 1024 * 512,
+		MaxReaders:           conf.CacheMaxReaders,
+		DedupWindow:          conf.OriginDedupWindow.Duration,
+		MaxRevalidateAge:     conf.MaxRevalidateAge.Duration,
+		NoRevalidate:         conf.PurgeStream != "",
+		CollapseRevalidation: conf.CollapseRevalidation,
+		InvalidatorMaxDiff:   conf.InvalidatorMaxDiff,
+		Paranoid:             conf.CacheParanoid,
+		GzipMaxSize:          conf.CacheGzipMaxSize,
+		BrotliMaxSize:        conf.CacheBrotliMaxSize,
+		BrotliQuality:        conf.BrotliQuality,
+		NegativeTTL:          conf.CacheNegativeTTL.Duration,
+		InvalidatePeriod:     period,
+		TTL:                  conf.CacheTTL.Duration,
+		ExtensionTTL:         extTTL,
+		StaleWhileRevalidate: conf.StaleWhileRevalidate.Duration,
+		Broadcaster:          broadcaster,
+	})
+
+	if conf.PurgeStream != "" {
+		purges, err := filesrv.NewPurgeListener(conf.PurgeStream, c.filesystem)
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.purges = purges
+	}
+
 	return c, nil
 }
 
+// parseETagHash parses the config names md5, fnv and crc32 of the hash
+// ETags are generated with.
+func parseETagHash(s string) (func() hash.Hash, error) {
+	switch s {
+	case "", "md5":
+		return md5.New, nil
+	case "fnv":
+		return func() hash.Hash { return fnv.New64a() }, nil
+	case "crc32":
+		return func() hash.Hash { return crc32.NewIEEE() }, nil
+	}
+
+	return nil, fmt.Errorf("server: invalid etag hash %q", s)
+}
+
+// parseRedirectPolicy parses the config names follow, reject and relay of
+// the origin redirect policy.
+func parseRedirectPolicy(s string) (filesrv.RedirectPolicy, error) {
+	switch s {
+	case "", "follow":
+		return filesrv.RedirectFollow, nil
+	case "reject":
+		return filesrv.RedirectReject, nil
+	case "relay":
+		return filesrv.RedirectRelay, nil
+	}
+
+	return filesrv.RedirectFollow, fmt.Errorf("server: invalid redirect policy %q", s)
+}
+
+// localRoot returns the directory files are served from when the origin is
+// the local filesystem, the Root of conf or a file:// Origin.
+func localRoot(conf *config.Config) string {
+	if conf.Root != "" {
+		return conf.Root
+	}
+
+	if strings.HasPrefix(conf.Origin, "file://") {
+		return strings.TrimPrefix(conf.Origin, "file://")
+	}
+
+	return ""
+}
+
 func (c *context) Close() error {
-	return nil
+	var err error
+
+	if c.purges != nil {
+		err = c.purges.Close()
+	}
+
+	if c.broadcaster != nil {
+		c.broadcaster.Close()
+	}
+
+	if cl, ok := c.filesystem.(io.Closer); ok {
+		if cerr := cl.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
 }
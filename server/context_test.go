@@ -0,0 +1,34 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/simonz05/filesrv"
+	"github.com/simonz05/util/assert"
+)
+
+func TestParseETagHash(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestParseETagHash")
+
+	for s, size := range map[string]int{"": 16, "md5": 16, "fnv": 8, "crc32": 4} {
+		newHash, err := parseETagHash(s)
+		ast.Nil(err)
+		ast.Equal(size, newHash().Size())
+	}
+
+	_, err := parseETagHash("sha1")
+	ast.NotNil(err)
+}
+
+func TestParseRedirectPolicy(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestParseRedirectPolicy")
+
+	for s, p := range map[string]filesrv.RedirectPolicy{"": filesrv.RedirectFollow, "follow": filesrv.RedirectFollow, "reject": filesrv.RedirectReject, "relay": filesrv.RedirectRelay} {
+		v, err := parseRedirectPolicy(s)
+		ast.Nil(err)
+		ast.Equal(p, v)
+	}
+
+	_, err := parseRedirectPolicy("ignore")
+	ast.NotNil(err)
+}
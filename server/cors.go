@@ -0,0 +1,51 @@
+// Copyright 2015 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+)
+
+// corsHandler returns middleware adding CORS headers to responses to
+// requests from the allowed origins. An origin of "*" allows any origin.
+// Requests from other origins are served without CORS headers.
+func corsHandler(origins []string) func(http.Handler) http.Handler {
+	allowAll := false
+	allowed := make(map[string]bool, len(origins))
+
+	for _, o := range origins {
+		if o == "*" {
+			allowAll = true
+		}
+
+		allowed[o] = true
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+
+			switch {
+			case origin == "":
+			case allowAll:
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			case allowed[origin]:
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+
+			if r.Method == "OPTIONS" && origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+				if w.Header().Get("Access-Control-Allow-Origin") != "" {
+					w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+				}
+
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
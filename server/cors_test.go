@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/simonz05/util/assert"
+)
+
+func TestCorsHandler(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCorsHandler")
+	tests := []struct {
+		origins []string
+		method  string
+		origin  string
+		status  int
+		allow   string
+		methods string
+	}{
+		{[]string{"https://a.com"}, "GET", "https://a.com", http.StatusOK, "https://a.com", ""},
+		{[]string{"https://a.com"}, "GET", "https://b.com", http.StatusOK, "", ""},
+		{[]string{"*"}, "GET", "https://b.com", http.StatusOK, "*", ""},
+		{[]string{"https://a.com"}, "GET", "", http.StatusOK, "", ""},
+		{[]string{"https://a.com"}, "OPTIONS", "https://a.com", http.StatusNoContent, "https://a.com", "GET, HEAD"},
+		{[]string{"https://a.com"}, "OPTIONS", "https://b.com", http.StatusNoContent, "", ""},
+	}
+
+	for _, tt := range tests {
+		h := corsHandler(tt.origins)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		req, _ := http.NewRequest(tt.method, "/file", nil)
+
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+
+		if tt.method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		ast.Equal(tt.status, w.Code)
+		ast.Equal(tt.allow, w.Header().Get("Access-Control-Allow-Origin"))
+		ast.Equal(tt.methods, w.Header().Get("Access-Control-Allow-Methods"))
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	gocontext "context"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds the origin request of a readiness check.
+const readyTimeout = 2 * time.Second
+
+// healthHandler responds with HTTP 200 while the server is serving.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// originStatus describes the origin in readiness responses.
+type originStatus struct {
+	Origin string `json:"origin"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readyHandler responds with HTTP 200 when a HEAD request to origin gets
+// a response other than a server error within readyTimeout, HTTP 503
+// otherwise.
+func readyHandler(origin string, client *http.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := gocontext.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "HEAD", origin, nil)
+
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, originStatus{"unavailable", err.Error()})
+			return
+		}
+
+		res, err := client.Do(req)
+
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, originStatus{"unavailable", err.Error()})
+			return
+		}
+
+		res.Body.Close()
+
+		if res.StatusCode >= 500 {
+			writeJSON(w, http.StatusServiceUnavailable, originStatus{"unavailable", res.Status})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, originStatus{Origin: "ok"})
+	})
+}
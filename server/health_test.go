@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/simonz05/util/assert"
+)
+
+func TestHealth(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestHealth")
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	healthHandler(w, req)
+	ast.Equal(http.StatusOK, w.Code)
+	ast.Equal("ok\n", w.Body.String())
+}
+
+func TestReady(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestReady")
+	var status int
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ast.Equal("HEAD", r.Method)
+		w.WriteHeader(status)
+	}))
+	defer origin.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		origin       string
+		originStatus int
+		status       int
+		body         string
+	}{
+		{origin.URL, http.StatusOK, http.StatusOK, "{\"origin\":\"ok\"}\n"},
+		{origin.URL, http.StatusNotFound, http.StatusOK, "{\"origin\":\"ok\"}\n"},
+		{origin.URL, http.StatusBadGateway, http.StatusServiceUnavailable, "{\"origin\":\"unavailable\",\"error\":\"502 Bad Gateway\"}\n"},
+		{down.URL, 0, http.StatusServiceUnavailable, ""},
+	}
+
+	for _, tt := range tests {
+		status = tt.originStatus
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		readyHandler(tt.origin, http.DefaultClient).ServeHTTP(w, req)
+		ast.Equal(tt.status, w.Code)
+
+		if tt.body != "" {
+			ast.Equal(tt.body, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2015 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/simonz05/filesrv"
+)
+
+var (
+	rateLimited = expvar.NewInt("filesrv.ratelimit.rejected")
+	inflight    = expvar.NewInt("filesrv.requests.inflight")
+)
+
+// transferLister is implemented by file servers which track responses in
+// progress.
+type transferLister interface {
+	Transfers() []filesrv.Transfer
+}
+
+// byteCounter is implemented by origins which count the bytes fetched.
+type byteCounter interface {
+	OriginBytes() int64
+}
+
+// servedCounter is implemented by file servers which count the bytes
+// served.
+type servedCounter interface {
+	ServedBytes() int64
+}
+
+// originErrorCounter is implemented by origins which count failed fetches by
+// category.
+type originErrorCounter interface {
+	OriginErrors() map[string]int64
+}
+
+// fetchCounter is implemented by origins which count their fetches.
+type fetchCounter interface {
+	OriginFetches() int64
+}
+
+// latencyBuckets are the upper bounds of the buckets of the origin latency
+// histogram.
+var latencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// sizeBuckets are the upper bounds in bytes of the buckets of the origin
+// response size histogram.
+var sizeBuckets = []int64{
+	1 << 10,
+	10 << 10,
+	100 << 10,
+	1 << 20,
+	10 << 20,
+	100 << 20,
+	1 << 30,
+}
+
+// originHistogram is an origin observer counting origin requests by
+// latency, by response size and by status class.
+type originHistogram struct {
+	counts   [10]int64 // per bucket of latencyBuckets and one above
+	sizes    [9]int64  // per bucket of sizeBuckets, one above and unknown
+	statuses [6]int64  // per status class, 0 without a response
+}
+
+func (h *originHistogram) Observe(d time.Duration, size int64, status int) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	atomic.AddInt64(&h.counts[i], 1)
+
+	if status == 0 {
+		atomic.AddInt64(&h.statuses[0], 1)
+		return
+	}
+
+	if class := status / 100; class > 0 && class < len(h.statuses) {
+		atomic.AddInt64(&h.statuses[class], 1)
+	}
+
+	i = len(h.sizes) - 1
+
+	if size >= 0 {
+		i = sort.Search(len(sizeBuckets), func(i int) bool { return size <= sizeBuckets[i] })
+	}
+
+	atomic.AddInt64(&h.sizes[i], 1)
+}
+
+// snapshot returns the number of requests by the upper bound of their
+// bucket, such as "250ms", and "+Inf" for slower requests.
+func (h *originHistogram) snapshot() map[string]int64 {
+	m := make(map[string]int64, len(h.counts))
+
+	for i := range h.counts {
+		k := "+Inf"
+
+		if i < len(latencyBuckets) {
+			k = latencyBuckets[i].String()
+		}
+
+		m[k] = atomic.LoadInt64(&h.counts[i])
+	}
+
+	return m
+}
+
+// sizeSnapshot returns the number of responses by the upper bound in bytes
+// of their size bucket, "+Inf" for larger responses and "unknown" for
+// streamed responses without a Content-Length.
+func (h *originHistogram) sizeSnapshot() map[string]int64 {
+	m := make(map[string]int64, len(h.sizes))
+
+	for i := range h.sizes {
+		k := "unknown"
+
+		if i < len(sizeBuckets) {
+			k = strconv.FormatInt(sizeBuckets[i], 10)
+		} else if i == len(sizeBuckets) {
+			k = "+Inf"
+		}
+
+		m[k] = atomic.LoadInt64(&h.sizes[i])
+	}
+
+	return m
+}
+
+// statusSnapshot returns the number of requests by the class of their
+// response status, such as "2xx", and "error" for requests which got no
+// response.
+func (h *originHistogram) statusSnapshot() map[string]int64 {
+	m := make(map[string]int64, len(h.statuses))
+	m["error"] = atomic.LoadInt64(&h.statuses[0])
+
+	for class := 1; class < len(h.statuses); class++ {
+		m[strconv.Itoa(class)+"xx"] = atomic.LoadInt64(&h.statuses[class])
+	}
+
+	return m
+}
+
+// inflightHandler counts the requests in progress.
+func inflightHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inflight.Add(1)
+		defer inflight.Add(-1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// publishMetrics publishes the metrics of the cache, the origin and the
+// file server as expvar variables.
+func publishMetrics(c *context, fileServer http.Handler, opt filesrv.ServeOptions) {
+	if cs, ok := c.filesystem.(filesrv.CacheStatter); ok {
+		stat := func(f func(filesrv.CacheStats) int64) func() interface{} {
+			return func() interface{} {
+				return f(cs.Stats())
+			}
+		}
+
+		publish("filesrv.cache.hits", stat(func(s filesrv.CacheStats) int64 { return s.Hits }))
+		publish("filesrv.cache.misses", stat(func(s filesrv.CacheStats) int64 { return s.Misses }))
+		publish("filesrv.cache.negative", stat(func(s filesrv.CacheStats) int64 { return s.Negative }))
+		publish("filesrv.cache.items", stat(func(s filesrv.CacheStats) int64 { return s.Items }))
+		publish("filesrv.cache.size", stat(func(s filesrv.CacheStats) int64 { return s.Size }))
+		publish("filesrv.cache.evictions", stat(func(s filesrv.CacheStats) int64 { return s.Evictions }))
+	}
+
+	if o, ok := c.origin.(fetchCounter); ok {
+		publish("filesrv.origin.fetches", func() interface{} {
+			return o.OriginFetches()
+		})
+	}
+
+	if t, ok := fileServer.(transferLister); ok && opt.TrackTransfers {
+		publish("filesrv.transfers", func() interface{} {
+			return t.Transfers()
+		})
+	}
+
+	if o, ok := c.origin.(byteCounter); ok {
+		publish("filesrv.origin.bytes", func() interface{} {
+			return o.OriginBytes()
+		})
+	}
+
+	if s, ok := fileServer.(servedCounter); ok {
+		publish("filesrv.served.bytes", func() interface{} {
+			return s.ServedBytes()
+		})
+	}
+
+	if o, ok := c.origin.(originErrorCounter); ok {
+		publish("filesrv.origin.errors", func() interface{} {
+			return o.OriginErrors()
+		})
+	}
+
+	publish("filesrv.ratelimit.buckets", func() interface{} {
+		return ratelimiter.Buckets()
+	})
+	publish("filesrv.ratelimit.evictions", func() interface{} {
+		return ratelimiter.Evictions()
+	})
+
+	if h := c.originLatency; h != nil {
+		publish("filesrv.origin.latency", func() interface{} {
+			return h.snapshot()
+		})
+		publish("filesrv.origin.size", func() interface{} {
+			return h.sizeSnapshot()
+		})
+		publish("filesrv.origin.status", func() interface{} {
+			return h.statusSnapshot()
+		})
+	}
+}
+
+// published holds the functions read by the expvar variables published by
+// publish, by name.
+var published sync.Map
+
+// publish publishes the expvar variable name reading f. Publishing a name
+// again, as a second Init does, replaces the function the variable reads
+// instead of panicking on the duplicate name.
+func publish(name string, f func() interface{}) {
+	v, loaded := published.LoadOrStore(name, new(atomic.Value))
+	fn := v.(*atomic.Value)
+	fn.Store(f)
+
+	if !loaded {
+		expvar.Publish(name, expvar.Func(func() interface{} {
+			return fn.Load().(func() interface{})()
+		}))
+	}
+}
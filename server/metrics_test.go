@@ -0,0 +1,93 @@
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/simonz05/filesrv"
+	"github.com/simonz05/util/assert"
+)
+
+func TestPublishMetrics(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestPublishMetrics")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+	c := &context{origin: filesrv.New(origin.URL)}
+	cache := filesrv.NewCache(c.origin, 10, 1024)
+	defer cache.Close()
+	c.filesystem = cache
+	fileServer := filesrv.FileServer(c.filesystem)
+
+	// publishing again, as a second Init does, replaces the variables
+	stale := filesrv.NewCache(c.origin, 10, 1024)
+	defer stale.Close()
+	publishMetrics(&context{origin: c.origin, filesystem: stale}, fileServer, filesrv.ServeOptions{})
+	publishMetrics(c, fileServer, filesrv.ServeOptions{})
+
+	h := inflightHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ast.Equal("1", inflight.String())
+		fileServer.ServeHTTP(w, r)
+	}))
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "/file", nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"filesrv.cache.hits", "1"},
+		{"filesrv.cache.misses", "1"},
+		{"filesrv.cache.items", "1"},
+		{"filesrv.origin.fetches", "1"},
+		{"filesrv.served.bytes", "14"},
+		{"filesrv.requests.inflight", "0"},
+	}
+
+	for _, tt := range tests {
+		ast.Equal(tt.value, expvar.Get(tt.name).String())
+	}
+}
+
+func TestOriginHistogram(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestOriginHistogram")
+	h := new(originHistogram)
+
+	for _, d := range []time.Duration{time.Millisecond, 10 * time.Millisecond, 200 * time.Millisecond, time.Minute} {
+		h.Observe(d, 100, http.StatusOK)
+	}
+
+	m := h.snapshot()
+	ast.Equal(len(latencyBuckets)+1, len(m))
+	ast.Equal(int64(2), m["10ms"])
+	ast.Equal(int64(0), m["50ms"])
+	ast.Equal(int64(1), m["250ms"])
+	ast.Equal(int64(1), m["+Inf"])
+
+	h = new(originHistogram)
+	h.Observe(time.Millisecond, 2<<10, http.StatusOK)
+	h.Observe(time.Millisecond, 2<<30, http.StatusOK)
+	h.Observe(time.Millisecond, -1, http.StatusOK)
+	h.Observe(time.Millisecond, 19, http.StatusNotFound)
+	h.Observe(time.Millisecond, 0, 0)
+
+	m = h.sizeSnapshot()
+	ast.Equal(len(sizeBuckets)+2, len(m))
+	ast.Equal(int64(1), m["1024"])
+	ast.Equal(int64(1), m["10240"])
+	ast.Equal(int64(1), m["+Inf"])
+	ast.Equal(int64(1), m["unknown"])
+
+	m = h.statusSnapshot()
+	ast.Equal(int64(3), m["2xx"])
+	ast.Equal(int64(1), m["4xx"])
+	ast.Equal(int64(0), m["5xx"])
+	ast.Equal(int64(1), m["error"])
+}
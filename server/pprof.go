@@ -0,0 +1,63 @@
+// Copyright 2015 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// pprofPrefix is the path net/http/pprof serves its handlers under.
+const pprofPrefix = "/debug/pprof/"
+
+// expvarPath is the path expvar serves its variables under.
+const expvarPath = "/debug/vars"
+
+// handleDebug registers the expvar and pprof handlers on mux.
+func handleDebug(mux *http.ServeMux) {
+	mux.Handle(expvarPath, expvar.Handler())
+	mux.HandleFunc(pprofPrefix, pprof.Index)
+	mux.HandleFunc(pprofPrefix+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(pprofPrefix+"profile", pprof.Profile)
+	mux.HandleFunc(pprofPrefix+"symbol", pprof.Symbol)
+	mux.HandleFunc(pprofPrefix+"trace", pprof.Trace)
+}
+
+// withoutDebug hides the handlers expvar and net/http/pprof register on h,
+// the http.DefaultServeMux, when they're served on the admin listener.
+func withoutDebug(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == expvarPath || strings.HasPrefix(r.URL.Path, pprofPrefix) {
+			http.NotFound(w, r)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// pprofGate hides the handlers net/http/pprof registers on h, the
+// http.DefaultServeMux, unless enabled. The enabled handlers require the
+// admin token when there's one. Either way they bypass the middleware of
+// the file server.
+func pprofGate(h http.Handler, enabled bool, token string) http.Handler {
+	guarded := h
+
+	if token != "" {
+		guarded = adminHandler(token, h)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, pprofPrefix) {
+			h.ServeHTTP(w, r)
+		} else if !enabled {
+			http.NotFound(w, r)
+		} else {
+			guarded.ServeHTTP(w, r)
+		}
+	})
+}
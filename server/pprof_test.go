@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/simonz05/util/assert"
+)
+
+func TestPprofGate(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestPprofGate")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.Handle(pprofPrefix, http.DefaultServeMux)
+
+	tests := []struct {
+		enabled bool
+		token   string
+		auth    string
+		path    string
+		status  int
+	}{
+		{false, "", "", "/debug/pprof/", http.StatusNotFound},
+		{false, "", "", "/debug/pprof/cmdline", http.StatusNotFound},
+		{false, "", "", "/file.js", http.StatusOK},
+		{true, "", "", "/debug/pprof/", http.StatusOK},
+		{true, "", "", "/debug/pprof/cmdline", http.StatusOK},
+		{true, "secret", "wrong", "/debug/pprof/", http.StatusUnauthorized},
+		{true, "secret", "secret", "/debug/pprof/", http.StatusOK},
+		{true, "secret", "", "/file.js", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tt.auth)
+		w := httptest.NewRecorder()
+		pprofGate(mux, tt.enabled, tt.token).ServeHTTP(w, req)
+		ast.Equal(tt.status, w.Code)
+	}
+}
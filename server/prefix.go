@@ -0,0 +1,42 @@
+// Copyright 2015 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// stripPrefixHandler serves requests for paths under prefix with h, with
+// the prefix removed from the path. Other requests get HTTP 404.
+func stripPrefixHandler(prefix string, h http.Handler) http.Handler {
+	prefix = "/" + strings.Trim(prefix, "/")
+
+	if prefix == "/" {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, prefix)
+
+		if len(rest) == len(r.URL.Path) || rest != "" && rest[0] != '/' {
+			http.NotFound(w, r)
+			return
+		}
+
+		if rest == "" {
+			rest = "/"
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		h.ServeHTTP(w, r2)
+	})
+}
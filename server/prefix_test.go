@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/simonz05/util/assert"
+)
+
+func TestStripPrefix(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestStripPrefix")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+
+	tests := []struct {
+		prefix string
+		path   string
+		status int
+		body   string
+	}{
+		{"", "/js/app.js", http.StatusOK, "/js/app.js"},
+		{"/", "/js/app.js", http.StatusOK, "/js/app.js"},
+		{"/assets", "/assets/js/app.js", http.StatusOK, "/js/app.js"},
+		{"/assets/", "/assets/js/app.js", http.StatusOK, "/js/app.js"},
+		{"assets", "/assets", http.StatusOK, "/"},
+		{"/assets", "/assetsjs/app.js", http.StatusNotFound, ""},
+		{"/assets", "/js/app.js", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.path, nil)
+		w := httptest.NewRecorder()
+		stripPrefixHandler(tt.prefix, h).ServeHTTP(w, req)
+		ast.Equal(tt.status, w.Code)
+
+		if tt.status == http.StatusOK {
+			ast.Equal(tt.body, w.Body.String())
+		}
+	}
+}
@@ -7,9 +7,14 @@
 package server
 
 import (
+	"crypto/tls"
+	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
 
 	"github.com/simonz05/filesrv"
 	"github.com/simonz05/filesrv/config"
@@ -19,20 +24,101 @@ import (
 	"github.com/simonz05/util/sig"
 )
 
-import _ "expvar"
-
 func Init(conf *config.Config) (io.Closer, error) {
 	c, err := newContextFromConfig(conf)
 	if err != nil {
 		return nil, err
 	}
-	err = installHandlers(c)
-	return io.Closer(c), err
+
+	// nothing is fetched from the origin on a config error
+	if err := installHandlers(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if conf.WarmSitemap != "" {
+		go warm(c, conf)
+	}
+
+	if p, ok := c.filesystem.(filesrv.Preloader); ok && len(conf.PreloadPaths) > 0 {
+		go func() {
+			opt := filesrv.WarmOptions{Workers: conf.WarmWorkers, Rate: conf.WarmRate}
+			n := p.Preload(conf.PreloadPaths, opt)
+			log.Printf("server: preloaded %d of %d files", n, len(conf.PreloadPaths))
+		}()
+	}
+
+	return io.Closer(c), nil
+}
+
+// warm loads the files listed by the configured sitemap into the cache.
+func warm(c *context, conf *config.Config) {
+	opt := filesrv.WarmOptions{
+		Workers: conf.WarmWorkers,
+		Rate:    conf.WarmRate,
+	}
+	n, err := filesrv.WarmSitemap(c.filesystem, conf.WarmSitemap, opt)
+
+	if err != nil {
+		log.Errorln("server: warm:", err)
+		return
+	}
+
+	log.Printf("server: warmed %d files", n)
 }
 
+// adminMux serves the admin endpoints on the admin listener when the
+// config has an AdminListen address.
+var adminMux = http.NewServeMux()
+
 func installHandlers(c *context) error {
+	fallback, err := parseAddrFallback(c.conf.RateLimitAddrFallback)
+
+	if err != nil {
+		return err
+	}
+
+	ratelimiter.AddrFallback = fallback
+	ratelimiter.TrustedHops = c.conf.RateLimitTrustedHops
+	ratelimiter.SetBuckets(c.conf.RateLimitBuckets)
+	ratelimiter.Rules = nil
+
+	for _, rule := range c.conf.RateLimitRules {
+		rr := RateRule{Pattern: rule.Pattern, Rate: rule.Rate, Capacity: rule.Capacity}
+
+		if rr.Capacity <= 0 {
+			rr.Capacity = int64(math.Ceil(rr.Rate))
+		}
+
+		if err := rr.validate(); err != nil {
+			return err
+		}
+
+		ratelimiter.Rules = append(ratelimiter.Rules, rr)
+	}
+
 	// global middleware
 	var middleware []func(http.Handler) http.Handler
+	statusHeaders, err := statusHeaderHandler(c.conf)
+
+	if err != nil {
+		return err
+	}
+
+	// outermost, so the errors of the other middleware get the headers
+	if statusHeaders != nil {
+		middleware = append(middleware, statusHeaders)
+	}
+
+	if format := c.conf.LogFormat; format != "" {
+		accessLog, err := accessLogHandler(format, os.Stdout)
+
+		if err != nil {
+			return err
+		}
+
+		middleware = append(middleware, accessLog)
+	}
 
 	switch log.Severity {
 	case log.LevelDebug:
@@ -43,22 +129,259 @@ func installHandlers(c *context) error {
 		middleware = append(middleware, handler.RecoveryHandler)
 	}
 
-	http.Handle("/", handler.Use(filesrv.FileServer(c.filesystem), middleware...))
+	middleware = append(middleware, inflightHandler)
+
+	if timeout := c.conf.RequestTimeout.Duration; timeout > 0 {
+		middleware = append(middleware, timeoutHandler(timeout))
+	}
+
+	if rate := c.conf.GlobalRateLimit; rate > 0 {
+		capacity := c.conf.GlobalRateLimitBurst
+
+		if capacity <= 0 {
+			capacity = int64(math.Ceil(rate))
+		}
+
+		ratelimiter.SetGlobalRate(rate, capacity)
+	}
+
+	if c.conf.GlobalRateLimit > 0 || len(ratelimiter.Rules) > 0 {
+		ratelimiter.FillRate, ratelimiter.Capacity = 0, 0
+
+		// with rules alone only the paths they match are limited
+		if c.conf.GlobalRateLimit > 0 {
+			ratelimiter.FillRate = float64(c.conf.HTTPRateLimit)
+			ratelimiter.Capacity = c.conf.HTTPRateLimit
+		}
+
+		middleware = append(middleware, ratelimitHandler)
+	}
+
+	if len(c.conf.AllowOrigin) > 0 {
+		middleware = append(middleware, corsHandler(c.conf.AllowOrigin))
+	}
+
+	if c.conf.BasicAuthUser != "" || c.conf.BasicAuthPassword != "" {
+		middleware = append(middleware, basicAuthHandler(c.conf.BasicAuthUser, c.conf.BasicAuthPassword))
+	}
+
+	opt := filesrv.ServeOptions{
+		RetryOnReadError: c.conf.RetryOnReadError,
+		IndexFiles:       c.conf.IndexFiles,
+		ForwardHeaders:   c.conf.ForwardHeaders,
+		TrackTransfers:   c.conf.TrackTransfers,
+		MaxAge:           c.conf.CacheControlMaxAge.Duration,
+		Via:              c.conf.Via,
+		Compress:         c.conf.Compress,
+		CompressMinSize:  c.conf.CompressMinSize,
+		Brotli:           c.conf.Brotli,
+		BrotliQuality:    c.conf.BrotliQuality,
+		Precompressed:    c.conf.Precompressed,
+		NotFoundFallback: c.conf.NotFoundFallback,
+		NoSniff:          c.conf.NoSniff,
+		InstanceID:       c.conf.InstanceID,
+
+		CacheStatusHeader: c.conf.CacheStatusHeader,
+		LargeTransferSize: c.conf.LargeTransferSize,
+		MaxTransfers:      c.conf.MaxTransfers,
+		MaxBandwidth:      c.conf.MaxBandwidth,
+	}
+
+	pages := map[int]string{
+		http.StatusBadGateway: c.conf.ErrorPagePath,
+		http.StatusNotFound:   c.conf.NotFoundPagePath,
+	}
+
+	for code, path := range pages {
+		if path == "" {
+			continue
+		}
+
+		page, err := os.ReadFile(path)
+
+		if err != nil {
+			return fmt.Errorf("server: error page: %v", err)
+		}
+
+		if opt.ErrorPages == nil {
+			opt.ErrorPages = make(map[int][]byte)
+		}
+
+		opt.ErrorPages[code] = page
+	}
+
+	for _, rule := range c.conf.ClientHints {
+		opt.ClientHints = append(opt.ClientHints, filesrv.ClientHintRule{
+			Pattern: rule.Pattern,
+			Headers: rule.Headers,
+		})
+	}
+
+	for _, rule := range c.conf.Placeholders {
+		opt.Placeholders = append(opt.Placeholders, filesrv.PlaceholderRule{
+			Prefix:      rule.Prefix,
+			Placeholder: rule.Placeholder,
+			MinSize:     rule.MinSize,
+		})
+	}
+
+	fileServer := filesrv.FileServerWithOptions(c.filesystem, opt)
+	http.Handle("/", handler.Use(stripPrefixHandler(c.conf.StripPrefix, fileServer), middleware...))
+
+	// the admin endpoints are served on the admin listener when there's
+	// one, on the public listener otherwise
+	admin := http.DefaultServeMux
+
+	if c.conf.AdminListen != "" {
+		admin = adminMux
+		handleDebug(admin)
+	}
+
+	// health checks are served on both listeners, for load balancers
+	installHealth(http.DefaultServeMux, c)
+
+	if admin != http.DefaultServeMux {
+		installHealth(admin, c)
+	}
+
+	publishMetrics(c, fileServer, opt)
+
+	if token := c.conf.AdminToken; token != "" {
+		if p, ok := c.filesystem.(filesrv.Purger); ok {
+			admin.Handle("/admin/purge", adminHandler(token, purgeHandler(p)))
+			admin.Handle("/admin/purge-all", adminHandler(token, purgeAllHandler(p)))
+		}
+
+		if p, ok := c.filesystem.(surrogatePurger); ok {
+			admin.Handle("/admin/purge-key", adminHandler(token, purgeKeyHandler(p)))
+		}
+
+		if m, ok := c.filesystem.(manifester); ok {
+			admin.Handle("/admin/manifest", adminHandler(token, manifestHandler(m, c.conf.ManifestPrefix)))
+		}
+
+		if l, ok := c.filesystem.(entryLister); ok {
+			admin.Handle("/debug/cache", adminHandler(token, cacheEntriesHandler(l)))
+		}
+	}
+
 	return nil
 }
 
-func ListenAndServe(laddr string, shutdown io.Closer) error {
-	l, err := net.Listen("tcp", laddr)
+// statusHeaderHandler returns a middleware setting the StatusHeaders of
+// conf on responses, or nil when there are none.
+func statusHeaderHandler(conf *config.Config) (func(http.Handler) http.Handler, error) {
+	if len(conf.StatusHeaders) == 0 {
+		return nil, nil
+	}
+
+	headers := make(map[int]http.Header)
+
+	for status, hdr := range conf.StatusHeaders {
+		code, err := strconv.Atoi(status)
+
+		if err != nil {
+			return nil, fmt.Errorf("server: invalid status %q: %v", status, err)
+		}
+
+		h := make(http.Header)
+
+		for k, v := range hdr {
+			h.Set(k, v)
+		}
+
+		headers[code] = h
+	}
+
+	return func(h http.Handler) http.Handler {
+		return filesrv.StatusHeaderHandler(h, headers)
+	}, nil
+}
+
+// installHealth registers the health checks on mux. They bypass the
+// middleware.
+func installHealth(mux *http.ServeMux, c *context) {
+	mux.HandleFunc("/healthz", healthHandler)
+
+	if c.originURL != "" {
+		mux.Handle("/readyz", readyHandler(c.originURL, http.DefaultClient))
+	} else {
+		mux.HandleFunc("/readyz", healthHandler)
+	}
+}
+
+func ListenAndServe(conf *config.Config, shutdown io.Closer) error {
+	tlsConf, err := tlsConfig(conf)
 
 	if err != nil {
 		return err
 	}
 
+	var admin net.Listener
+
+	if conf.AdminListen != "" {
+		admin, err = net.Listen("tcp", conf.AdminListen)
+
+		if err != nil {
+			return err
+		}
+
+		log.Printf("server: Admin listen on %s", admin.Addr())
+	}
+
+	l, err := net.Listen("tcp", conf.Listen)
+
+	if err != nil {
+		if admin != nil {
+			admin.Close()
+		}
+
+		return err
+	}
+
+	if tlsConf != nil {
+		l = tls.NewListener(l, tlsConf)
+	}
+
 	log.Printf("server: Listen on %s", l.Addr())
+	return serve(l, admin, conf, shutdown, sig.TrapCloser)
+}
+
+// serve serves requests on l, and the admin endpoints on admin unless
+// it's nil. The closer passed to trap gracefully shuts the server down:
+// the requests in progress are drained before shutdown is closed and serve
+// returns.
+func serve(l, admin net.Listener, conf *config.Config, shutdown io.Closer, trap func(io.Closer)) error {
+	srv := &http.Server{Handler: pprofGate(http.DefaultServeMux, conf.EnablePprof, conf.AdminToken)}
+	d := &drainer{
+		srv:     srv,
+		timeout: drainTimeout(conf),
+		done:    make(chan error, 1),
+	}
+	closers := []io.Closer{d}
+
+	if admin != nil {
+		// the debug handlers expvar and pprof register on the
+		// http.DefaultServeMux are served on the admin listener only
+		srv.Handler = withoutDebug(http.DefaultServeMux)
+		asrv := &http.Server{Handler: pprofGate(adminMux, conf.EnablePprof, conf.AdminToken)}
+		closers = append(closers, &drainer{srv: asrv, timeout: drainTimeout(conf), done: make(chan error, 1)})
+
+		go func() {
+			if err := asrv.Serve(admin); err != http.ErrServerClosed {
+				log.Errorln("server: admin:", err)
+			}
+		}()
+	}
 
-	closer := ioutil.MultiCloser([]io.Closer{l, shutdown})
-	sig.TrapCloser(closer)
-	err = http.Serve(l, nil)
+	closer := ioutil.MultiCloser(append(closers, shutdown))
+	trap(closer)
+	err := srv.Serve(l)
 	log.Printf("server: Shutting down ..")
+
+	if err == http.ErrServerClosed {
+		err = <-d.done
+	}
+
 	return err
 }
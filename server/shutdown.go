@@ -0,0 +1,51 @@
+// Copyright 2015 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	gocontext "context"
+	"net/http"
+	"time"
+
+	"github.com/simonz05/filesrv/config"
+	"github.com/simonz05/util/log"
+)
+
+// drainTimeout returns how long shutdown waits for requests in progress.
+func drainTimeout(conf *config.Config) time.Duration {
+	if conf.DrainTransfers {
+		return conf.DrainMax.Duration
+	}
+
+	return conf.DrainTimeout.Duration
+}
+
+// shutdown stops srv accepting connections and waits up to timeout for
+// the requests in progress to complete before closing their connections.
+func shutdown(srv *http.Server, timeout time.Duration) error {
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+
+	if err == gocontext.DeadlineExceeded {
+		log.Printf("server: drain timed out after %s", timeout)
+		return srv.Close()
+	}
+
+	return err
+}
+
+// drainer is an io.Closer shutting down a server.
+type drainer struct {
+	srv     *http.Server
+	timeout time.Duration
+	done    chan error
+}
+
+func (d *drainer) Close() error {
+	err := shutdown(d.srv, d.timeout)
+	d.done <- err
+	return err
+}
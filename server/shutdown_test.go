@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/simonz05/filesrv/config"
+	"github.com/simonz05/util/assert"
+)
+
+// slowHandler writes ten chunks 50ms apart.
+func slowHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Length", "10")
+
+	for i := 0; i < 10; i++ {
+		fmt.Fprint(w, i)
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestShutdownDrain")
+	tests := []struct {
+		timeout time.Duration
+		body    string
+		err     bool
+	}{
+		{2 * time.Second, "0123456789", false},
+		{100 * time.Millisecond, "", true},
+	}
+
+	for _, tt := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		ast.Nil(err)
+		srv := &http.Server{Handler: http.HandlerFunc(slowHandler)}
+		go srv.Serve(l)
+
+		res, err := http.Get("http://" + l.Addr().String())
+		ast.Nil(err)
+		start := time.Now()
+		go shutdown(srv, tt.timeout)
+
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		ast.Equal(tt.err, err != nil)
+
+		if tt.err {
+			ast.Equal(true, time.Since(start) < time.Second)
+			ast.Equal(true, len(body) < 10)
+		} else {
+			ast.Equal(tt.body, string(body))
+		}
+	}
+}
+
+// closeRecorder records when it's closed.
+type closeRecorder struct {
+	closed chan bool
+}
+
+func (c *closeRecorder) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestServeGracefulShutdown(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeGracefulShutdown")
+	defer func(h http.Handler) { http.DefaultServeMux = h.(*http.ServeMux) }(http.DefaultServeMux)
+	http.DefaultServeMux = http.NewServeMux()
+	http.HandleFunc("/slow", slowHandler)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ast.Nil(err)
+	conf := &config.Config{DrainTimeout: config.Duration{Duration: 2 * time.Second}}
+	shutdown := &closeRecorder{closed: make(chan bool)}
+	trapped := make(chan io.Closer, 1)
+	served := make(chan error, 1)
+
+	go func() {
+		served <- serve(l, nil, conf, shutdown, func(c io.Closer) { trapped <- c })
+	}()
+
+	closer := <-trapped
+	res, err := http.Get("http://" + l.Addr().String() + "/slow")
+	ast.Nil(err)
+	go closer.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	ast.Nil(err)
+	ast.Equal("0123456789", string(body))
+	ast.Nil(<-served)
+
+	select {
+	case <-shutdown.closed:
+	case <-time.After(time.Second):
+		t.Error("shutdown closer not called")
+	}
+}
+
+func TestServeAdminListener(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeAdminListener")
+	defer func(h http.Handler) { http.DefaultServeMux = h.(*http.ServeMux) }(http.DefaultServeMux)
+	defer func(mux *http.ServeMux) { adminMux = mux }(adminMux)
+	http.DefaultServeMux, adminMux = http.NewServeMux(), http.NewServeMux()
+
+	// the debug handlers expvar and pprof register as they're imported
+	handleDebug(http.DefaultServeMux)
+	handleDebug(adminMux)
+	http.Handle("/file.js", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	adminMux.Handle("/admin/purge-all", adminHandler("secret", purgeAllHandler(&fakePurger{})))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ast.Nil(err)
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	ast.Nil(err)
+	conf := &config.Config{AdminToken: "secret", EnablePprof: true, DrainTimeout: config.Duration{Duration: time.Second}}
+	trapped := make(chan io.Closer, 1)
+	served := make(chan error, 1)
+
+	go func() {
+		served <- serve(l, admin, conf, &closeRecorder{closed: make(chan bool)}, func(c io.Closer) { trapped <- c })
+	}()
+
+	closer := <-trapped
+	tests := []struct {
+		addr   net.Addr
+		method string
+		path   string
+		status int
+	}{
+		{l.Addr(), "GET", "/file.js", http.StatusOK},
+		{l.Addr(), "GET", "/debug/vars", http.StatusNotFound},
+		{l.Addr(), "GET", "/debug/pprof/", http.StatusNotFound},
+		{l.Addr(), "POST", "/admin/purge-all", http.StatusNotFound},
+		{admin.Addr(), "GET", "/debug/vars", http.StatusOK},
+		{admin.Addr(), "GET", "/debug/pprof/", http.StatusOK},
+		{admin.Addr(), "POST", "/admin/purge-all", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, "http://"+tt.addr.String()+tt.path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal(tt.status, res.StatusCode)
+	}
+
+	closer.Close()
+	ast.Nil(<-served)
+
+	// the admin listener is shut down along with the public one
+	_, err = http.Get("http://" + admin.Addr().String() + "/debug/vars")
+	ast.NotNil(err)
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	gocontext "context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// timeoutHandler responds with HTTP 503 to requests whose response hasn't
+// started within timeout, and cancels their context. Unlike
+// http.TimeoutHandler it doesn't buffer responses: a response started in
+// time, such as a large download to a slow client, runs to completion.
+func timeoutHandler(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := gocontext.WithCancel(r.Context())
+			defer cancel()
+			tw := &timeoutWriter{ResponseWriter: w, header: w.Header().Clone()}
+
+			t := time.AfterFunc(timeout, func() {
+				if tw.timeout() {
+					cancel()
+				}
+			})
+
+			h.ServeHTTP(tw, r.WithContext(ctx))
+			t.Stop()
+			tw.done()
+		})
+	}
+}
+
+// timeoutWriter holds the header of a response until it starts, so a
+// timeout can respond in its place.
+type timeoutWriter struct {
+	http.ResponseWriter
+	mu       sync.Mutex
+	header   http.Header
+	started  bool // the handler has written the response, or is done
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+// start sends the header of the handler with the response. It reports
+// false after a timeout.
+func (tw *timeoutWriter) start() bool {
+	if tw.timedOut {
+		return false
+	}
+
+	if !tw.started {
+		tw.started = true
+		dst := tw.ResponseWriter.Header()
+
+		for k := range dst {
+			delete(dst, k)
+		}
+
+		for k, v := range tw.header {
+			dst[k] = v
+		}
+	}
+
+	return true
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.start() {
+		tw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if !tw.start() {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	return tw.ResponseWriter.Write(b)
+}
+
+// timeout responds with HTTP 503 unless the response has started. It
+// reports whether it did.
+func (tw *timeoutWriter) timeout() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.started {
+		return false
+	}
+
+	tw.timedOut = true
+	http.Error(tw.ResponseWriter, "Service Unavailable", http.StatusServiceUnavailable)
+	return true
+}
+
+// done sends the header of a handler which didn't write a response, and
+// keeps a timeout from responding after the handler returned.
+func (tw *timeoutWriter) done() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.start()
+}
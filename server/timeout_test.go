@@ -0,0 +1,62 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/simonz05/util/assert"
+)
+
+func TestTimeoutHandler(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestTimeoutHandler")
+	h := timeoutHandler(50 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("late"))
+		case "/cancel":
+			<-r.Context().Done()
+		case "/stream":
+			// a response started in time isn't cut off
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("first"))
+			time.Sleep(100 * time.Millisecond)
+			w.Write([]byte(" last"))
+		default:
+			w.Header().Set("X-Fast", "1")
+		}
+	}))
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"/slow", http.StatusServiceUnavailable, "text/plain; charset=utf-8", "Service Unavailable\n"},
+		{"/cancel", http.StatusServiceUnavailable, "text/plain; charset=utf-8", "Service Unavailable\n"},
+		{"/stream", http.StatusOK, "application/octet-stream", "first last"},
+		{"/fast", http.StatusOK, "", ""},
+	}
+
+	for _, tt := range tests {
+		res, err := http.Get(server.URL + tt.path)
+		ast.Nil(err)
+		b, err := ioutil.ReadAll(res.Body)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal(tt.status, res.StatusCode)
+		ast.Equal(tt.contentType, res.Header.Get("Content-Type"))
+		ast.Equal(tt.body, string(b))
+
+		if tt.path == "/fast" {
+			ast.Equal("1", res.Header.Get("X-Fast"))
+		}
+	}
+}
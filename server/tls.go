@@ -0,0 +1,47 @@
+// Copyright 2015 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/simonz05/filesrv/config"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig returns the TLS config of the server or nil when the server
+// serves plain HTTP.
+func tlsConfig(conf *config.Config) (*tls.Config, error) {
+	if conf.TLSCertFile == "" && conf.TLSKeyFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("server: tls: %v", err)
+	}
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if v := conf.TLSMinVersion; v != "" {
+		min, ok := tlsVersions[v]
+
+		if !ok {
+			return nil, fmt.Errorf("server: invalid TLS version %q", v)
+		}
+
+		cfg.MinVersion = min
+	}
+
+	return cfg, nil
+}
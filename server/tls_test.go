@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/simonz05/filesrv/config"
+	"github.com/simonz05/util/assert"
+)
+
+// writeSelfSigned writes a self-signed certificate for 127.0.0.1 and its
+// key to dir.
+func writeSelfSigned(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	if err := os.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestTLSConfig")
+	certFile, keyFile := writeSelfSigned(t, t.TempDir())
+
+	cfg, err := tlsConfig(&config.Config{})
+	ast.Nil(err)
+	ast.Equal(true, cfg == nil)
+
+	_, err = tlsConfig(&config.Config{TLSCertFile: certFile, TLSKeyFile: "missing.pem"})
+	ast.NotNil(err)
+
+	_, err = tlsConfig(&config.Config{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSMinVersion: "2.0"})
+	ast.NotNil(err)
+
+	cfg, err = tlsConfig(&config.Config{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSMinVersion: "1.2"})
+	ast.Nil(err)
+	ast.Equal(uint16(tls.VersionTLS12), cfg.MinVersion)
+}
+
+func TestServeTLS(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestServeTLS")
+	defer func(h http.Handler) { http.DefaultServeMux = h.(*http.ServeMux) }(http.DefaultServeMux)
+	http.DefaultServeMux = http.NewServeMux()
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	})
+
+	certFile, keyFile := writeSelfSigned(t, t.TempDir())
+	conf := &config.Config{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSMinVersion: "1.2"}
+	cfg, err := tlsConfig(conf)
+	ast.Nil(err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ast.Nil(err)
+	trapped := make(chan io.Closer, 1)
+	served := make(chan error, 1)
+
+	go func() {
+		served <- serve(tls.NewListener(l, cfg), nil, conf, &closeRecorder{closed: make(chan bool)}, func(c io.Closer) { trapped <- c })
+	}()
+
+	closer := <-trapped
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	res, err := client.Get("https://" + l.Addr().String() + "/")
+	ast.Nil(err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	ast.Equal("secure", string(body))
+	ast.Equal(true, res.TLS != nil)
+
+	closer.Close()
+	ast.Nil(<-served)
+}
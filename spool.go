@@ -0,0 +1,90 @@
+package filesrv
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// defaultSpoolThreshold is the size above which files are spooled when
+// RemoteOptions.SpoolThreshold is zero.
+const defaultSpoolThreshold = 1 << 20
+
+// spoolFile is a temporary file holding a file fetched from the origin. It's
+// removed when closed.
+type spoolFile struct {
+	*os.File
+}
+
+func (f *spoolFile) Close() error {
+	err := f.File.Close()
+
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+
+	return err
+}
+
+func (fs *remoteFileSystem) spoolThreshold() int64 {
+	if t := fs.opt.SpoolThreshold; t > 0 {
+		return t
+	}
+
+	return defaultSpoolThreshold
+}
+
+// spools reports whether bodies of size bytes are spooled to disk.
+func (fs *remoteFileSystem) spools(size int64) bool {
+	return fs.opt.SpoolDir != "" && size > fs.spoolThreshold()
+}
+
+// newSpoolFile returns the file of the body of res written to a temporary
+// file in the spool directory. Spooled files aren't cached.
+func (fs *remoteFileSystem) newSpoolFile(res *http.Response, path, name string) (http.File, error) {
+	defer res.Body.Close()
+	tmp, err := ioutil.TempFile(fs.opt.SpoolDir, "filesrv-")
+
+	if err != nil {
+		return nil, err
+	}
+
+	sf := &spoolFile{tmp}
+	n, err := io.Copy(tmp, res.Body)
+
+	// a body of unknown length has a length of -1
+	if err == nil && res.ContentLength >= 0 && n != res.ContentLength {
+		err = ErrContentLength
+	}
+
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		sf.Close()
+		return nil, err
+	}
+
+	contentType, err := fs.contentType(res, tmp, name)
+
+	if err != nil {
+		sf.Close()
+		return nil, err
+	}
+
+	etag, err := fs.etag(res, tmp)
+
+	if err != nil {
+		sf.Close()
+		return nil, err
+	}
+
+	f := &file{ReadSeeker: sf, spooled: true, fi: originInfo(res, path, name)}
+	f.fi.size = int(n)
+	f.fi.contentType = contentType
+	f.fi.etag = etag
+
+	return f, nil
+}
@@ -0,0 +1,96 @@
+package filesrv
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var errStreamSeek = errors.New("filesrv: seek before the read position of a streamed file")
+
+// streamReader reads a file straight from an origin response body holding
+// the file from offset off. The first bytes of the body are kept, so the
+// head can be read again, but seeking further back than the head fails on
+// read. Seeking forward skips the body.
+type streamReader struct {
+	body    io.ReadCloser
+	head    []byte
+	off     int64 // offset of the body in the file
+	size    int64
+	pos     int64 // position seeked to
+	bodyPos int64 // position of body in the file
+}
+
+func newStreamReader(body io.ReadCloser, off, size int64, headLen int) (*streamReader, error) {
+	head := make([]byte, headLen)
+	n, err := io.ReadFull(body, head)
+
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+
+	r := &streamReader{
+		body:    body,
+		head:    head[:n],
+		off:     off,
+		size:    size,
+		pos:     off,
+		bodyPos: off + int64(n),
+	}
+
+	return r, nil
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.pos < r.off {
+		return 0, errOutsideRange
+	}
+
+	if r.pos < r.off+int64(len(r.head)) {
+		n := copy(p, r.head[r.pos-r.off:])
+		r.pos += int64(n)
+		return n, nil
+	}
+
+	if r.pos < r.bodyPos {
+		return 0, errStreamSeek
+	}
+
+	if r.pos > r.bodyPos {
+		n, err := io.CopyN(ioutil.Discard, r.body, r.pos-r.bodyPos)
+		r.bodyPos += n
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	r.bodyPos += int64(n)
+	return n, err
+}
+
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+
+	if offset < 0 {
+		return 0, errNegativePosition
+	}
+
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *streamReader) Close() error {
+	return r.body.Close()
+}
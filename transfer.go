@@ -0,0 +1,92 @@
+package filesrv
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transfer describes a response in progress.
+type Transfer struct {
+	Path     string        `json:"path"`
+	Sent     int64         `json:"sent"`
+	Size     int64         `json:"size"`
+	Duration time.Duration `json:"duration"`
+}
+
+// transferWriter counts the bytes written to a response.
+type transferWriter struct {
+	http.ResponseWriter
+	path  string
+	start time.Time
+	sent  int64
+	size  int64
+}
+
+func (w *transferWriter) WriteHeader(code int) {
+	if n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+		atomic.StoreInt64(&w.size, n)
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *transferWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(&w.sent, int64(n))
+	return n, err
+}
+
+func (w *transferWriter) transfer() Transfer {
+	return Transfer{
+		Path:     w.path,
+		Sent:     atomic.LoadInt64(&w.sent),
+		Size:     atomic.LoadInt64(&w.size),
+		Duration: time.Since(w.start),
+	}
+}
+
+// transferTracker keeps the set of responses in progress.
+type transferTracker struct {
+	active map[*transferWriter]bool
+	mu     sync.Mutex
+}
+
+func newTransferTracker() *transferTracker {
+	return &transferTracker{
+		active: make(map[*transferWriter]bool),
+	}
+}
+
+func (t *transferTracker) add(w http.ResponseWriter, r *http.Request) *transferWriter {
+	tw := &transferWriter{
+		ResponseWriter: w,
+		path:           r.URL.Path,
+		start:          time.Now(),
+	}
+
+	t.mu.Lock()
+	t.active[tw] = true
+	t.mu.Unlock()
+	return tw
+}
+
+func (t *transferTracker) del(tw *transferWriter) {
+	t.mu.Lock()
+	delete(t.active, tw)
+	t.mu.Unlock()
+}
+
+func (t *transferTracker) list() []Transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	transfers := make([]Transfer, 0, len(t.active))
+
+	for tw := range t.active {
+		transfers = append(transfers, tw.transfer())
+	}
+
+	return transfers
+}
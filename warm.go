@@ -0,0 +1,206 @@
+package filesrv
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// WarmOptions configures WarmSitemap and Preload.
+type WarmOptions struct {
+	// Workers is the number of files opened concurrently. Defaults to 4.
+	Workers int
+
+	// Rate is the number of files opened per second. Zero means no limit.
+	Rate float64
+
+	// Logger logs files which fail to open.
+	Logger Logger
+}
+
+// sitemap is a sitemap or a sitemap index as defined by
+// https://www.sitemaps.org/protocol.html.
+type sitemap struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// originClient returns the client and static header of the origin of fs,
+// or of the filesystem cached by fs, for requests such as sitemap fetches.
+// Filesystems not fetching over HTTP get the default client.
+func originClient(fs http.FileSystem) (*http.Client, http.Header) {
+	if mc, ok := fs.(*memoryCacheFilesystem); ok {
+		fs = mc.fs
+	}
+
+	if hc, ok := fs.(httpClienter); ok {
+		return hc.httpClient(), hc.staticHeader()
+	}
+
+	return defaultClient, nil
+}
+
+func fetchSitemap(client *http.Client, header http.Header, loc string) (*sitemap, error) {
+	req, err := http.NewRequest("GET", loc, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	res, err := client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sitemap %s: unexpected status %s", loc, res.Status)
+	}
+
+	sm := new(sitemap)
+	err = xml.NewDecoder(res.Body).Decode(sm)
+	return sm, err
+}
+
+// sitemapPaths returns the paths of the URLs listed by the sitemap at loc,
+// following a sitemap index one level deep. The sitemaps are fetched with
+// client, sending header.
+func sitemapPaths(client *http.Client, header http.Header, loc string, log Logger) ([]string, error) {
+	sm, err := fetchSitemap(client, header, loc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range sm.Sitemaps {
+		sub, err := fetchSitemap(client, header, s.Loc)
+
+		if err != nil {
+			log.Printf("warm: %v", err)
+			continue
+		}
+
+		sm.URLs = append(sm.URLs, sub.URLs...)
+	}
+
+	var names []string
+
+	for _, u := range sm.URLs {
+		pu, err := url.Parse(u.Loc)
+
+		if err != nil {
+			log.Printf("warm: %v", err)
+			continue
+		}
+
+		name := pu.Path
+
+		if pu.RawQuery != "" {
+			name += "?" + pu.RawQuery
+		}
+
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// WarmSitemap fetches the sitemap at loc and opens the files it lists from
+// fs, which is expected to be a cache. It returns the number of files
+// opened. Files which fail to open are logged and skipped. The sitemap is
+// fetched with the HTTP client and static header of the origin of fs.
+func WarmSitemap(fs http.FileSystem, loc string, opt WarmOptions) (int, error) {
+	client, header := originClient(fs)
+	names, err := sitemapPaths(client, header, loc, loggerOrDefault(opt.Logger))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return preload(fs, names, opt), nil
+}
+
+// Preloader is implemented by the caches returned by NewCache and
+// NewCacheWithOptions.
+type Preloader interface {
+	// Preload opens names to load them into the cache and returns the
+	// number of files opened. Files which fail to open are logged and
+	// skipped.
+	Preload(names []string, opt WarmOptions) int
+}
+
+// Preload implements Preloader.
+func (fs *memoryCacheFilesystem) Preload(names []string, opt WarmOptions) int {
+	return preload(fs, names, opt)
+}
+
+// preload opens names from fs with opt.Workers workers and returns the
+// number of files opened.
+func preload(fs http.FileSystem, names []string, opt WarmOptions) int {
+	workers := opt.Workers
+	log := loggerOrDefault(opt.Logger)
+
+	if workers <= 0 {
+		workers = 4
+	}
+
+	var tick <-chan time.Time
+
+	if opt.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opt.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	queue := make(chan string)
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	opened := 0
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for name := range queue {
+				f, err := fs.Open(name)
+
+				if err != nil {
+					log.Printf("warm: %s: %v", name, err)
+					continue
+				}
+
+				f.Close()
+				mu.Lock()
+				opened++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, name := range names {
+		if tick != nil {
+			<-tick
+		}
+
+		queue <- name
+	}
+
+	close(queue)
+	wg.Wait()
+	return opened
+}
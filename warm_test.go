@@ -0,0 +1,116 @@
+package filesrv
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/simonz05/util/assert"
+)
+
+func TestWarmSitemap(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestWarmSitemap")
+	var origin *httptest.Server
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>%s/assets.xml</loc></sitemap>
+</sitemapindex>`, origin.URL)
+		case "/assets.xml":
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%[1]s/app.js</loc></url>
+  <url><loc>%[1]s/app.css?v=2</loc></url>
+  <url><loc>%[1]s/missing.png</loc></url>
+</urlset>`, origin.URL)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	fs := newFakeFs()
+	fs.files["/app.js"] = newFile("app.js")
+	fs.files["/app.css?v=2"] = newFile("app.css")
+	cache := NewCache(fs, 10, 64)
+	defer cache.Close()
+
+	start := time.Now()
+	n, err := WarmSitemap(cache, origin.URL+"/sitemap.xml", WarmOptions{Workers: 2, Rate: 100})
+	ast.Nil(err)
+	ast.Equal(2, n)
+	ast.Equal(3, fs.openCnt)
+	ast.Equal(true, time.Since(start) >= 20*time.Millisecond)
+
+	// warmed files are served from the cache
+	_, err = cache.Open("/app.js")
+	ast.Nil(err)
+	_, err = cache.Open("/app.css?v=2")
+	ast.Nil(err)
+	ast.Equal(3, fs.openCnt)
+
+	_, err = WarmSitemap(cache, origin.URL+"/none.xml", WarmOptions{})
+	ast.NotNil(err)
+}
+
+func TestPreload(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestPreload")
+	fs := newFakeFs()
+	fs.files["/app.js"] = newFile("app.js")
+	fs.files["/app.css"] = newFile("app.css")
+	cache := NewCache(fs, 10, 64)
+	defer cache.Close()
+
+	n := cache.(Preloader).Preload([]string{"/app.js", "/app.css", "/missing.png"}, WarmOptions{Workers: 2})
+	ast.Equal(2, n)
+	ast.Equal(3, fs.openCnt)
+
+	for _, name := range []string{"/app.js", "/app.css"} {
+		f, err := cache.Open(name)
+		ast.Nil(err)
+		f.Close()
+	}
+
+	ast.Equal(3, fs.openCnt)
+}
+
+func TestWarmSitemapOriginHeader(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestWarmSitemapOriginHeader")
+	var origin *httptest.Server
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%s/app.js</loc></url>
+</urlset>`, origin.URL)
+		default:
+			w.Write([]byte("app()"))
+		}
+	}))
+	defer origin.Close()
+
+	header := http.Header{"Authorization": {"Bearer secret"}}
+	cache := NewCache(NewWithOptions(origin.URL, RemoteOptions{Header: header}), 10, 1024)
+	defer cache.Close()
+
+	// the sitemap is fetched with the static header of the origin
+	n, err := WarmSitemap(cache, origin.URL+"/sitemap.xml", WarmOptions{})
+	ast.Nil(err)
+	ast.Equal(1, n)
+
+	// filesystems without an HTTP origin send no header
+	local := NewCache(newFakeFs(), 10, 64)
+	defer local.Close()
+	_, err = WarmSitemap(local, origin.URL+"/sitemap.xml", WarmOptions{})
+	ast.NotNil(err)
+}